@@ -0,0 +1,246 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+const adminUnixSocketPrefix = "unix:"
+
+// 管理用 HTTP API
+type adminServer struct {
+	main *Main
+	// drain 完了後にプロセスを終了する
+	shutdown context.CancelFunc
+	draining atomic.Bool
+}
+
+type AdminStatus struct {
+	Version        string `json:"version"`
+	Mode           string `json:"mode"`
+	Paused         bool   `json:"paused"`
+	Draining       bool   `json:"draining"`
+	QueuedFiles    int    `json:"queued_files"`
+	InFlightFiles  int    `json:"in_flight_files"`
+	Recordings     int    `json:"recordings"`
+	RecentFailures int    `json:"recent_failures"`
+}
+
+type AdminQueue struct {
+	Queued   []*QueuedFile   `json:"queued"`
+	InFlight []*InFlightFile `json:"in_flight"`
+}
+
+type AdminRequeueRequest struct {
+	// 録画 ID または相対パス
+	Recording string `json:"recording"`
+}
+
+type AdminRequeueResponse struct {
+	Recording          string `json:"recording"`
+	QuarantineRequeued int    `json:"quarantine_requeued"`
+	EvacuateRestored   int    `json:"evacuate_restored"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func newAdminServer(m *Main, shutdown context.CancelFunc) *adminServer {
+	return &adminServer{
+		main:     m,
+		shutdown: shutdown,
+	}
+}
+
+func (s *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", s.handleStatus)
+	mux.HandleFunc("GET /v1/queue", s.handleQueue)
+	mux.HandleFunc("GET /v1/recordings", s.handleRecordings)
+	mux.HandleFunc("GET /v1/failures", s.handleFailures)
+	mux.HandleFunc("GET /v1/config", s.handleConfig)
+	mux.HandleFunc("POST /v1/pause", s.handlePause)
+	mux.HandleFunc("POST /v1/resume", s.handleResume)
+	mux.HandleFunc("POST /v1/drain", s.handleDrain)
+	mux.HandleFunc("POST /v1/requeue", s.handleRequeue)
+	return mux
+}
+
+// 管理用 HTTP API を起動する
+func runAdminServer(ctx context.Context, config *Config, m *Main, shutdown context.CancelFunc) error {
+	listener, err := listenAdmin(config.AdminListenAddr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           newAdminServer(m, shutdown).handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zlog.Error().Err(err).Str("listen_addr", config.AdminListenAddr).Msg("ADMIN-SERVER-ERROR")
+		}
+	}()
+	zlog.Info().Str("listen_addr", config.AdminListenAddr).Msg("STARTED-ADMIN-SERVER")
+	return nil
+}
+
+func listenAdmin(listenAddr string) (net.Listener, error) {
+	if socketPath, ok := strings.CutPrefix(listenAddr, adminUnixSocketPrefix); ok {
+		// 前回の起動で残ったソケットファイルを削除する
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		// 実行ユーザー以外からは操作させない
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", listenAddr)
+}
+
+func (s *adminServer) status() *AdminStatus {
+	mode := "timer"
+	if s.main.currentConfig().ScanIntervalS > 0 {
+		mode = "resident"
+	}
+	return &AdminStatus{
+		Version:        Version,
+		Mode:           mode,
+		Paused:         uploadPause.paused(),
+		Draining:       s.draining.Load(),
+		QueuedFiles:    len(uploadStatus.queuedFiles()),
+		InFlightFiles:  uploadStatus.inFlightCount(),
+		Recordings:     len(s.main.recordingStates()),
+		RecentFailures: len(uploadStatus.recentFailures()),
+	}
+}
+
+func (s *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.status())
+}
+
+func (s *adminServer) handleQueue(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, &AdminQueue{
+		Queued:   uploadStatus.queuedFiles(),
+		InFlight: uploadStatus.inFlightFiles(),
+	})
+}
+
+func (s *adminServer) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.main.recordingStates())
+}
+
+func (s *adminServer) handleFailures(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, uploadStatus.recentFailures())
+}
+
+func (s *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, s.main.currentConfig().redacted())
+}
+
+func (s *adminServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	uploadPause.pause()
+	zlog.Info().Msg("ADMIN-PAUSED-UPLOADS")
+	writeAdminJSON(w, http.StatusOK, s.status())
+}
+
+func (s *adminServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeAdminJSON(w, http.StatusConflict, &adminError{Error: "draining"})
+		return
+	}
+	uploadPause.resume()
+	zlog.Info().Msg("ADMIN-RESUMED-UPLOADS")
+	writeAdminJSON(w, http.StatusOK, s.status())
+}
+
+// 新しいファイルの受け取りを止め、処理中のファイルがなくなったら終了する
+func (s *adminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if s.draining.CompareAndSwap(false, true) {
+		uploadPause.pause()
+		zlog.Info().
+			Int("in_flight_files", uploadStatus.inFlightCount()).
+			Msg("ADMIN-DRAIN-STARTED")
+		go func() {
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			for uploadStatus.inFlightCount() > 0 {
+				<-ticker.C
+			}
+			zlog.Info().Msg("ADMIN-DRAIN-COMPLETED")
+			s.shutdown()
+		}()
+	}
+	writeAdminJSON(w, http.StatusAccepted, s.status())
+}
+
+// 隔離ディレクトリと退避ディレクトリから録画を戻し、常駐モードではすぐに探索する
+func (s *adminServer) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	var req AdminRequeueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminJSON(w, http.StatusBadRequest, &adminError{Error: err.Error()})
+		return
+	}
+	if req.Recording == "" {
+		writeAdminJSON(w, http.StatusBadRequest, &adminError{Error: "recording is required"})
+		return
+	}
+
+	config := s.main.currentConfig()
+	res := &AdminRequeueResponse{Recording: req.Recording}
+	if config.QuarantineDirFullPath != "" {
+		requeued, err := requeueQuarantinedFiles(config, []string{req.Recording})
+		if err != nil && !os.IsNotExist(err) {
+			writeAdminJSON(w, http.StatusInternalServerError, &adminError{Error: err.Error()})
+			return
+		}
+		res.QuarantineRequeued = requeued
+	}
+	restored, err := restoreEvacuatedRecordings(config, req.Recording)
+	res.EvacuateRestored = restored
+	if err != nil {
+		writeAdminJSON(w, http.StatusInternalServerError, &adminError{Error: err.Error()})
+		return
+	}
+	if res.QuarantineRequeued == 0 && res.EvacuateRestored == 0 {
+		writeAdminJSON(w, http.StatusNotFound, &adminError{Error: "recording not found"})
+		return
+	}
+
+	zlog.Info().
+		Str("recording", req.Recording).
+		Int("quarantine_requeued", res.QuarantineRequeued).
+		Int("evacuate_restored", res.EvacuateRestored).
+		Msg("ADMIN-REQUEUED-RECORDING")
+	s.main.requestRescan()
+	writeAdminJSON(w, http.StatusOK, res)
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zlog.Error().Err(err).Msg("ADMIN-RESPONSE-ENCODE-ERROR")
+	}
+}
@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminConfigRedacted(t *testing.T) {
+	config := &Config{
+		ObjectStorageAccessKeyID:     "access-key",
+		ObjectStorageSecretAccessKey: "secret-key",
+		WebhookBasicAuthUsername:     "user",
+		WebhookBasicAuthPassword:     "password",
+		UploadWorkers:                4,
+	}
+	s := newAdminServer(newMain(config), func() {})
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/config", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, "access-key", got["object_storage_access_key_id"])
+	assert.Equal(t, redactedValue, got["object_storage_secret_access_key"])
+	assert.Equal(t, "user", got["webhook_basic_auth_username"])
+	assert.Equal(t, redactedValue, got["webhook_basic_auth_password"])
+	assert.Equal(t, float64(4), got["upload_workers"])
+	assert.NotContains(t, rec.Body.String(), "secret-key")
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	config := &Config{}
+	s := newAdminServer(newMain(config), func() {})
+	t.Cleanup(uploadPause.resume)
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/pause", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, uploadPause.paused())
+
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/resume", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, uploadPause.paused())
+}
+
+func TestAdminRequeueEvacuatedRecording(t *testing.T) {
+	root := t.TempDir()
+	archiveDir := filepath.Join(root, "archive")
+	evacuateDir := filepath.Join(root, "evacuate")
+	writeTestFile(t, filepath.Join(evacuateDir, "REC1", "archive-A.json"))
+	writeTestFile(t, filepath.Join(evacuateDir, "REC1", "archive-A.webm"))
+
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: archiveDir, EvacuateDirFullPath: evacuateDir},
+		},
+	}
+	m := newMain(config)
+	s := newAdminServer(m, func() {})
+
+	rec := httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/requeue", strings.NewReader(`{"recording":"REC1"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got AdminRequeueResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, 1, got.EvacuateRestored)
+	assert.FileExists(t, filepath.Join(archiveDir, "REC1", "archive-A.webm"))
+	_, err := os.Stat(filepath.Join(evacuateDir, "REC1"))
+	assert.True(t, os.IsNotExist(err))
+	// 常駐モードですぐに探索する
+	assert.Len(t, m.rescan, 1)
+
+	rec = httptest.NewRecorder()
+	s.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/requeue", strings.NewReader(`{"recording":"REC2"}`)))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
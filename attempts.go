@@ -0,0 +1,424 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	zlog "github.com/rs/zerolog/log"
+	base32 "github.com/shogo82148/go-clockwork-base32"
+)
+
+const (
+	DefaultUploadRetryBackoffInitialS = 60
+	DefaultUploadRetryBackoffMaxS     = 3600
+
+	DefaultWebhookTypeUploadFailed = "upload.failed"
+)
+
+// ファイルごとに保持するエラー履歴の件数
+const uploadAttemptErrorsLimit = 20
+
+// upload_failed_dir_full_path に移動した録画ディレクトリに書き出す失敗履歴のファイル名
+// archive- や report- で始まらないため、戻した後も処理対象のファイルとして扱われない
+const uploadFailedFilename = "upload-failed.json"
+
+// 録画ディレクトリごとのアップロードの失敗履歴
+type RecordingAttempts struct {
+	RecordingDir string `json:"recording_dir"`
+	// ファイル名ごとの失敗履歴
+	Files map[string]*FileAttempts `json:"files"`
+}
+
+type FileAttempts struct {
+	// 失敗した回数
+	Attempts int `json:"attempts"`
+	// この時刻を過ぎるまで録画ディレクトリを処理しない
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	// 古いものから uploadAttemptErrorsLimit 件まで保持する
+	Errors []*AttemptError `json:"errors"`
+}
+
+type AttemptError struct {
+	Timestamp    time.Time `json:"timestamp"`
+	ErrorCode    string    `json:"error_code,omitempty"`
+	ErrorReason  string    `json:"error_reason,omitempty"`
+	ErrorClass   string    `json:"error_class,omitempty"`
+	ErrorMessage string    `json:"error_message"`
+}
+
+func (c Config) uploadAttemptsEnabled() bool {
+	return c.UploadAttemptsDirFullPath != ""
+}
+
+// attempts 回目の失敗の後、次に処理するまでの待ち時間を返す
+func (c Config) uploadRetryBackoff(attempts int) time.Duration {
+	initial := time.Duration(c.UploadRetryBackoffInitialS) * time.Second
+	if initial <= 0 {
+		initial = DefaultUploadRetryBackoffInitialS * time.Second
+	}
+	maxBackoff := time.Duration(c.UploadRetryBackoffMaxS) * time.Second
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultUploadRetryBackoffMaxS * time.Second
+	}
+	backoff := initial
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+func (c Config) webhookTypeUploadFailed() string {
+	if c.WebhookTypeUploadFailed == "" {
+		return DefaultWebhookTypeUploadFailed
+	}
+	return c.WebhookTypeUploadFailed
+}
+
+// 失敗履歴のファイルのパスを返す
+// 録画ディレクトリの移動や共有ストレージのマウント先に影響されないように、アーカイブディレクトリからの相対パスを使う
+func uploadAttemptsFilePath(config *Config, recordingDir string) string {
+	return filepath.Join(config.UploadAttemptsDirFullPath, config.recordingName(recordingDir)+".json")
+}
+
+// 失敗履歴がない場合は空の履歴を返す
+func loadRecordingAttempts(config *Config, recordingDir string) (*RecordingAttempts, error) {
+	attempts := &RecordingAttempts{
+		RecordingDir: recordingDir,
+		Files:        make(map[string]*FileAttempts),
+	}
+	raw, err := os.ReadFile(uploadAttemptsFilePath(config, recordingDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return attempts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, attempts); err != nil {
+		return nil, err
+	}
+	if attempts.Files == nil {
+		attempts.Files = make(map[string]*FileAttempts)
+	}
+	return attempts, nil
+}
+
+// 失敗したファイルがなくなった場合は失敗履歴のファイルを削除する
+func (a *RecordingAttempts) save(config *Config) error {
+	path := uploadAttemptsFilePath(config, a.RecordingDir)
+	if len(a.Files) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeJSONFileAtomic(path, a)
+}
+
+// 処理できるまでの待ち時間が最も長いファイルの時刻を返す
+func (a *RecordingAttempts) nextAttemptAt() time.Time {
+	var next time.Time
+	for _, f := range a.Files {
+		if f.NextAttemptAt.After(next) {
+			next = f.NextAttemptAt
+		}
+	}
+	return next
+}
+
+// 失敗した回数が最も多いファイルの回数を返す
+func (a *RecordingAttempts) maxAttempts() int {
+	var attempts int
+	for _, f := range a.Files {
+		attempts = max(attempts, f.Attempts)
+	}
+	return attempts
+}
+
+// ファイルの処理に失敗したことを記録する
+// retry-now に分類したエラーの場合は待ち時間を空けない
+func recordUploadFailure(config *Config, filePath string, cause error, classification ErrorClassification) (*FileAttempts, error) {
+	attempts, err := loadRecordingAttempts(config, filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Base(filePath)
+	fa, ok := attempts.Files[filename]
+	if !ok {
+		fa = &FileAttempts{}
+		attempts.Files[filename] = fa
+	}
+	now := time.Now().UTC()
+	fa.Attempts++
+	fa.NextAttemptAt = now
+	if classification.Class != ErrorClassRetryNow {
+		fa.NextAttemptAt = now.Add(config.uploadRetryBackoff(fa.Attempts))
+	}
+	var message string
+	if cause != nil {
+		message = cause.Error()
+	}
+	fa.Errors = append(fa.Errors, &AttemptError{
+		Timestamp:    now,
+		ErrorCode:    minio.ToErrorResponse(cause).Code,
+		ErrorReason:  classification.Reason,
+		ErrorClass:   classification.Class,
+		ErrorMessage: message,
+	})
+	if len(fa.Errors) > uploadAttemptErrorsLimit {
+		fa.Errors = fa.Errors[len(fa.Errors)-uploadAttemptErrorsLimit:]
+	}
+	if err := attempts.save(config); err != nil {
+		return nil, err
+	}
+	return fa, nil
+}
+
+// ファイルの処理に成功した場合は失敗履歴を削除する
+func clearUploadFailure(config *Config, filePath string) error {
+	attempts, err := loadRecordingAttempts(config, filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	filename := filepath.Base(filePath)
+	if _, ok := attempts.Files[filename]; !ok {
+		return nil
+	}
+	delete(attempts.Files, filename)
+	return attempts.save(config)
+}
+
+// これまでに失敗した回数を返す
+func previousUploadAttempts(config *Config, filePath string) int {
+	if !config.uploadAttemptsEnabled() {
+		return 0
+	}
+	attempts, err := loadRecordingAttempts(config, filepath.Dir(filePath))
+	if err != nil {
+		return 0
+	}
+	if fa, ok := attempts.Files[filepath.Base(filePath)]; ok {
+		return fa.Attempts
+	}
+	return 0
+}
+
+// アップローダーの処理結果を失敗履歴に反映する
+func recordUploadResult(config *Config, result UploaderResult) {
+	if !config.uploadAttemptsEnabled() || result.Excluded {
+		return
+	}
+	if result.Success {
+		if err := clearUploadFailure(config, result.Filepath); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", result.Filepath).
+				Msg("FAILED-CLEAR-UPLOAD-ATTEMPTS")
+		}
+		return
+	}
+	switch result.ErrorClass {
+	case ErrorClassSkip:
+		return
+	case ErrorClassQuarantine:
+		// 隔離したファイルは録画ディレクトリに残らないので失敗履歴も削除する
+		if config.QuarantineDirFullPath != "" {
+			if err := clearUploadFailure(config, result.Filepath); err != nil {
+				zlog.Error().
+					Err(err).
+					Str("path", result.Filepath).
+					Msg("FAILED-CLEAR-UPLOAD-ATTEMPTS")
+			}
+			return
+		}
+	}
+	classification := ErrorClassification{Reason: result.ErrorReason, Class: result.ErrorClass}
+	fa, err := recordUploadFailure(config, result.Filepath, result.Err, classification)
+	if err != nil {
+		zlog.Error().
+			Err(err).
+			Str("path", result.Filepath).
+			Msg("FAILED-RECORD-UPLOAD-ATTEMPTS")
+		return
+	}
+	zlog.Warn().
+		Str("path", result.Filepath).
+		Str("error_reason", result.ErrorReason).
+		Str("error_class", result.ErrorClass).
+		Int("attempts", fa.Attempts).
+		Int("max_attempts", config.UploadMaxAttempts).
+		Time("next_attempt_at", fa.NextAttemptAt).
+		Msg("RECORDED-UPLOAD-FAILURE")
+}
+
+// 失敗履歴に従って、処理するファイルを返す
+// 失敗した回数が upload_max_attempts に達した録画ディレクトリは upload_failed_dir_full_path に移動し、
+// 次に処理する時刻になっていない録画ディレクトリは処理しない
+func applyUploadAttempts(config *Config, files []string) []string {
+	if !config.uploadAttemptsEnabled() {
+		return files
+	}
+	filesByDir := make(map[string][]string)
+	var dirs []string
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if _, ok := filesByDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		filesByDir[dir] = append(filesByDir[dir], f)
+	}
+
+	now := time.Now()
+	var result []string
+	for _, dir := range dirs {
+		attempts, err := loadRecordingAttempts(config, dir)
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", dir).
+				Msg("FAILED-LOAD-UPLOAD-ATTEMPTS")
+			result = append(result, filesByDir[dir]...)
+			continue
+		}
+		// 隔離や手動の操作で録画ディレクトリからなくなったファイルの履歴は削除する
+		if attempts.pruneMissingFiles() {
+			if err := attempts.save(config); err != nil {
+				zlog.Error().
+					Err(err).
+					Str("path", dir).
+					Msg("FAILED-SAVE-UPLOAD-ATTEMPTS")
+			}
+		}
+
+		switch uploadAttemptsAction(config, attempts, now) {
+		case PlanActionMoveToFailed:
+			moveFailedRecording(config, attempts)
+			continue
+		case PlanActionBackoff:
+			zlog.Info().
+				Str("path", dir).
+				Int("attempts", attempts.maxAttempts()).
+				Time("next_attempt_at", attempts.nextAttemptAt()).
+				Msg("UPLOAD-BACKOFF")
+			continue
+		}
+		result = append(result, filesByDir[dir]...)
+	}
+	return result
+}
+
+// 録画ディレクトリからなくなったファイルの履歴を削除する
+// 失敗履歴のファイルは更新しない、削除した場合は true を返す
+func (a *RecordingAttempts) pruneMissingFiles() bool {
+	var pruned bool
+	for filename := range a.Files {
+		if _, err := os.Stat(filepath.Join(a.RecordingDir, filename)); errors.Is(err, os.ErrNotExist) {
+			delete(a.Files, filename)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// 失敗履歴に従った録画ディレクトリの扱いを返す
+// upload_failed_dir_full_path に移動する場合は move-to-failed、次に処理する時刻になっていない場合は backoff、
+// 処理する場合は空文字を返す
+func uploadAttemptsAction(config *Config, attempts *RecordingAttempts, now time.Time) string {
+	if config.UploadMaxAttempts > 0 && attempts.maxAttempts() >= config.UploadMaxAttempts {
+		return PlanActionMoveToFailed
+	}
+	if attempts.nextAttemptAt().After(now) {
+		return PlanActionBackoff
+	}
+	return ""
+}
+
+// 失敗した回数が上限に達した録画ディレクトリを失敗履歴と一緒に移動し、upload.failed ウェブフックを送信する
+func moveFailedRecording(config *Config, attempts *RecordingAttempts) {
+	dir := attempts.RecordingDir
+	newDirPath := config.relocatedPath(dir, config.UploadFailedDirFullPath)
+	if err := os.MkdirAll(filepath.Dir(newDirPath), 0755); err != nil {
+		zlog.Error().
+			Err(err).
+			Str("upload_failed_dir_path", filepath.Dir(newDirPath)).
+			Msg("UPLOAD-FAILED-DIRECTORY-CREATE-ERROR")
+		return
+	}
+	if err := os.Rename(dir, newDirPath); err != nil {
+		zlog.Error().
+			Err(err).
+			Str("old_path", dir).
+			Str("new_path", newDirPath).
+			Msg("UPLOAD-FAILED-RECORDING-MOVE-ERROR")
+		return
+	}
+	if err := writeJSONFileAtomic(filepath.Join(newDirPath, uploadFailedFilename), attempts); err != nil {
+		zlog.Error().
+			Err(err).
+			Str("path", newDirPath).
+			Msg("UPLOAD-FAILED-FILE-WRITE-ERROR")
+	}
+	runSummary.recordingFailed()
+	zlog.Error().
+		Str("old_path", dir).
+		Str("new_path", newDirPath).
+		Int("attempts", attempts.maxAttempts()).
+		Strs("files", attempts.filenames()).
+		Msg("MOVED-UPLOAD-FAILED-RECORDING")
+
+	if config.WebhookEndpointURL != "" {
+		if err := postUploadFailedWebhook(config, attempts, newDirPath); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", newDirPath).
+				Msg("UPLOAD-FAILED-WEBHOOK-SEND-ERROR")
+		}
+	}
+
+	attempts.Files = nil
+	if err := attempts.save(config); err != nil {
+		zlog.Error().
+			Err(err).
+			Str("path", dir).
+			Msg("FAILED-SAVE-UPLOAD-ATTEMPTS")
+	}
+}
+
+func (a *RecordingAttempts) filenames() []string {
+	var result []string
+	for filename := range a.Files {
+		result = append(result, filename)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func postUploadFailedWebhook(config *Config, attempts *RecordingAttempts, failedDirPath string) error {
+	webhookID, err := generateWebhookID(base32.NewEncoding())
+	if err != nil {
+		return err
+	}
+	webhookType := config.webhookTypeUploadFailed()
+	w := WebhookUploadFailed{
+		ID:            webhookID,
+		Type:          webhookType,
+		Timestamp:     time.Now().UTC(),
+		RecordingID:   filepath.Base(attempts.RecordingDir),
+		RecordingDir:  attempts.RecordingDir,
+		FailedDirPath: failedDirPath,
+		Files:         attempts.Files,
+	}
+	buf, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return postWebhook(context.Background(), config, webhookType, buf)
+}
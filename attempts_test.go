@@ -0,0 +1,120 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadRetryBackoff(t *testing.T) {
+	config := &Config{}
+	assert.Equal(t, 60*time.Second, config.uploadRetryBackoff(1))
+	assert.Equal(t, 120*time.Second, config.uploadRetryBackoff(2))
+	assert.Equal(t, 3600*time.Second, config.uploadRetryBackoff(100))
+
+	config = &Config{UploadRetryBackoffInitialS: 10, UploadRetryBackoffMaxS: 30}
+	assert.Equal(t, 10*time.Second, config.uploadRetryBackoff(1))
+	assert.Equal(t, 20*time.Second, config.uploadRetryBackoff(2))
+	assert.Equal(t, 30*time.Second, config.uploadRetryBackoff(3))
+}
+
+func newAttemptsTestConfig(t *testing.T) *Config {
+	root := t.TempDir()
+	return &Config{
+		UploadAttemptsDirFullPath: filepath.Join(root, "attempts"),
+		UploadFailedDirFullPath:   filepath.Join(root, "failed"),
+		ArchiveRoots: []*ArchiveRoot{
+			{Name: "default", ArchiveDirFullPath: filepath.Join(root, "archive")},
+		},
+	}
+}
+
+func TestRecordUploadFailure(t *testing.T) {
+	config := newAttemptsTestConfig(t)
+	archiveDir := config.ArchiveRoots[0].ArchiveDirFullPath
+	jsonFilePath := filepath.Join(archiveDir, "REC1", "archive-A.json")
+	writeTestFile(t, jsonFilePath)
+
+	recordUploadResult(config, UploaderResult{Filepath: jsonFilePath, Err: errors.New("timeout")})
+	recordUploadResult(config, UploaderResult{Filepath: jsonFilePath, Err: errors.New("connection reset")})
+	assert.Equal(t, 2, previousUploadAttempts(config, jsonFilePath))
+
+	attempts, err := loadRecordingAttempts(config, filepath.Dir(jsonFilePath))
+	require.NoError(t, err)
+	fa := attempts.Files["archive-A.json"]
+	require.NotNil(t, fa)
+	assert.Equal(t, 2, fa.Attempts)
+	require.Len(t, fa.Errors, 2)
+	assert.Equal(t, "timeout", fa.Errors[0].ErrorMessage)
+	assert.Equal(t, "connection reset", fa.Errors[1].ErrorMessage)
+	assert.FileExists(t, filepath.Join(config.UploadAttemptsDirFullPath, "default", "REC1.json"))
+
+	// 成功したら履歴を削除する
+	recordUploadResult(config, UploaderResult{Success: true, Filepath: jsonFilePath})
+	assert.Equal(t, 0, previousUploadAttempts(config, jsonFilePath))
+	assert.NoFileExists(t, filepath.Join(config.UploadAttemptsDirFullPath, "default", "REC1.json"))
+
+	// skip は記録せず、retry-now は待ち時間を空けない
+	recordUploadResult(config, UploaderResult{Filepath: jsonFilePath, Err: context.Canceled, ErrorClass: ErrorClassSkip})
+	assert.Equal(t, 0, previousUploadAttempts(config, jsonFilePath))
+	recordUploadResult(config, UploaderResult{Filepath: jsonFilePath, Err: errors.New("timeout"), ErrorReason: ErrorReasonTimeout, ErrorClass: ErrorClassRetryNow})
+	attempts, err = loadRecordingAttempts(config, filepath.Dir(jsonFilePath))
+	require.NoError(t, err)
+	fa = attempts.Files["archive-A.json"]
+	require.NotNil(t, fa)
+	assert.Equal(t, 1, fa.Attempts)
+	assert.False(t, fa.NextAttemptAt.After(time.Now()))
+	assert.Equal(t, ErrorReasonTimeout, fa.Errors[0].ErrorReason)
+	assert.Equal(t, ErrorClassRetryNow, fa.Errors[0].ErrorClass)
+}
+
+func TestApplyUploadAttempts(t *testing.T) {
+	config := newAttemptsTestConfig(t)
+	config.UploadMaxAttempts = 3
+	archiveDir := config.ArchiveRoots[0].ArchiveDirFullPath
+	rec1 := filepath.Join(archiveDir, "REC1", "archive-A.json")
+	rec2 := filepath.Join(archiveDir, "REC2", "archive-B.json")
+	rec3 := filepath.Join(archiveDir, "REC3", "archive-C.json")
+	for _, f := range []string{rec1, rec2, rec3} {
+		writeTestFile(t, f)
+	}
+
+	// REC1 は待ち時間中
+	recordUploadResult(config, UploaderResult{Filepath: rec1, Err: errors.New("timeout")})
+	// REC2 は上限に達した
+	for range 3 {
+		recordUploadResult(config, UploaderResult{Filepath: rec2, Err: errors.New("timeout")})
+	}
+	// REC3 は待ち時間を過ぎた
+	attempts, err := loadRecordingAttempts(config, filepath.Dir(rec3))
+	require.NoError(t, err)
+	attempts.Files["archive-C.json"] = &FileAttempts{Attempts: 1, NextAttemptAt: time.Now().Add(-time.Second)}
+	// 録画ディレクトリからなくなったファイルの履歴は削除する
+	attempts.Files["archive-D.json"] = &FileAttempts{Attempts: 2, NextAttemptAt: time.Now().Add(time.Hour)}
+	require.NoError(t, attempts.save(config))
+
+	files := applyUploadAttempts(config, []string{rec1, rec2, rec3})
+	assert.Equal(t, []string{rec3}, files)
+
+	attempts, err = loadRecordingAttempts(config, filepath.Dir(rec3))
+	require.NoError(t, err)
+	assert.NotContains(t, attempts.Files, "archive-D.json")
+
+	// 上限に達した録画ディレクトリは失敗履歴と一緒に移動する
+	assert.NoDirExists(t, filepath.Dir(rec2))
+	raw, err := os.ReadFile(filepath.Join(config.UploadFailedDirFullPath, "REC2", uploadFailedFilename))
+	require.NoError(t, err)
+	var failed RecordingAttempts
+	require.NoError(t, json.Unmarshal(raw, &failed))
+	assert.Equal(t, 3, failed.Files["archive-B.json"].Attempts)
+	assert.Len(t, failed.Files["archive-B.json"].Errors, 3)
+	assert.FileExists(t, filepath.Join(config.UploadFailedDirFullPath, "REC2", "archive-B.json"))
+	assert.NoFileExists(t, uploadAttemptsFilePath(config, filepath.Dir(rec2)))
+}
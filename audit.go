@@ -0,0 +1,490 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/shiguredo/sora-archive-uploader/s3"
+)
+
+const (
+	AuditIssueRecordingNotFound = "recording-not-found"
+	AuditIssueMissingReport     = "missing-report"
+	AuditIssueMissingSplitEnd   = "missing-split-end"
+	AuditIssueMissingMedia      = "missing-media"
+	AuditIssueMissingMetadata   = "missing-metadata"
+	AuditIssueMissingObject     = "missing-object"
+	AuditIssueSizeMismatch      = "size-mismatch"
+	AuditIssueChecksumMismatch  = "checksum-mismatch"
+	AuditIssueExtraObject       = "extra-object"
+	AuditIssueError             = "error"
+)
+
+type AuditIssue struct {
+	RecordingID string `json:"recording_id"`
+	Kind        string `json:"kind"`
+	ObjectKey   string `json:"object_key,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+type AuditReport struct {
+	From           *time.Time    `json:"from,omitempty"`
+	To             *time.Time    `json:"to,omitempty"`
+	Recordings     int           `json:"recordings"`
+	CheckedObjects int           `json:"checked_objects"`
+	Issues         []*AuditIssue `json:"issues"`
+}
+
+// 監査対象の録画
+type auditTarget struct {
+	recordingID string
+	// 退避ディレクトリの録画ディレクトリ、一覧から読み込んだ場合は空文字
+	localDir string
+	// 退避ディレクトリから見つけた場合はアーカイブディレクトリのプレフィックスのみ確認する
+	prefixes []string
+}
+
+type AuditOptions struct {
+	// 録画の作成日時で絞り込む
+	// 作成日時は report ファイルか archive ファイルの created_at を使う
+	From *time.Time
+	To   *time.Time
+	// 1 行に 1 つの録画 ID を書いたファイル
+	ListFilePath string
+}
+
+func (o AuditOptions) inRange(t time.Time) bool {
+	if o.From != nil && t.Before(*o.From) {
+		return false
+	}
+	if o.To != nil && !t.Before(*o.To) {
+		return false
+	}
+	return true
+}
+
+// 退避ディレクトリの録画ディレクトリと録画 ID の一覧から監査対象を集める
+// 一覧の録画のうち退避ディレクトリにあるものは、退避ディレクトリのファイルと突き合わせる
+// 一覧にしかない録画の作成日時はバケットのオブジェクトから取得するため、期間での絞り込みは runAudit で行う
+func collectAuditTargets(config *Config, opts AuditOptions) ([]*auditTarget, error) {
+	var targets []*auditTarget
+	evacuated := make(map[string]struct{})
+	for _, root := range config.ArchiveRoots {
+		recordings, err := collectEvacuatedRecordings(root.EvacuateDirFullPath, config.archiveDirMaxDepth())
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range recordings {
+			recordingID := filepath.Base(r.path)
+			evacuated[recordingID] = struct{}{}
+			// created_at がない場合は録画ディレクトリの更新日時を使う
+			createdAt, ok := localRecordingCreatedAt(r.path)
+			if !ok {
+				createdAt = r.modTime
+			}
+			if !opts.inRange(createdAt) {
+				continue
+			}
+			targets = append(targets, &auditTarget{
+				recordingID: recordingID,
+				localDir:    r.path,
+				prefixes:    []string{path.Join(strings.Trim(root.ObjectKeyPrefix, "/"), recordingID) + "/"},
+			})
+		}
+	}
+
+	if opts.ListFilePath != "" {
+		ids, err := readRecordingIDList(opts.ListFilePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if _, ok := evacuated[id]; ok {
+				continue
+			}
+			evacuated[id] = struct{}{}
+			targets = append(targets, &auditTarget{
+				recordingID: id,
+				prefixes:    recordingObjectPrefixes(config, id),
+			})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].recordingID < targets[j].recordingID
+	})
+	return targets, nil
+}
+
+// 録画の作成日時を取得するファイルを report ファイル、archive ファイルの順に並べる
+func createdAtCandidates(names []string) []string {
+	var reports, archives []string
+	for _, name := range names {
+		if path.Ext(name) != ".json" {
+			continue
+		}
+		switch recordingFileType(name) {
+		case RecordingFileTypeReport:
+			reports = append(reports, name)
+		case RecordingFileTypeArchive, RecordingFileTypeSplitArchive:
+			archives = append(archives, name)
+		}
+	}
+	sort.Strings(reports)
+	sort.Strings(archives)
+	return append(reports, archives...)
+}
+
+// Sora が出力する JSON ファイルの created_at から録画の作成日時を取り出す
+// created_at は UNIX 時間 (秒) だが、RFC 3339 形式の文字列も受け付ける
+func parseRecordingCreatedAt(data []byte) (time.Time, bool) {
+	var v struct {
+		CreatedAt json.RawMessage `json:"created_at"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil || len(v.CreatedAt) == 0 {
+		return time.Time{}, false
+	}
+	var unix float64
+	if err := json.Unmarshal(v.CreatedAt, &unix); err == nil {
+		return time.UnixMilli(int64(unix * 1000)), true
+	}
+	var s string
+	if err := json.Unmarshal(v.CreatedAt, &s); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 退避ディレクトリの録画ディレクトリに残っている JSON ファイルから録画の作成日時を取得する
+func localRecordingCreatedAt(dirPath string) (time.Time, bool) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	for _, name := range createdAtCandidates(names) {
+		data, err := os.ReadFile(filepath.Join(dirPath, name))
+		if err != nil {
+			continue
+		}
+		if t, ok := parseRecordingCreatedAt(data); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// 録画の JSON オブジェクトの上限サイズ
+const maxRecordingJSONObjectSize = 1024 * 1024
+
+// バケットの JSON オブジェクトから録画の作成日時を取得する
+// created_at がない場合はオブジェクトの最も古い更新日時を使う
+func bucketRecordingCreatedAt(ctx context.Context, client *minio.Client, bucketName, prefix string, objects []minio.ObjectInfo) (time.Time, bool, error) {
+	if len(objects) == 0 {
+		return time.Time{}, false, nil
+	}
+	names := make([]string, 0, len(objects))
+	oldest := objects[0].LastModified
+	for _, object := range objects {
+		names = append(names, strings.TrimPrefix(object.Key, prefix))
+		if object.LastModified.Before(oldest) {
+			oldest = object.LastModified
+		}
+	}
+	for _, name := range createdAtCandidates(names) {
+		object, err := client.GetObject(ctx, bucketName, prefix+name, minio.GetObjectOptions{})
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		data, err := io.ReadAll(io.LimitReader(object, maxRecordingJSONObjectSize))
+		object.Close()
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if t, ok := parseRecordingCreatedAt(data); ok {
+			return t, true, nil
+		}
+	}
+	return oldest, true, nil
+}
+
+// 空行と # から始まる行は無視する
+func readRecordingIDList(listFilePath string) ([]string, error) {
+	f, err := os.Open(listFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result, scanner.Err()
+}
+
+func runAudit(ctx context.Context, config *Config, opts AuditOptions) (*AuditReport, error) {
+	targets, err := collectAuditTargets(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	osConfig := config.objectStorageConfig()
+	client, err := s3.NewClient(osConfig.Endpoint, newCredentials(osConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{
+		From:   opts.From,
+		To:     opts.To,
+		Issues: []*AuditIssue{},
+	}
+	for _, target := range targets {
+		var prefix string
+		var objects []minio.ObjectInfo
+		for _, p := range target.prefixes {
+			objects, err = listRecordingObjects(ctx, client, osConfig.BucketName, p)
+			if err != nil {
+				return nil, err
+			}
+			if len(objects) > 0 {
+				prefix = p
+				break
+			}
+		}
+		if target.localDir == "" && (opts.From != nil || opts.To != nil) {
+			// バケットにオブジェクトがなく作成日時がわからない録画は、一覧で指定されているため対象にする
+			createdAt, ok, err := bucketRecordingCreatedAt(ctx, client, osConfig.BucketName, prefix, objects)
+			if err != nil {
+				return nil, err
+			}
+			if ok && !opts.inRange(createdAt) {
+				continue
+			}
+		}
+		report.Recordings++
+		report.CheckedObjects += len(objects)
+		report.Issues = append(report.Issues, auditRecordingObjects(target.recordingID, prefix, objects)...)
+		if target.localDir != "" {
+			// 一覧ではユーザーメタデータを取得できないため、multipart アップロードのオブジェクトは MD5 を取得する
+			for i, object := range objects {
+				if objectMD5(object) != "" {
+					continue
+				}
+				info, err := client.StatObject(ctx, osConfig.BucketName, object.Key, minio.StatObjectOptions{})
+				if err != nil {
+					return nil, err
+				}
+				objects[i].UserMetadata = info.UserMetadata
+			}
+			issues, err := auditLocalFiles(target.recordingID, target.localDir, prefix, objects)
+			if err != nil {
+				report.Issues = append(report.Issues, &AuditIssue{
+					RecordingID: target.recordingID,
+					Kind:        AuditIssueError,
+					Path:        target.localDir,
+					Detail:      err.Error(),
+				})
+			}
+			report.Issues = append(report.Issues, issues...)
+		}
+	}
+	return report, nil
+}
+
+// バケットのオブジェクトが録画として揃っているか確認する
+func auditRecordingObjects(recordingID, prefix string, objects []minio.ObjectInfo) []*AuditIssue {
+	if len(objects) == 0 {
+		return []*AuditIssue{{
+			RecordingID: recordingID,
+			Kind:        AuditIssueRecordingNotFound,
+		}}
+	}
+
+	names := make(map[string]struct{}, len(objects))
+	for _, object := range objects {
+		names[strings.TrimPrefix(object.Key, prefix)] = struct{}{}
+	}
+	issue := func(kind, name, detail string) *AuditIssue {
+		return &AuditIssue{
+			RecordingID: recordingID,
+			Kind:        kind,
+			ObjectKey:   prefix + name,
+			Detail:      detail,
+		}
+	}
+	hasMedia := func(base string) bool {
+		_, webm := names[base+".webm"]
+		_, mp4 := names[base+".mp4"]
+		return webm || mp4
+	}
+
+	var issues []*AuditIssue
+	var hasReport bool
+	splitConnections := make(map[string]struct{})
+	for name := range names {
+		base := strings.TrimSuffix(name, path.Ext(name))
+		ext := path.Ext(name)
+		fileType := recordingFileType(name)
+		switch {
+		case fileType == RecordingFileTypeReport:
+			hasReport = true
+		case fileType == RecordingFileTypeSplitArchiveEnd:
+		case fileType == RecordingFileTypeArchive || fileType == RecordingFileTypeSplitArchive:
+			if fileType == RecordingFileTypeSplitArchive {
+				splitConnections[splitArchiveConnectionID(base)] = struct{}{}
+			}
+			switch ext {
+			case ".json":
+				if !hasMedia(base) {
+					issues = append(issues, issue(AuditIssueMissingMedia, name, ""))
+				}
+			case ".webm", ".mp4":
+				if _, ok := names[base+".json"]; !ok {
+					issues = append(issues, issue(AuditIssueMissingMetadata, name, ""))
+				}
+			default:
+				issues = append(issues, issue(AuditIssueExtraObject, name, ""))
+			}
+		default:
+			issues = append(issues, issue(AuditIssueExtraObject, name, ""))
+		}
+	}
+	if !hasReport {
+		issues = append(issues, issue(AuditIssueMissingReport, fmt.Sprintf("report-%s.json", recordingID), ""))
+	}
+	for connectionID := range splitConnections {
+		name := fmt.Sprintf("split-archive-end-%s.json", connectionID)
+		if _, ok := names[name]; !ok {
+			issues = append(issues, issue(AuditIssueMissingSplitEnd, name, ""))
+		}
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].ObjectKey < issues[j].ObjectKey
+	})
+	return issues
+}
+
+// split-archive-<connection_id>_<連番> から connection_id を取り出す
+func splitArchiveConnectionID(base string) string {
+	s := strings.TrimPrefix(base, "split-archive-")
+	if i := strings.LastIndex(s, "_"); i > 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// 退避ディレクトリに残っているファイルがバケットに同じ内容で存在するか確認する
+func auditLocalFiles(recordingID, localDir, prefix string, objects []minio.ObjectInfo) ([]*AuditIssue, error) {
+	entries, err := os.ReadDir(localDir)
+	if err != nil {
+		return nil, err
+	}
+	objectsByName := make(map[string]minio.ObjectInfo, len(objects))
+	for _, object := range objects {
+		objectsByName[strings.TrimPrefix(object.Key, prefix)] = object
+	}
+
+	var issues []*AuditIssue
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		localPath := filepath.Join(localDir, entry.Name())
+		issue := &AuditIssue{
+			RecordingID: recordingID,
+			ObjectKey:   prefix + entry.Name(),
+			Path:        localPath,
+		}
+		object, ok := objectsByName[entry.Name()]
+		if !ok {
+			issue.Kind = AuditIssueMissingObject
+			issues = append(issues, issue)
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return issues, err
+		}
+		if info.Size() != object.Size {
+			issue.Kind = AuditIssueSizeMismatch
+			issue.Detail = fmt.Sprintf("local=%d remote=%d", info.Size(), object.Size)
+			issues = append(issues, issue)
+			continue
+		}
+		// アップロード時に保存した MD5 がなく、multipart アップロードの場合はサイズのみ比較する
+		expected := objectMD5(object)
+		if expected == "" {
+			continue
+		}
+		sum, err := fileMD5(localPath)
+		if err != nil {
+			return issues, err
+		}
+		if sum != expected {
+			issue.Kind = AuditIssueChecksumMismatch
+			issue.Detail = fmt.Sprintf("local=%s remote=%s", sum, expected)
+			issues = append(issues, issue)
+		}
+	}
+	return issues, nil
+}
+
+func fileMD5(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeAuditReport(w io.Writer, report *AuditReport, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case PlanFormatTable, "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RECORDING_ID\tKIND\tOBJECT_KEY\tPATH\tDETAIL")
+		for _, issue := range report.Issues {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", issue.RecordingID, issue.Kind, issue.ObjectKey, issue.Path, issue.Detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "recordings=%d checked_objects=%d issues=%d\n", report.Recordings, report.CheckedObjects, len(report.Issues))
+		return err
+	default:
+		return fmt.Errorf("unsupported audit format: %q", format)
+	}
+}
@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func auditIssueKinds(issues []*AuditIssue) map[string]string {
+	result := make(map[string]string)
+	for _, issue := range issues {
+		result[issue.ObjectKey] = issue.Kind
+	}
+	return result
+}
+
+func TestAuditRecordingObjects(t *testing.T) {
+	objects := []minio.ObjectInfo{
+		{Key: "p/REC1/archive-A.json"},
+		{Key: "p/REC1/archive-A.webm"},
+		{Key: "p/REC1/archive-B.json"},
+		{Key: "p/REC1/archive-C.mp4"},
+		{Key: "p/REC1/split-archive-D_0001.json"},
+		{Key: "p/REC1/split-archive-D_0001.webm"},
+		{Key: "p/REC1/split-archive-E_0001.json"},
+		{Key: "p/REC1/split-archive-E_0001.webm"},
+		{Key: "p/REC1/split-archive-end-E.json"},
+		{Key: "p/REC1/unknown.txt"},
+	}
+	issues := auditRecordingObjects("REC1", "p/REC1/", objects)
+	assert.Equal(t, map[string]string{
+		"p/REC1/archive-B.json":           AuditIssueMissingMedia,
+		"p/REC1/archive-C.mp4":            AuditIssueMissingMetadata,
+		"p/REC1/report-REC1.json":         AuditIssueMissingReport,
+		"p/REC1/split-archive-end-D.json": AuditIssueMissingSplitEnd,
+		"p/REC1/unknown.txt":              AuditIssueExtraObject,
+	}, auditIssueKinds(issues))
+
+	issues = auditRecordingObjects("REC2", "", nil)
+	require.Len(t, issues, 1)
+	assert.Equal(t, AuditIssueRecordingNotFound, issues[0].Kind)
+}
+
+func TestAuditLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	// "{}" の MD5
+	const md5 = "99914b932bd37a50b983c5e7c90ae93b"
+	for _, name := range []string{"archive-A.json", "archive-B.json", "archive-C.json", "archive-D.json", "archive-E.json", "archive-F.json", "archive-G.json"} {
+		writeTestFile(t, filepath.Join(dir, name))
+	}
+	objects := []minio.ObjectInfo{
+		{Key: "REC1/archive-A.json", Size: 2, ETag: `"` + md5 + `"`},
+		{Key: "REC1/archive-B.json", Size: 3, ETag: md5},
+		{Key: "REC1/archive-C.json", Size: 2, ETag: "00000000000000000000000000000000"},
+		// MD5 を保存していない multipart アップロードはサイズのみ比較する
+		{Key: "REC1/archive-D.json", Size: 2, ETag: "00000000000000000000000000000000-2"},
+		// multipart アップロードはユーザーメタデータの MD5 と比較する
+		{Key: "REC1/archive-F.json", Size: 2, ETag: "00000000000000000000000000000000-2", UserMetadata: minio.StringMap{objectMD5MetadataKey: md5}},
+		{Key: "REC1/archive-G.json", Size: 2, ETag: "00000000000000000000000000000000-2", UserMetadata: minio.StringMap{objectMD5MetadataKey: "00000000000000000000000000000000"}},
+	}
+	issues, err := auditLocalFiles("REC1", dir, "REC1/", objects)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"REC1/archive-B.json": AuditIssueSizeMismatch,
+		"REC1/archive-C.json": AuditIssueChecksumMismatch,
+		"REC1/archive-E.json": AuditIssueMissingObject,
+		"REC1/archive-G.json": AuditIssueChecksumMismatch,
+	}, auditIssueKinds(issues))
+}
+
+func TestCollectAuditTargets(t *testing.T) {
+	root := t.TempDir()
+	evacuateDir := filepath.Join(root, "evacuate")
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: evacuateDir, ObjectKeyPrefix: "/p/"},
+		},
+	}
+	now := time.Now()
+	// 録画ディレクトリの更新日時ではなく report ファイルの created_at で絞り込む
+	for id, createdAt := range map[string]time.Time{
+		"REC1": now.AddDate(0, 0, -3),
+		"REC2": now.AddDate(0, 0, -1),
+		"REC3": now,
+	} {
+		dirPath := filepath.Join(evacuateDir, id)
+		require.NoError(t, os.MkdirAll(dirPath, 0755))
+		report := fmt.Sprintf(`{"recording_id": "%s", "created_at": %d}`, id, createdAt.Unix())
+		require.NoError(t, os.WriteFile(filepath.Join(dirPath, "report-"+id+".json"), []byte(report), 0644))
+		require.NoError(t, os.Chtimes(dirPath, now, now))
+	}
+	// created_at がない場合は録画ディレクトリの更新日時を使う
+	require.NoError(t, os.MkdirAll(filepath.Join(evacuateDir, "REC6"), 0755))
+	modTime := now.AddDate(0, 0, -1)
+	require.NoError(t, os.Chtimes(filepath.Join(evacuateDir, "REC6"), modTime, modTime))
+
+	from := now.AddDate(0, 0, -2)
+	to := now.Add(-time.Hour)
+	targets, err := collectAuditTargets(config, AuditOptions{From: &from, To: &to})
+	require.NoError(t, err)
+	require.Len(t, targets, 2)
+	assert.Equal(t, "REC2", targets[0].recordingID)
+	assert.Equal(t, filepath.Join(evacuateDir, "REC2"), targets[0].localDir)
+	assert.Equal(t, []string{"p/REC2/"}, targets[0].prefixes)
+	assert.Equal(t, "REC6", targets[1].recordingID)
+
+	// 一覧と退避ディレクトリの録画を合わせる
+	// 退避ディレクトリにある録画は退避ディレクトリのファイルと突き合わせる
+	listFilePath := filepath.Join(root, "list.txt")
+	require.NoError(t, os.WriteFile(listFilePath, []byte("# nightly\nREC2\nREC4\n\n  REC5 \nREC4\n"), 0644))
+	targets, err = collectAuditTargets(config, AuditOptions{From: &from, To: &to, ListFilePath: listFilePath})
+	require.NoError(t, err)
+	require.Len(t, targets, 4)
+	assert.Equal(t, "REC2", targets[0].recordingID)
+	assert.Equal(t, filepath.Join(evacuateDir, "REC2"), targets[0].localDir)
+	assert.Equal(t, "REC4", targets[1].recordingID)
+	assert.Empty(t, targets[1].localDir)
+	assert.Equal(t, []string{"p/REC5/"}, targets[2].prefixes)
+	assert.Equal(t, "REC6", targets[3].recordingID)
+
+	// 期間を指定しない場合はすべての録画が対象になる
+	targets, err = collectAuditTargets(config, AuditOptions{ListFilePath: listFilePath})
+	require.NoError(t, err)
+	assert.Len(t, targets, 6)
+}
+
+func TestParseRecordingCreatedAt(t *testing.T) {
+	createdAt, ok := parseRecordingCreatedAt([]byte(`{"created_at": 1767225600}`))
+	assert.True(t, ok)
+	assert.True(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Equal(createdAt))
+
+	createdAt, ok = parseRecordingCreatedAt([]byte(`{"created_at": "2026-01-01T09:00:00+09:00"}`))
+	assert.True(t, ok)
+	assert.True(t, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).Equal(createdAt))
+
+	_, ok = parseRecordingCreatedAt([]byte(`{"recording_id": "REC1"}`))
+	assert.False(t, ok)
+	_, ok = parseRecordingCreatedAt([]byte(`{`))
+	assert.False(t, ok)
+}
+
+// 録画 ID ごとに report オブジェクトだけを持つバケットを返すサーバー
+func newAuditStorageServer(t *testing.T, reports map[string]string) *httptest.Server {
+	lastModified := time.Now().UTC()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("location") {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<LocationConstraint>us-east-1</LocationConstraint>`))
+			return
+		}
+		if r.URL.Query().Get("list-type") == "2" {
+			prefix := r.URL.Query().Get("prefix")
+			var contents string
+			for key, body := range reports {
+				if strings.HasPrefix(key, prefix) {
+					contents += fmt.Sprintf(`<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"x"</ETag><Size>%d</Size></Contents>`,
+						key, lastModified.Format(time.RFC3339), len(body))
+				}
+			}
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<ListBucketResult><Name>bucket</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>%s</ListBucketResult>`, prefix, contents)
+			return
+		}
+		body, ok := reports[strings.TrimPrefix(r.URL.Path, "/bucket/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"x"`)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRunAuditListWithRange(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	server := newAuditStorageServer(t, map[string]string{
+		"p/REC4/report-REC4.json": fmt.Sprintf(`{"created_at": %d}`, now.AddDate(0, 0, -1).Unix()),
+		"p/REC5/report-REC5.json": fmt.Sprintf(`{"created_at": %d}`, now.AddDate(0, 0, -3).Unix()),
+	})
+	config := &Config{
+		ObjectStorageEndpoint:        server.URL,
+		ObjectStorageBucketName:      "bucket",
+		ObjectStorageAccessKeyID:     "access-key-id",
+		ObjectStorageSecretAccessKey: "secret-access-key",
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: filepath.Join(root, "evacuate"), ObjectKeyPrefix: "p"},
+		},
+	}
+	listFilePath := filepath.Join(root, "list.txt")
+	require.NoError(t, os.WriteFile(listFilePath, []byte("REC4\nREC5\nREC7\n"), 0644))
+
+	// 一覧の録画もバケットの report オブジェクトの created_at で絞り込む
+	// バケットにない録画は作成日時がわからないため対象にする
+	from := now.AddDate(0, 0, -2)
+	report, err := runAudit(context.Background(), config, AuditOptions{From: &from, ListFilePath: listFilePath})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Recordings)
+	kinds := make(map[string]string)
+	for _, issue := range report.Issues {
+		kinds[issue.RecordingID] = issue.Kind
+	}
+	assert.NotContains(t, kinds, "REC5")
+	assert.Equal(t, AuditIssueRecordingNotFound, kinds["REC7"])
+}
@@ -14,6 +14,9 @@ func main() {
 
 	// /bin/sora-archive-uploader -C ./config.ini
 	configFilePath := flag.String("C", "./config.ini", "Config file path")
+
+	// /bin/sora-archive-uploader -C ./config.ini -dry-run
+	dryRun := flag.Bool("dry-run", false, "アップロードせずに処理内容を表示する")
 	flag.Parse()
 
 	if *showVersion {
@@ -22,5 +25,69 @@ func main() {
 	}
 
 	log.Printf("config file path: %s", *configFilePath)
-	archive.Run(configFilePath)
+
+	switch flag.Arg(0) {
+	case "":
+		if *dryRun {
+			archive.Plan(configFilePath, archive.PlanFormatTable)
+			return
+		}
+		archive.Run(configFilePath)
+	case "plan":
+		// /bin/sora-archive-uploader -C ./config.ini plan [-format table|json]
+		planFlags := flag.NewFlagSet("plan", flag.ExitOnError)
+		format := planFlags.String("format", archive.PlanFormatTable, "出力形式 (table / json)")
+		planFlags.Parse(flag.Args()[1:])
+		archive.Plan(configFilePath, *format)
+	case "requeue":
+		// /bin/sora-archive-uploader -C ./config.ini requeue [recording-id...]
+		archive.Requeue(configFilePath, flag.Args()[1:])
+	case "upload":
+		// /bin/sora-archive-uploader -C ./config.ini upload <recording-dir>
+		archive.Upload(configFilePath, requireArg(1, "recording-dir"))
+	case "resend-webhook":
+		// /bin/sora-archive-uploader -C ./config.ini resend-webhook <recording-id>
+		archive.ResendWebhook(configFilePath, requireArg(1, "recording-id"))
+	case "verify":
+		// /bin/sora-archive-uploader -C ./config.ini verify <recording-dir>
+		archive.Verify(configFilePath, requireArg(1, "recording-dir"))
+	case "restore":
+		// /bin/sora-archive-uploader -C ./config.ini restore [-dest dir] <recording-id>
+		restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+		destDir := restoreFlags.String("dest", ".", "録画ディレクトリを復元する先のディレクトリ")
+		restoreFlags.Parse(flag.Args()[1:])
+		if restoreFlags.NArg() < 1 {
+			log.Fatalf("restore: recording-id is required")
+		}
+		archive.Restore(configFilePath, restoreFlags.Arg(0), *destDir)
+	case "audit":
+		// /bin/sora-archive-uploader -C ./config.ini audit [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-list file] [-format table|json]
+		auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+		from := auditFlags.String("from", "", "録画をこの日付以降に作成されたものに絞り込む (YYYY-MM-DD)")
+		to := auditFlags.String("to", "", "録画をこの日付までに作成されたものに絞り込む (YYYY-MM-DD)")
+		listFilePath := auditFlags.String("list", "", "1 行に 1 つの録画 ID を書いたファイル、退避ディレクトリの録画と合わせて突き合わせる")
+		format := auditFlags.String("format", archive.PlanFormatTable, "出力形式 (table / json)")
+		auditFlags.Parse(flag.Args()[1:])
+		archive.Audit(configFilePath, *from, *to, *listFilePath, *format)
+	case "list":
+		// /bin/sora-archive-uploader -C ./config.ini list
+		archive.List(configFilePath)
+	case "config":
+		// /bin/sora-archive-uploader -C ./config.ini config check
+		switch requireArg(1, "check") {
+		case "check":
+			archive.CheckConfig(configFilePath)
+		default:
+			log.Fatalf("unknown config command: %s", flag.Arg(1))
+		}
+	default:
+		log.Fatalf("unknown command: %s", flag.Arg(0))
+	}
+}
+
+func requireArg(i int, name string) string {
+	if flag.NArg() <= i {
+		log.Fatalf("%s: %s is required", flag.Arg(0), name)
+	}
+	return flag.Arg(i)
 }
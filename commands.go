@@ -0,0 +1,431 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	VerifyStatusOK           = "ok"
+	VerifyStatusMissing      = "missing"
+	VerifyStatusSizeMismatch = "size-mismatch"
+	VerifyStatusError        = "error"
+)
+
+func loadCommandConfig(configFilePath *string) *Config {
+	config, err := newConfig(*configFilePath)
+	if err != nil {
+		log.Print("cannot parse config file, err=", err)
+		os.Exit(ExitCodeConfigError)
+	}
+	if err := initLogger(config); err != nil {
+		log.Print("cannot parse config file, err=", err)
+		os.Exit(ExitCodeConfigError)
+	}
+	return config
+}
+
+// 設定ファイルを読み込めるか確認し、見つかった誤りをすべて表示する
+func CheckConfig(configFilePath *string) {
+	config, err := newConfig(*configFilePath)
+	if err == nil {
+		err = config.validateDirectories()
+	}
+	if err != nil {
+		for _, e := range configErrorList(err) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFilePath, e)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", *configFilePath)
+}
+
+// 指定した録画ディレクトリだけをすぐに処理する
+func Upload(configFilePath *string, recordingDir string) {
+	if exitCode := upload(configFilePath, recordingDir); exitCode != ExitCodeSuccess {
+		os.Exit(exitCode)
+	}
+}
+
+// 終了コードを返す
+// 終了前にロックを解放するため、os.Exit は呼び出し側で行う
+func upload(configFilePath *string, recordingDir string) int {
+	config := loadCommandConfig(configFilePath)
+
+	recordingDir, err := filepath.Abs(recordingDir)
+	if err != nil {
+		zlog.Error().Err(err).Str("path", recordingDir).Msg("INVALID-RECORDING-DIRECTORY")
+		return ExitCodeConfigError
+	}
+	if config.archiveRootOf(recordingDir) == nil {
+		// オブジェクトキーと退避先はアーカイブディレクトリからの相対パスで決まる
+		zlog.Error().Str("path", recordingDir).Msg("RECORDING-DIRECTORY-NOT-IN-ARCHIVE-ROOT")
+		return ExitCodeConfigError
+	}
+	entries, err := os.ReadDir(recordingDir)
+	if err != nil {
+		zlog.Error().Err(err).Str("path", recordingDir).Msg("NOT-FOUND-TARGET-PATH")
+		return ExitCodeConfigError
+	}
+
+	// タイマーや常駐モードの実行と同じファイルを処理しないように、実行時と同じロックを取得する
+	instanceLock, err := acquireInstanceLock(config)
+	if errors.Is(err, errLockHeld) {
+		zlog.Info().
+			Str("lock_file_path", config.LockFilePath).
+			Msg("ANOTHER-INSTANCE-RUNNING")
+		return ExitCodeNothingToDo
+	}
+	if err != nil {
+		zlog.Error().Err(err).Str("lock_file_path", config.LockFilePath).Msg("FAILED-ACQUIRE-INSTANCE-LOCK")
+		return ExitCodeError
+	}
+	if instanceLock != nil {
+		defer instanceLock.release()
+	}
+	if config.RecordingLockDirFullPath != "" {
+		locks := newRecordingLocks()
+		defer locks.releaseAll()
+		if !locks.tryLock(config, recordingDir) {
+			zlog.Info().Str("path", recordingDir).Msg("RECORDING-LOCKED-BY-ANOTHER-PROCESS")
+			return ExitCodeNothingToDo
+		}
+	}
+	foundFiles := scanRecordingDirectory(recordingDir, entries)
+	if len(foundFiles) == 0 {
+		zlog.Info().Str("path", recordingDir).Msg("ARCHIVE-FILE-NOT-FOUND")
+		return ExitCodeNothingToDo
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	// 処理中のファイルの完了を待っている間に再度シグナルを受け取ったらすぐに終了する
+	context.AfterFunc(ctx, stop)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// ファイルごとの処理結果を集計して終了コードを決める
+	runSummary.start("upload")
+	runSummary.recordingsFound(foundFiles)
+	m := newMain(config)
+	err = m.process(ctx, cancel, config, foundFiles)
+	summary := runSummary.finish()
+	reportRunSummary(config, summary)
+	if err != nil {
+		zlog.Error().Err(err).Str("path", recordingDir).Msg("FAILED-UPLOAD-RECORDING")
+		return ExitCodeError
+	}
+	exitCode := summary.exitCode()
+	event := zlog.Info()
+	if exitCode != ExitCodeSuccess {
+		event = zlog.Warn()
+	}
+	event.
+		Str("path", recordingDir).
+		Int("files", len(foundFiles)).
+		Int64("failed_files", summary.FailedFiles).
+		Int("exit_code", exitCode).
+		Msg("UPLOADED-RECORDING")
+	return exitCode
+}
+
+// 保存したウェブフックのペイロードを再送する
+func ResendWebhook(configFilePath *string, recordingID string) {
+	config := loadCommandConfig(configFilePath)
+
+	if config.WebhookEndpointURL == "" {
+		zlog.Fatal().Msg("WEBHOOK-ENDPOINT-NOT-CONFIGURED")
+	}
+	if config.WebhookPayloadStoreDirFullPath == "" {
+		zlog.Fatal().Msg("WEBHOOK-PAYLOAD-STORE-DIR-NOT-CONFIGURED")
+	}
+
+	webhooks, err := loadStoredWebhooks(config, recordingID)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("recording_id", recordingID).Msg("FAILED-LOAD-STORED-WEBHOOKS")
+	}
+
+	var failed int
+	for _, w := range webhooks {
+		if err := postWebhook(context.Background(), config, w.Type, w.Payload); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("recording_id", recordingID).
+				Str("webhook_type", w.Type).
+				Time("stored_at", w.StoredAt).
+				Msg("RESEND-WEBHOOK-ERROR")
+			failed++
+			continue
+		}
+		zlog.Info().
+			Str("recording_id", recordingID).
+			Str("webhook_type", w.Type).
+			Time("stored_at", w.StoredAt).
+			Msg("RESENT-WEBHOOK")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+type VerifyResult struct {
+	Path       string `json:"path"`
+	ObjectKey  string `json:"object_key"`
+	LocalSize  int64  `json:"local_size"`
+	RemoteSize int64  `json:"remote_size"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// 録画ディレクトリのファイルとバケットのオブジェクトを比較する
+func verifyRecordingDirectory(ctx context.Context, config *Config, recordingDir string) ([]*VerifyResult, error) {
+	entries, err := os.ReadDir(recordingDir)
+	if err != nil {
+		return nil, err
+	}
+	osConfig := config.objectStorageConfig()
+	decide := planRecordingFilter(config)
+	var result []*VerifyResult
+	for _, f := range scanRecordingDirectory(recordingDir, entries) {
+		action := planFile(config, f, decide)
+		if action.Action == PlanActionError {
+			result = append(result, &VerifyResult{
+				Path:   f,
+				Status: VerifyStatusError,
+				Error:  action.Error,
+			})
+			continue
+		}
+		for _, upload := range action.Uploads {
+			r := &VerifyResult{
+				Path:      upload.Path,
+				ObjectKey: upload.ObjectKey,
+				LocalSize: upload.Size,
+			}
+			info, err := statObject(ctx, osConfig, upload.ObjectKey)
+			switch {
+			case err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey":
+				r.Status = VerifyStatusMissing
+			case err != nil:
+				r.Status = VerifyStatusError
+				r.Error = err.Error()
+			case info.Size != upload.Size:
+				r.RemoteSize = info.Size
+				r.Status = VerifyStatusSizeMismatch
+			default:
+				r.RemoteSize = info.Size
+				r.Status = VerifyStatusOK
+			}
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+func Verify(configFilePath *string, recordingDir string) {
+	config := loadCommandConfig(configFilePath)
+
+	// アーカイブディレクトリと比較できるように絶対パスにする
+	recordingDir, err := filepath.Abs(recordingDir)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("path", recordingDir).Msg("FAILED-VERIFY")
+	}
+	results, err := verifyRecordingDirectory(context.Background(), config, recordingDir)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("path", recordingDir).Msg("FAILED-VERIFY")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tPATH\tOBJECT_KEY\tLOCAL_SIZE\tREMOTE_SIZE\tERROR")
+	var failed int
+	for _, r := range results {
+		if r.Status != VerifyStatusOK {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", r.Status, r.Path, r.ObjectKey, r.LocalSize, r.RemoteSize, r.Error)
+	}
+	tw.Flush()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+type PendingRecording struct {
+	Dir         string         `json:"dir"`
+	RecordingID string         `json:"recording_id"`
+	Files       map[string]int `json:"files"`
+	Size        int64          `json:"size"`
+	OldestAt    time.Time      `json:"oldest_at"`
+	HasReport   bool           `json:"has_report"`
+	// 次の実行での扱い、pending / locked / backoff / move-to-failed
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// 次の実行で処理する録画ディレクトリ
+const PendingStatusPending = "pending"
+
+// 処理待ちの録画ディレクトリを返す
+func listPendingRecordings(config *Config) ([]*PendingRecording, error) {
+	foundFiles, err := runFileFinder(config)
+	if err != nil {
+		return nil, err
+	}
+	schedule := planRecordingSchedule(config, time.Now())
+	recordings := make(map[string]*PendingRecording)
+	for _, f := range foundFiles {
+		dir := filepath.Dir(f)
+		r, ok := recordings[dir]
+		if !ok {
+			r = &PendingRecording{
+				Dir:         dir,
+				RecordingID: filepath.Base(dir),
+				Files:       make(map[string]int),
+				Size:        directorySize(dir),
+				Status:      PendingStatusPending,
+			}
+			if s := schedule(dir); s.action != "" {
+				r.Status = s.action
+				r.Attempts = s.attempts
+				if !s.nextAttemptAt.IsZero() {
+					r.NextAttemptAt = &s.nextAttemptAt
+				}
+			}
+			recordings[dir] = r
+		}
+		fileType := recordingFileType(filepath.Base(f))
+		r.Files[fileType]++
+		if fileType == RecordingFileTypeReport {
+			r.HasReport = true
+		}
+		if info, err := os.Stat(f); err == nil {
+			if r.OldestAt.IsZero() || info.ModTime().Before(r.OldestAt) {
+				r.OldestAt = info.ModTime()
+			}
+		}
+	}
+	result := make([]*PendingRecording, 0, len(recordings))
+	for _, r := range recordings {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].OldestAt.Before(result[j].OldestAt)
+	})
+	return result, nil
+}
+
+func List(configFilePath *string) {
+	config, err := newConfig(*configFilePath)
+	if err != nil {
+		log.Fatal("cannot parse config file, err=", err)
+	}
+
+	recordings, err := listPendingRecordings(config)
+	if err != nil {
+		log.Fatal("cannot list recordings, err=", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECORDING_ID\tSTATUS\tATTEMPTS\tNEXT_ATTEMPT\tARCHIVE\tSPLIT_ARCHIVE\tSPLIT_ARCHIVE_END\tREPORT\tSIZE\tOLDEST\tDIR")
+	for _, r := range recordings {
+		nextAttempt := "-"
+		if r.NextAttemptAt != nil {
+			nextAttempt = r.NextAttemptAt.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%d\t%d\t%t\t%d\t%s\t%s\n",
+			r.RecordingID,
+			r.Status,
+			r.Attempts,
+			nextAttempt,
+			r.Files[RecordingFileTypeArchive],
+			r.Files[RecordingFileTypeSplitArchive],
+			r.Files[RecordingFileTypeSplitArchiveEnd],
+			r.HasReport,
+			r.Size,
+			r.OldestAt.UTC().Format(time.RFC3339),
+			r.Dir,
+		)
+	}
+	tw.Flush()
+}
+
+// バケットから録画をダウンロードして録画ディレクトリを復元する
+func Restore(configFilePath *string, recordingID, destDir string) {
+	config := loadCommandConfig(configFilePath)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	results, err := restoreRecording(ctx, config, recordingID, destDir)
+	if err != nil {
+		zlog.Fatal().Err(err).Str("recording_id", recordingID).Msg("FAILED-RESTORE")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tOBJECT_KEY\tPATH\tSIZE\tCHECKSUM_VERIFIED\tERROR")
+	var failed int
+	for _, r := range results {
+		status := "ok"
+		if r.Error != "" {
+			status = "error"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%t\t%s\n", status, r.ObjectKey, r.Path, r.Size, r.ChecksumVerified, r.Error)
+	}
+	tw.Flush()
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// 退避ディレクトリの録画と録画 ID の一覧をバケットのオブジェクトと突き合わせる
+// from と to は YYYY-MM-DD 形式で、to の日付を含む
+func Audit(configFilePath *string, from, to, listFilePath, format string) {
+	config := loadCommandConfig(configFilePath)
+
+	opts := AuditOptions{
+		ListFilePath: listFilePath,
+	}
+	if from != "" {
+		t, err := time.ParseInLocation(time.DateOnly, from, time.Local)
+		if err != nil {
+			log.Fatal("invalid -from, err=", err)
+		}
+		opts.From = &t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation(time.DateOnly, to, time.Local)
+		if err != nil {
+			log.Fatal("invalid -to, err=", err)
+		}
+		t = t.AddDate(0, 0, 1)
+		opts.To = &t
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := runAudit(ctx, config, opts)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("FAILED-AUDIT")
+	}
+	if err := writeAuditReport(os.Stdout, report, format); err != nil {
+		log.Fatal("cannot write audit report, err=", err)
+	}
+	if len(report.Issues) > 0 {
+		os.Exit(1)
+	}
+}
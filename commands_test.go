@@ -0,0 +1,89 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreWebhookPayload(t *testing.T) {
+	config := &Config{
+		WebhookPayloadStoreDirFullPath: t.TempDir(),
+	}
+	require.NoError(t, storeWebhookPayload(config, "archive.uploaded", []byte(`{"id":"W1","recording_id":"REC1"}`)))
+	require.NoError(t, storeWebhookPayload(config, "report.uploaded", []byte(`{"id":"W2","recording_id":"REC1"}`)))
+	// 録画 ID を持たないウェブフックは保存しない
+	require.NoError(t, storeWebhookPayload(config, "disk.pressure", []byte(`{"id":"W3"}`)))
+
+	webhooks, err := loadStoredWebhooks(config, "REC1")
+	require.NoError(t, err)
+	require.Len(t, webhooks, 2)
+	assert.Equal(t, "archive.uploaded", webhooks[0].Type)
+	assert.JSONEq(t, `{"id":"W1","recording_id":"REC1"}`, string(webhooks[0].Payload))
+	assert.Equal(t, "report.uploaded", webhooks[1].Type)
+
+	entries, err := os.ReadDir(config.WebhookPayloadStoreDirFullPath)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestListPendingRecordings(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "REC1", "archive-A.json"))
+	writeTestFile(t, filepath.Join(root, "REC1", "archive-A.webm"))
+	writeTestFile(t, filepath.Join(root, "REC1", "report-REC1.json"))
+	writeTestFile(t, filepath.Join(root, "REC2", "split-archive-B_0001.json"))
+	writeTestFile(t, filepath.Join(root, "REC2", "split-archive-B_0001.mp4"))
+	writeTestFile(t, filepath.Join(root, "REC2", "split-archive-end-B.json"))
+
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: filepath.Join(root, "evacuate")},
+		},
+	}
+	recordings, err := listPendingRecordings(config)
+	require.NoError(t, err)
+	require.Len(t, recordings, 2)
+
+	byID := make(map[string]*PendingRecording)
+	for _, r := range recordings {
+		byID[r.RecordingID] = r
+	}
+	assert.Equal(t, 1, byID["REC1"].Files[RecordingFileTypeArchive])
+	assert.True(t, byID["REC1"].HasReport)
+	assert.Equal(t, 1, byID["REC2"].Files[RecordingFileTypeSplitArchive])
+	assert.Equal(t, 1, byID["REC2"].Files[RecordingFileTypeSplitArchiveEnd])
+	assert.False(t, byID["REC2"].HasReport)
+	assert.Equal(t, PendingStatusPending, byID["REC1"].Status)
+}
+
+func TestRecordingObjectPrefixes(t *testing.T) {
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{Name: "default"},
+			{Name: "sora2", ObjectKeyPrefix: "/sora2/"},
+			{Name: "sora3"},
+		},
+	}
+	assert.Equal(t, []string{"REC1/", "sora2/REC1/"}, recordingObjectPrefixes(config, "REC1"))
+	assert.Equal(t, []string{"REC1/"}, recordingObjectPrefixes(&Config{}, "REC1"))
+}
+
+func TestObjectKeyEvacuatedRecording(t *testing.T) {
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: "/archive/sora", EvacuateDirFullPath: "/archive/sora/evacuate", ObjectKeyPrefix: "sora"},
+			{ArchiveDirFullPath: "/archive/sora2", EvacuateDirFullPath: "/evacuate/sora2", ObjectKeyPrefix: "sora2"},
+		},
+	}
+	assert.Equal(t, "sora2/REC1/archive-A.webm", config.objectKey("/archive/sora2/REC1/archive-A.json", "REC1", "archive-A.webm"))
+	// 退避した録画ディレクトリは退避する前のアーカイブディレクトリのプレフィックスを使う
+	assert.Equal(t, "sora2/REC1/archive-A.webm", config.objectKey("/evacuate/sora2/REC1/archive-A.json", "REC1", "archive-A.webm"))
+	assert.Equal(t, "/archive/sora2/2025/REC1", config.unevacuatedPath("/evacuate/sora2/2025/REC1"))
+	// アーカイブディレクトリ内に退避ディレクトリがある場合も同じ
+	assert.Equal(t, "sora/REC1/archive-A.webm", config.objectKey("/archive/sora/evacuate/REC1/archive-A.json", "REC1", "archive-A.webm"))
+	assert.Equal(t, "REC1/archive-A.webm", config.objectKey("/other/REC1/archive-A.json", "REC1", "archive-A.webm"))
+}
@@ -2,6 +2,11 @@ package archive
 
 import (
 	_ "embed"
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"gopkg.in/ini.v1"
 )
@@ -18,8 +23,28 @@ const (
 	DefaultLogRotateMaxBackups = 7
 	// days
 	DefaultLogRotateMaxAge = 30
+
+	DefaultArchiveDirMaxDepth = 1
+
+	// 追加のアーカイブディレクトリを指定するセクション名のプレフィックス
+	// [archive_root.<name>] の形式で指定する
+	ArchiveRootSectionPrefix = "archive_root."
+	// 従来の archive_dir_full_path から作るアーカイブディレクトリの名前
+	// [archive_root.default] セクションとは併用できない
+	DefaultArchiveRootName = "default"
 )
 
+// アーカイブディレクトリと、その退避先、オブジェクトキーのプレフィックスの組
+type ArchiveRoot struct {
+	Name string `ini:"-"`
+	// 従来の archive_dir_full_path から作った
+	topLevel bool
+
+	ArchiveDirFullPath  string `ini:"archive_dir_full_path"`
+	EvacuateDirFullPath string `ini:"evacuate_dir_full_path"`
+	ObjectKeyPrefix     string `ini:"object_key_prefix"`
+}
+
 type Config struct {
 	Debug bool `ini:"debug"`
 
@@ -36,15 +61,113 @@ type Config struct {
 	ObjectStorageBucketName      string `ini:"object_storage_bucket_name"`
 	ObjectStorageAccessKeyID     string `ini:"object_storage_access_key_id"`
 	ObjectStorageSecretAccessKey string `ini:"object_storage_secret_access_key"`
+	// object_storage_secret_access_key をファイルから読み込む
+	ObjectStorageSecretAccessKeyFile string `ini:"object_storage_secret_access_key_file"`
 
 	SoraArchiveDirFullPath  string `ini:"archive_dir_full_path"`
 	SoraEvacuateDirFullPath string `ini:"evacuate_dir_full_path"`
+	ObjectKeyPrefix         string `ini:"object_key_prefix"`
+
+	// 録画ディレクトリを探索する深さ
+	// 1 の場合はアーカイブディレクトリ直下のディレクトリのみを録画ディレクトリとして扱う
+	ArchiveDirMaxDepth int `ini:"archive_dir_max_depth"`
+
+	// archive_dir_full_path と [archive_root.<name>] セクションをまとめたもの
+	ArchiveRoots []*ArchiveRoot `ini:"-"`
+
+	// フィルタで除外した録画ファイルの扱い (keep / move / delete)
+	FilterExcludedAction      string `ini:"filter_excluded_action"`
+	FilterExcludedDirFullPath string `ini:"filter_excluded_dir_full_path"`
+
+	// [filter.<name>] セクションで指定したフィルタ
+	FilterRules []*FilterRule `ini:"-"`
+
+	// quarantine に分類したエラーで処理に失敗したファイルの移動先
+	QuarantineDirFullPath string `ini:"quarantine_dir_full_path"`
+	// [error_class] セクションで指定したエラーの理由ごとの扱い、キーは小文字にする
+	ErrorClassOverrides map[string]string `ini:"-"`
+
+	// 退避ディレクトリの保持期間と合計サイズの上限、0 の場合は制限しない
+	EvacuateRetentionMaxAgeH        int64 `ini:"evacuate_retention_max_age_h"`
+	EvacuateRetentionMaxTotalSizeMB int64 `ini:"evacuate_retention_max_total_size_mb"`
+	// すべてのファイルのアップロードに成功した録画ディレクトリを退避せずに削除する
+	RemoveEmptyRecordingDirectory bool `ini:"remove_empty_recording_directory"`
+
+	// アーカイブディレクトリのファイルシステムの使用率 (%) または空き容量 (MB) が閾値を超えた場合に緊急モードで動作する
+	// 0 の場合は確認しない
+	DiskPressureThresholdPercent int   `ini:"disk_pressure_threshold_percent"`
+	DiskPressureMinFreeMB        int64 `ini:"disk_pressure_min_free_mb"`
+	// 緊急モードでのアップロードワーカー数、upload_workers より小さい場合は upload_workers を使う
+	DiskPressureUploadWorkers int `ini:"disk_pressure_upload_workers"`
+	// 緊急モードで空き容量が閾値を上回るまで退避ディレクトリを古いものから削除する
+	DiskPressurePurgeEvacuate bool `ini:"disk_pressure_purge_evacuate"`
+
+	// 放置された録画ディレクトリとみなすまでの猶予期間、0 の場合は検出しない
+	StuckRecordingGracePeriodS int64 `ini:"stuck_recording_grace_period_s"`
+	// 放置された録画ディレクトリの扱い (report / upload / quarantine)
+	StuckRecordingAction                string `ini:"stuck_recording_action"`
+	StuckRecordingQuarantineDirFullPath string `ini:"stuck_recording_quarantine_dir_full_path"`
 
 	UploadWorkers int `ini:"upload_workers"`
 
+	// 録画ディレクトリごとのアップロードの失敗履歴を保存するディレクトリ
+	// 指定した場合は失敗した録画ディレクトリを待ち時間を空けてから処理する
+	UploadAttemptsDirFullPath string `ini:"upload_attempts_dir_full_path"`
+	// 失敗した回数がこの回数に達した録画ディレクトリを upload_failed_dir_full_path に移動する、0 の場合は移動しない
+	UploadMaxAttempts       int    `ini:"upload_max_attempts"`
+	UploadFailedDirFullPath string `ini:"upload_failed_dir_full_path"`
+	// 失敗した後に次に処理するまでの待ち時間、失敗するたびに 2 倍にし、最大値で打ち止めにする
+	UploadRetryBackoffInitialS int `ini:"upload_retry_backoff_initial_s"`
+	UploadRetryBackoffMaxS     int `ini:"upload_retry_backoff_max_s"`
+
+	// オブジェクトストレージの操作に失敗した場合に同じ実行中でリトライするファイルごとの回数、0 の場合はリトライしない
+	StorageRetryBudget int `ini:"storage_retry_budget"`
+	// リトライまでの待ち時間、リトライするたびに 2 倍にし、最大値で打ち止めにする
+	StorageRetryIntervalInitialMS int `ini:"storage_retry_interval_initial_ms"`
+	StorageRetryIntervalMaxMS     int `ini:"storage_retry_interval_max_ms"`
+	// クライアントライブラリ内でリクエストをリトライする回数、0 の場合はクライアントライブラリの既定値の 10 回
+	// multipart アップロードするメディアファイルは、失敗したパートだけをこの回数までリトライする
+	StorageClientMaxRetries int `ini:"storage_client_max_retries"`
+
+	// 多重起動を防ぐためにロックするファイルのパス
+	LockFilePath string `ini:"lock_file_path"`
+	// 他のプロセスがロックを保持している場合の動作 (exit / wait)
+	LockMode string `ini:"lock_mode"`
+	// 録画ディレクトリごとのロックファイルを置くディレクトリ
+	// 指定した場合は他のプロセスが処理中の録画ディレクトリを処理しない
+	RecordingLockDirFullPath string `ini:"recording_lock_dir_full_path"`
+
+	// 停止シグナルを受け取った後、処理中のファイルの完了を待つ時間
+	// 0 の場合は待たずに処理中のファイルを中断する
+	ShutdownDrainTimeoutS int `ini:"shutdown_drain_timeout_s"`
+
+	// 0 より大きい場合は常駐し、指定した間隔でアーカイブディレクトリを探索する
+	// 0 の場合は 1 回だけ探索とアップロードを行い終了する (タイマーモード)
+	ScanIntervalS int `ini:"scan_interval_s"`
+
+	// 常駐モードで Prometheus のメトリクスを公開するアドレス
+	MetricsListenAddr string `ini:"metrics_listen_addr"`
+	// タイマーモードで node_exporter の textfile collector 向けにメトリクスを書き出すファイルのパス
+	MetricsTextfilePath string `ini:"metrics_textfile_path"`
+
+	// OpenTelemetry のスパンを OTLP/HTTP で送信する先の URL
+	TracingOTLPEndpointURL string `ini:"tracing_otlp_endpoint_url"`
+
+	// 処理結果を JSON で書き出すファイルのパス
+	RunSummaryFilePath string `ini:"run_summary_file_path"`
+	// 処理結果を run.summary ウェブフックで送信する
+	RunSummaryWebhook bool `ini:"run_summary_webhook"`
+
+	// 管理用 HTTP API を公開するアドレス
+	// unix: から始まる場合は Unix ドメインソケットのパスとして扱う
+	AdminListenAddr string `ini:"admin_listen_addr"`
+
 	// 1 ファイルあたりのアップロードレート制限
 	UploadFileRateLimitMbps int `ini:"upload_file_rate_limit_mbps"`
 
+	// メディアファイルのアップロードの進捗をログに出力する間隔、0 の場合は出力しない
+	UploadProgressLogIntervalS int `ini:"upload_progress_log_interval_s"`
+
 	WebhookEndpointURL            string `ini:"webhook_endpoint_url"`
 	WebhookEndpointHealthCheckURL string `ini:"webhook_endpoint_health_check_url"`
 
@@ -53,17 +176,29 @@ type Config struct {
 	WebhookTypeSplitArchiveUploaded    string `ini:"webhook_type_split_archive_uploaded"`
 	WebhookTypeSplitArchiveEndUploaded string `ini:"webhook_type_split_archive_end_uploaded"`
 	WebhookTypeReportUploaded          string `ini:"webhook_type_report_uploaded"`
+	WebhookTypeRecordingIncomplete     string `ini:"webhook_type_recording_incomplete"`
+	WebhookTypeDiskPressure            string `ini:"webhook_type_disk_pressure"`
+	WebhookTypeRunSummary              string `ini:"webhook_type_run_summary"`
+	WebhookTypeUploadFailed            string `ini:"webhook_type_upload_failed"`
 
 	ExcludeWebhookRecordingMetadata bool `ini:"exclude_webhook_recording_metadata"`
 
 	WebhookBasicAuthUsername string `ini:"webhook_basic_auth_username"`
 	WebhookBasicAuthPassword string `ini:"webhook_basic_auth_password"`
+	// webhook_basic_auth_password をファイルから読み込む
+	WebhookBasicAuthPasswordFile string `ini:"webhook_basic_auth_password_file"`
 
 	WebhookRequestTimeoutS int32 `ini:"webhook_request_timeout_s"`
 
 	WebhookTLSVerifyCacertPath string `ini:"webhook_tls_verify_cacert_path"`
 	WebhookTLSFullchainPath    string `ini:"webhook_tls_fullchain_path"`
 	WebhookTLSPrivkeyPath      string `ini:"webhook_tls_privkey_path"`
+
+	// resend-webhook で再送するためにウェブフックのペイロードを保存するディレクトリ
+	WebhookPayloadStoreDirFullPath string `ini:"webhook_payload_store_dir_full_path"`
+
+	// 環境変数で上書きした設定項目
+	envOverriddenKeys []string
 }
 
 func newConfig(configFilePath string) (*Config, error) {
@@ -72,12 +207,203 @@ func newConfig(configFilePath string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.envOverriddenKeys = applyEnvOverrides(iniConfig)
 	if err := iniConfig.StrictMapTo(config); err != nil {
 		return nil, err
 	}
+	if err := loadSecretFiles(config); err != nil {
+		return nil, err
+	}
+	if err := loadArchiveRoots(iniConfig, config); err != nil {
+		return nil, err
+	}
+	if err := loadFilterRules(iniConfig, config); err != nil {
+		return nil, err
+	}
+	if err := loadErrorClassOverrides(iniConfig, config); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
 	return config, nil
 }
 
+func loadArchiveRoots(iniConfig *ini.File, config *Config) error {
+	// 従来の archive_dir_full_path はデフォルトのアーカイブディレクトリとして扱う
+	if config.SoraArchiveDirFullPath != "" {
+		config.ArchiveRoots = append(config.ArchiveRoots, &ArchiveRoot{
+			Name:                DefaultArchiveRootName,
+			topLevel:            true,
+			ArchiveDirFullPath:  config.SoraArchiveDirFullPath,
+			EvacuateDirFullPath: config.SoraEvacuateDirFullPath,
+			ObjectKeyPrefix:     config.ObjectKeyPrefix,
+		})
+	}
+
+	for _, section := range iniConfig.Sections() {
+		if !strings.HasPrefix(section.Name(), ArchiveRootSectionPrefix) {
+			continue
+		}
+		root := &ArchiveRoot{
+			Name: strings.TrimPrefix(section.Name(), ArchiveRootSectionPrefix),
+		}
+		if err := section.StrictMapTo(root); err != nil {
+			return err
+		}
+		config.ArchiveRoots = append(config.ArchiveRoots, root)
+	}
+	return nil
+}
+
+func (c Config) filterExcludedAction() string {
+	if c.FilterExcludedAction == "" {
+		return FilterExcludedActionKeep
+	}
+	return c.FilterExcludedAction
+}
+
+func (c Config) stuckRecordingAction() string {
+	if c.StuckRecordingAction == "" {
+		return StuckRecordingActionReport
+	}
+	return c.StuckRecordingAction
+}
+
+func (c Config) webhookTypeRecordingIncomplete() string {
+	if c.WebhookTypeRecordingIncomplete == "" {
+		return DefaultWebhookTypeRecordingIncomplete
+	}
+	return c.WebhookTypeRecordingIncomplete
+}
+
+func (c Config) archiveDirMaxDepth() int {
+	if c.ArchiveDirMaxDepth <= 0 {
+		return DefaultArchiveDirMaxDepth
+	}
+	return c.ArchiveDirMaxDepth
+}
+
+// 指定したパスを含むアーカイブディレクトリを返す
+// 複数該当する場合はもっとも深いものを返す
+func (c Config) archiveRootOf(filePath string) *ArchiveRoot {
+	var found *ArchiveRoot
+	for _, root := range c.ArchiveRoots {
+		rel, err := filepath.Rel(root.ArchiveDirFullPath, filePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if found == nil || len(root.ArchiveDirFullPath) > len(found.ArchiveDirFullPath) {
+			found = root
+		}
+	}
+	return found
+}
+
+// 退避ディレクトリ内のパスを、退避する前のアーカイブディレクトリ内のパスに変換する
+// 退避ディレクトリ外のパスはそのまま返す
+func (c Config) unevacuatedPath(filePath string) string {
+	var found *ArchiveRoot
+	var foundRel string
+	for _, root := range c.ArchiveRoots {
+		rel, err := filepath.Rel(root.EvacuateDirFullPath, filePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if found == nil || len(root.EvacuateDirFullPath) > len(found.EvacuateDirFullPath) {
+			found = root
+			foundRel = rel
+		}
+	}
+	if found == nil {
+		return filePath
+	}
+	return filepath.Join(found.ArchiveDirFullPath, foundRel)
+}
+
+// 録画ディレクトリを destDir に移動する際の移動先のパスを返す
+// アーカイブディレクトリからの相対パスを維持する
+func (c Config) relocatedPath(recordingDir, destDir string) string {
+	relPath := filepath.Base(recordingDir)
+	if root := c.archiveRootOf(recordingDir); root != nil {
+		if rel, err := filepath.Rel(root.ArchiveDirFullPath, recordingDir); err == nil {
+			relPath = rel
+		}
+	}
+	return filepath.Join(destDir, relPath)
+}
+
+// 録画ディレクトリを <アーカイブディレクトリ名>/<アーカイブディレクトリからの相対パス> の形式で返す
+// アーカイブディレクトリ外の場合はディレクトリ名を返す
+func (c Config) recordingName(recordingDir string) string {
+	if root := c.archiveRootOf(recordingDir); root != nil {
+		if rel, err := filepath.Rel(root.ArchiveDirFullPath, recordingDir); err == nil {
+			return filepath.Join(root.Name, rel)
+		}
+	}
+	return filepath.Base(recordingDir)
+}
+
+// アップロード先のオブジェクトキーを返す
+// アーカイブディレクトリにプレフィックスが設定されている場合は先頭に付与する
+// 退避ディレクトリ内のパスは、退避する前のアーカイブディレクトリのプレフィックスを使う
+func (c Config) objectKey(filePath, recordingID, filename string) string {
+	objectKey := fmt.Sprintf("%s/%s", recordingID, filename)
+	root := c.archiveRootOf(c.unevacuatedPath(filePath))
+	if root == nil {
+		return objectKey
+	}
+	prefix := strings.Trim(root.ObjectKeyPrefix, "/")
+	if prefix == "" {
+		return objectKey
+	}
+	return path.Join(prefix, objectKey)
+}
+
 func (c Config) IncludeWebhookRecordingMetadata() bool {
 	return !c.ExcludeWebhookRecordingMetadata
 }
+
+// 値を出力しない設定項目
+var secretConfigKeys = map[string]bool{
+	"object_storage_secret_access_key": true,
+	"webhook_basic_auth_password":      true,
+}
+
+const redactedValue = "REDACTED"
+
+// 秘密情報を伏せた設定を INI のキー名で返す
+func (c *Config) redacted() map[string]any {
+	result := redactedFields(c)
+	roots := make(map[string]any, len(c.ArchiveRoots))
+	for _, root := range c.ArchiveRoots {
+		roots[root.Name] = redactedFields(root)
+	}
+	result[strings.TrimSuffix(ArchiveRootSectionPrefix, ".")] = roots
+	filters := make(map[string]any, len(c.FilterRules))
+	for _, rule := range c.FilterRules {
+		filters[rule.Name] = redactedFields(rule)
+	}
+	result[strings.TrimSuffix(FilterSectionPrefix, ".")] = filters
+	result[ErrorClassSectionName] = c.ErrorClassOverrides
+	return result
+}
+
+func redactedFields(v any) map[string]any {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rt := rv.Type()
+	result := make(map[string]any, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("ini")
+		if key == "" || key == "-" {
+			continue
+		}
+		field := rv.Field(i)
+		if secretConfigKeys[key] && !field.IsZero() {
+			result[key] = redactedValue
+			continue
+		}
+		result[key] = field.Interface()
+	}
+	return result
+}
@@ -0,0 +1,266 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	base32 "github.com/shogo82148/go-clockwork-base32"
+)
+
+const DefaultWebhookTypeDiskPressure = "disk.pressure"
+
+// アーカイブディレクトリがあるファイルシステムの使用状況
+type diskUsage struct {
+	Path       string
+	TotalBytes uint64
+	FreeBytes  uint64
+}
+
+func (d diskUsage) usedPercent() float64 {
+	if d.TotalBytes == 0 {
+		return 0
+	}
+	return float64(d.TotalBytes-d.FreeBytes) / float64(d.TotalBytes) * 100
+}
+
+func getDiskUsage(path string) (*diskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	return &diskUsage{
+		Path:       path,
+		TotalBytes: uint64(stat.Blocks) * uint64(stat.Bsize),
+		// root 以外が利用できる空き容量
+		FreeBytes: uint64(stat.Bavail) * uint64(stat.Bsize),
+	}, nil
+}
+
+func (c Config) diskPressureEnabled() bool {
+	return c.DiskPressureThresholdPercent > 0 || c.DiskPressureMinFreeMB > 0
+}
+
+func (c Config) isDiskPressure(d diskUsage) bool {
+	if c.DiskPressureThresholdPercent > 0 && d.usedPercent() >= float64(c.DiskPressureThresholdPercent) {
+		return true
+	}
+	if c.DiskPressureMinFreeMB > 0 && d.FreeBytes < uint64(c.DiskPressureMinFreeMB)*1024*1024 {
+		return true
+	}
+	return false
+}
+
+// 空き容量が閾値を下回っているアーカイブディレクトリの使用状況を返す
+func checkDiskPressure(config *Config) []*diskUsage {
+	if !config.diskPressureEnabled() {
+		return nil
+	}
+	var result []*diskUsage
+	for _, root := range config.ArchiveRoots {
+		usage, err := getDiskUsage(root.ArchiveDirFullPath)
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", root.ArchiveDirFullPath).
+				Msg("FAILED-GET-DISK-USAGE")
+			continue
+		}
+		if config.isDiskPressure(*usage) {
+			result = append(result, usage)
+		}
+	}
+	return result
+}
+
+// 緊急時の設定を返す
+// 帯域制限を解除し、設定されていればアップロードワーカー数を増やす
+func (c Config) diskPressureConfig() *Config {
+	config := c
+	config.UploadFileRateLimitMbps = 0
+	if c.DiskPressureUploadWorkers > config.UploadWorkers {
+		config.UploadWorkers = c.DiskPressureUploadWorkers
+	}
+	return &config
+}
+
+func (c Config) webhookTypeDiskPressure() string {
+	if c.WebhookTypeDiskPressure == "" {
+		return DefaultWebhookTypeDiskPressure
+	}
+	return c.WebhookTypeDiskPressure
+}
+
+// 空き容量が不足している状態を保存するファイル名
+// 退避ディレクトリに置き、実行をまたいで状態が変わった場合だけウェブフックを送信するために使う
+const diskPressureStateFilename = ".disk-pressure"
+
+func diskPressureStateFilePath(root *ArchiveRoot) string {
+	return filepath.Join(root.EvacuateDirFullPath, diskPressureStateFilename)
+}
+
+// 空き容量の不足をログに出力し、不足した状態に変わった場合はウェブフックで通知する
+// 不足が解消した場合は状態を戻す
+// 設定されていれば、同じファイルシステムにある退避ディレクトリを削除する
+func handleDiskPressure(config *Config, usages []*diskUsage) {
+	pressured := make(map[string]*diskUsage, len(usages))
+	for _, usage := range usages {
+		pressured[usage.Path] = usage
+	}
+	for _, root := range config.ArchiveRoots {
+		stateFilePath := diskPressureStateFilePath(root)
+		_, err := os.Stat(stateFilePath)
+		wasPressured := err == nil
+
+		usage, ok := pressured[root.ArchiveDirFullPath]
+		if !ok {
+			if wasPressured {
+				if err := os.Remove(stateFilePath); err != nil {
+					zlog.Error().
+						Err(err).
+						Str("state_file_path", stateFilePath).
+						Msg("FAILED-REMOVE-DISK-PRESSURE-STATE-FILE")
+				}
+				zlog.Info().
+					Str("path", root.ArchiveDirFullPath).
+					Msg("DISK-PRESSURE-RESOLVED")
+			}
+			continue
+		}
+
+		zlog.Warn().
+			Str("path", usage.Path).
+			Uint64("total_bytes", usage.TotalBytes).
+			Uint64("free_bytes", usage.FreeBytes).
+			Float64("used_percent", usage.usedPercent()).
+			Int("threshold_percent", config.DiskPressureThresholdPercent).
+			Int64("min_free_mb", config.DiskPressureMinFreeMB).
+			Bool("continued", wasPressured).
+			Msg("DISK-PRESSURE-DETECTED")
+
+		if !wasPressured {
+			if err := os.MkdirAll(root.EvacuateDirFullPath, 0755); err == nil {
+				err = os.WriteFile(stateFilePath, nil, 0644)
+			}
+			if err != nil {
+				zlog.Error().
+					Err(err).
+					Str("state_file_path", stateFilePath).
+					Msg("FAILED-WRITE-DISK-PRESSURE-STATE-FILE")
+			}
+			if config.WebhookEndpointURL != "" {
+				if err := postDiskPressureWebhook(config, usage); err != nil {
+					zlog.Error().
+						Err(err).
+						Str("path", usage.Path).
+						Msg("DISK-PRESSURE-WEBHOOK-SEND-ERROR")
+				}
+			}
+		}
+
+		if config.DiskPressurePurgeEvacuate {
+			purgeEvacuateDirectoriesOnDevice(config, usage.Path)
+		}
+	}
+}
+
+// 空き容量が閾値を上回るまで、path と同じファイルシステムにある退避ディレクトリの古い録画ディレクトリから削除する
+// 別のファイルシステムの退避ディレクトリを削除しても空き容量は増えないため対象外にする
+func purgeEvacuateDirectoriesOnDevice(config *Config, path string) {
+	policy := config.evacuateRetentionPolicy()
+	policy.pressure = func() bool {
+		u, err := getDiskUsage(path)
+		return err == nil && config.isDiskPressure(*u)
+	}
+	for _, root := range config.ArchiveRoots {
+		if !policy.pressure() {
+			return
+		}
+		if !sameDevice(path, root.EvacuateDirFullPath) {
+			zlog.Debug().
+				Str("path", path).
+				Str("evacuate_dir_path", root.EvacuateDirFullPath).
+				Msg("SKIP-PURGE-EVACUATE-DIRECTORY-ON-OTHER-DEVICE")
+			continue
+		}
+		purgeEvacuateDirectory(root.EvacuateDirFullPath, config.archiveDirMaxDepth(), policy)
+	}
+}
+
+// 2 つのパスが同じデバイスにあるか
+// どちらかのパスを確認できない場合は false を返す
+func sameDevice(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	aStat, ok := aInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	bStat, ok := bInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return aStat.Dev == bStat.Dev
+}
+
+func postDiskPressureWebhook(config *Config, usage *diskUsage) error {
+	webhookID, err := generateWebhookID(base32.NewEncoding())
+	if err != nil {
+		return err
+	}
+	webhookType := config.webhookTypeDiskPressure()
+	w := WebhookDiskPressure{
+		ID:               webhookID,
+		Type:             webhookType,
+		Timestamp:        time.Now().UTC(),
+		Path:             usage.Path,
+		TotalBytes:       usage.TotalBytes,
+		FreeBytes:        usage.FreeBytes,
+		UsedPercent:      usage.usedPercent(),
+		ThresholdPercent: config.DiskPressureThresholdPercent,
+		MinFreeMB:        config.DiskPressureMinFreeMB,
+	}
+	buf, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return postWebhook(context.Background(), config, webhookType, buf)
+}
+
+// サイズの大きい録画ディレクトリから処理するように並べ替える
+// 録画ディレクトリ内のファイルの順番は維持する
+func sortByRecordingSize(files []string) []string {
+	var dirs []string
+	filesByDir := make(map[string][]string)
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if _, ok := filesByDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		filesByDir[dir] = append(filesByDir[dir], f)
+	}
+	sizes := make(map[string]int64, len(dirs))
+	for _, dir := range dirs {
+		sizes[dir] = directorySize(dir)
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return sizes[dirs[i]] > sizes[dirs[j]]
+	})
+
+	result := make([]string, 0, len(files))
+	for _, dir := range dirs {
+		result = append(result, filesByDir[dir]...)
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeEvacuateDirectoryDiskPressure(t *testing.T) {
+	evacuateDir := t.TempDir()
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC1"), 10, 3*time.Hour)
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC2"), 10, 2*time.Hour)
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC3"), 10, time.Hour)
+
+	// 2 つ削除すると空き容量が閾値を上回る
+	var calls int
+	policy := retentionPolicy{
+		pressure: func() bool {
+			calls++
+			return calls <= 2
+		},
+	}
+	purgeEvacuateDirectory(evacuateDir, 1, policy)
+
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "REC1"))
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "REC2"))
+	assert.DirExists(t, filepath.Join(evacuateDir, "REC3"))
+	// 不足が解消した後は残りの録画ディレクトリを確認しない
+	assert.Equal(t, 3, calls)
+}
+
+func TestPurgeEvacuateDirectoriesOnDevice(t *testing.T) {
+	archiveDir := t.TempDir()
+	evacuateDir := t.TempDir()
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC1"), 10, time.Hour)
+
+	// 空き容量が不足したままでも、別のファイルシステムの退避ディレクトリは削除しない
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: archiveDir, EvacuateDirFullPath: evacuateDir},
+		},
+		DiskPressureMinFreeMB: 1 << 40,
+	}
+	purgeEvacuateDirectoriesOnDevice(config, "/proc")
+	assert.DirExists(t, filepath.Join(evacuateDir, "REC1"))
+
+	// 同じファイルシステムの退避ディレクトリは削除する
+	purgeEvacuateDirectoriesOnDevice(config, archiveDir)
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "REC1"))
+
+	assert.True(t, sameDevice(archiveDir, evacuateDir))
+	assert.False(t, sameDevice(archiveDir, "/proc"))
+	assert.False(t, sameDevice(archiveDir, filepath.Join(archiveDir, "not-found")))
+}
+
+func TestHandleDiskPressureWebhookOnStateChange(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer server.Close()
+
+	root := &ArchiveRoot{
+		ArchiveDirFullPath:  t.TempDir(),
+		EvacuateDirFullPath: filepath.Join(t.TempDir(), "evacuate"),
+	}
+	config := &Config{
+		ArchiveRoots:                 []*ArchiveRoot{root},
+		DiskPressureThresholdPercent: 90,
+		WebhookEndpointURL:           server.URL,
+		WebhookTypeHeaderName:        "sora-archive-uploader-webhook-type",
+	}
+	usage := &diskUsage{Path: root.ArchiveDirFullPath, TotalBytes: 100, FreeBytes: 1}
+
+	// 不足した状態が続いている間は 1 回だけ送信する
+	handleDiskPressure(config, []*diskUsage{usage})
+	handleDiskPressure(config, []*diskUsage{usage})
+	assert.Equal(t, int32(1), received.Load())
+	assert.FileExists(t, diskPressureStateFilePath(root))
+
+	// 解消した後に再び不足した場合は送信する
+	handleDiskPressure(config, nil)
+	assert.NoFileExists(t, diskPressureStateFilePath(root))
+	handleDiskPressure(config, []*diskUsage{usage})
+	require.Equal(t, int32(2), received.Load())
+}
@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// 設定項目を上書きする環境変数名のプレフィックス
+// <プレフィックス><INI のキー名を大文字にしたもの> の形式で指定する
+// [archive_root.<name>] と [filter.<name>] セクションの項目は
+// <プレフィックス>ARCHIVE_ROOT_<NAME>_<キー名> や <プレフィックス>FILTER_<NAME>_<キー名> の形式で指定する
+// セクションは設定ファイルにあるもののみ上書きできる
+const EnvPrefix = "SORA_ARCHIVE_UPLOADER_"
+
+// 環境変数の値で INI の値を上書きし、上書きしたキー名を返す
+func applyEnvOverrides(iniConfig *ini.File) []string {
+	var overridden []string
+	overridden = append(overridden, overrideSection(iniConfig.Section(ini.DefaultSection), EnvPrefix, "", reflect.TypeFor[Config]())...)
+	for _, section := range iniConfig.Sections() {
+		var t reflect.Type
+		var sectionPrefix string
+		switch {
+		case strings.HasPrefix(section.Name(), ArchiveRootSectionPrefix):
+			t = reflect.TypeFor[ArchiveRoot]()
+			sectionPrefix = ArchiveRootSectionPrefix
+		case strings.HasPrefix(section.Name(), FilterSectionPrefix):
+			t = reflect.TypeFor[FilterRule]()
+			sectionPrefix = FilterSectionPrefix
+		default:
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), sectionPrefix)
+		envPrefix := EnvPrefix + envName(strings.TrimSuffix(sectionPrefix, ".")) + "_" + envName(name) + "_"
+		overridden = append(overridden, overrideSection(section, envPrefix, section.Name()+".", t)...)
+	}
+	return overridden
+}
+
+func overrideSection(section *ini.Section, envPrefix, keyPrefix string, t reflect.Type) []string {
+	var overridden []string
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("ini")
+		if key == "" || key == "-" {
+			continue
+		}
+		value, ok := os.LookupEnv(envPrefix + envName(key))
+		if !ok {
+			continue
+		}
+		section.Key(key).SetValue(value)
+		overridden = append(overridden, keyPrefix+key)
+	}
+	return overridden
+}
+
+// 英数字以外を _ に置き換えて大文字にする
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// *_file で指定したファイルから秘密情報を読み込む
+// Kubernetes の Secret をマウントしたファイルなどを想定し、末尾の改行は取り除く
+func loadSecretFiles(config *Config) error {
+	for _, secret := range []struct {
+		key      string
+		value    *string
+		filePath string
+	}{
+		{"object_storage_secret_access_key", &config.ObjectStorageSecretAccessKey, config.ObjectStorageSecretAccessKeyFile},
+		{"webhook_basic_auth_password", &config.WebhookBasicAuthPassword, config.WebhookBasicAuthPasswordFile},
+	} {
+		if secret.filePath == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s and %s_file cannot be set at the same time", secret.key, secret.key)
+		}
+		buf, err := os.ReadFile(secret.filePath)
+		if err != nil {
+			return fmt.Errorf("%s_file: %w", secret.key, err)
+		}
+		*secret.value = strings.TrimRight(string(buf), "\r\n")
+	}
+	return nil
+}
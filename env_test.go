@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewConfigEnvOverrides(t *testing.T) {
+	root := t.TempDir()
+	configFilePath := writeTestConfig(t, `
+archive_dir_full_path = `+root+`/archive
+evacuate_dir_full_path = `+root+`/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+upload_workers = 4
+
+[archive_root.sora-2]
+archive_dir_full_path = `+root+`/archive2
+evacuate_dir_full_path = `+root+`/evacuate2
+
+[filter.exclude-test]
+action = exclude
+channel_id_glob = test-*
+`)
+	secretFilePath := filepath.Join(root, "secret")
+	require.NoError(t, os.WriteFile(secretFilePath, []byte("secret-access-key\n"), 0600))
+
+	t.Setenv("SORA_ARCHIVE_UPLOADER_UPLOAD_WORKERS", "8")
+	t.Setenv("SORA_ARCHIVE_UPLOADER_DEBUG", "true")
+	t.Setenv("SORA_ARCHIVE_UPLOADER_OBJECT_STORAGE_ACCESS_KEY_ID", "access-key-id")
+	t.Setenv("SORA_ARCHIVE_UPLOADER_OBJECT_STORAGE_SECRET_ACCESS_KEY_FILE", secretFilePath)
+	t.Setenv("SORA_ARCHIVE_UPLOADER_ARCHIVE_ROOT_SORA_2_OBJECT_KEY_PREFIX", "sora2")
+	t.Setenv("SORA_ARCHIVE_UPLOADER_FILTER_EXCLUDE_TEST_CHANNEL_ID_GLOB", "debug-*")
+
+	config, err := newConfig(configFilePath)
+	require.NoError(t, err)
+	assert.Equal(t, 8, config.UploadWorkers)
+	assert.True(t, config.Debug)
+	assert.Equal(t, "access-key-id", config.ObjectStorageAccessKeyID)
+	assert.Equal(t, "secret-access-key", config.ObjectStorageSecretAccessKey)
+	require.Len(t, config.ArchiveRoots, 2)
+	assert.Equal(t, "sora2", config.ArchiveRoots[1].ObjectKeyPrefix)
+	require.Len(t, config.FilterRules, 1)
+	assert.Equal(t, "debug-*", config.FilterRules[0].ChannelIDGlob)
+	assert.ElementsMatch(t, []string{
+		"debug",
+		"object_storage_access_key_id",
+		"object_storage_secret_access_key_file",
+		"upload_workers",
+		"archive_root.sora-2.object_key_prefix",
+		"filter.exclude-test.channel_id_glob",
+	}, config.envOverriddenKeys)
+
+	// 秘密情報は出力しない
+	redacted := config.redacted()
+	assert.Equal(t, redactedValue, redacted["object_storage_secret_access_key"])
+	assert.Equal(t, secretFilePath, redacted["object_storage_secret_access_key_file"])
+
+	// 値とファイルを両方指定した場合はエラーにする
+	t.Setenv("SORA_ARCHIVE_UPLOADER_OBJECT_STORAGE_SECRET_ACCESS_KEY", "secret")
+	_, err = newConfig(configFilePath)
+	assert.EqualError(t, err, "object_storage_secret_access_key and object_storage_secret_access_key_file cannot be set at the same time")
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "UPLOAD_WORKERS", envName("upload_workers"))
+	assert.Equal(t, "SORA_2", envName("sora-2"))
+	assert.Equal(t, "A_B", envName("a.b"))
+}
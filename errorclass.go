@@ -0,0 +1,186 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"gopkg.in/ini.v1"
+)
+
+// 処理に失敗したファイルの扱い
+const (
+	// 一時的なエラーなので、同じ実行中にリトライし、それでも失敗した場合は upload_retry_backoff_initial_s を待たずに次回の探索で再度処理する
+	ErrorClassRetryNow = "retry-now"
+	// upload_retry_backoff_initial_s から倍々に待ってから再度処理する
+	// 混雑している場合は同じ実行中にもリトライする
+	ErrorClassRetryLater = "retry-later"
+	// 再度処理しても成功しないので、隔離ディレクトリに移動する
+	ErrorClassQuarantine = "quarantine"
+	// 失敗として記録せず、ファイルもそのまま残す
+	ErrorClassSkip = "skip"
+)
+
+const ErrorClassSectionName = "error_class"
+
+// S3 のエラーコード以外のエラーの理由
+const (
+	ErrorReasonCanceled         = "canceled"
+	ErrorReasonTimeout          = "timeout"
+	ErrorReasonNetwork          = "network"
+	ErrorReasonJSONNotExist     = "json_not_exist"
+	ErrorReasonMediaNotExist    = "media_not_exist"
+	ErrorReasonPermissionDenied = "permission_denied"
+	ErrorReasonLocalIO          = "local_io"
+	ErrorReasonInvalidJSON      = "invalid_json"
+	ErrorReasonUnknown          = "unknown"
+)
+
+// エラーの理由ごとのデフォルトの扱い
+// キーは小文字で、S3 のエラーコード、http_<ステータスコード>、http_<N>xx、または ErrorReason から始まる定数の値
+var defaultErrorClasses = map[string]string{
+	// 設定やバケットの誤り、ファイルのサイズなど、再度アップロードしても成功しないもの
+	"nosuchbucket":          ErrorClassQuarantine,
+	"accessdenied":          ErrorClassQuarantine,
+	"invalidregion":         ErrorClassQuarantine,
+	"entitytoolarge":        ErrorClassQuarantine,
+	"invalidaccesskeyid":    ErrorClassQuarantine,
+	"signaturedoesnotmatch": ErrorClassQuarantine,
+	"invalidbucketname":     ErrorClassQuarantine,
+	"keytoolongerror":       ErrorClassQuarantine,
+	"accountproblem":        ErrorClassQuarantine,
+	"allaccessdisabled":     ErrorClassQuarantine,
+	"http_403":              ErrorClassQuarantine,
+	// オブジェクトストレージ側の一時的なエラー
+	"requesttimeout": ErrorClassRetryNow,
+	"internalerror":  ErrorClassRetryNow,
+	"expiredtoken":   ErrorClassRetryNow,
+	"http_5xx":       ErrorClassRetryNow,
+	// 混雑している場合は間隔を空ける
+	"slowdown":             ErrorClassRetryLater,
+	"serviceunavailable":   ErrorClassRetryLater,
+	"requesttimetooskewed": ErrorClassRetryLater,
+	"http_429":             ErrorClassRetryLater,
+	"http_503":             ErrorClassRetryLater,
+	"http_4xx":             ErrorClassRetryLater,
+
+	ErrorReasonCanceled:         ErrorClassSkip,
+	ErrorReasonTimeout:          ErrorClassRetryNow,
+	ErrorReasonNetwork:          ErrorClassRetryNow,
+	ErrorReasonJSONNotExist:     ErrorClassSkip,
+	ErrorReasonMediaNotExist:    ErrorClassQuarantine,
+	ErrorReasonPermissionDenied: ErrorClassRetryLater,
+	ErrorReasonLocalIO:          ErrorClassRetryLater,
+	ErrorReasonInvalidJSON:      ErrorClassQuarantine,
+	ErrorReasonUnknown:          ErrorClassRetryLater,
+}
+
+// 分類したエラー
+type ErrorClassification struct {
+	// もっとも具体的な理由
+	Reason string
+	Class  string
+}
+
+func isErrorClass(class string) bool {
+	switch class {
+	case ErrorClassRetryNow, ErrorClassRetryLater, ErrorClassQuarantine, ErrorClassSkip:
+		return true
+	}
+	return false
+}
+
+// [error_class] セクションの <理由> = <扱い> を読み込む
+func loadErrorClassOverrides(iniConfig *ini.File, config *Config) error {
+	section, err := iniConfig.GetSection(ErrorClassSectionName)
+	if err != nil {
+		return nil
+	}
+	config.ErrorClassOverrides = make(map[string]string)
+	for _, key := range section.Keys() {
+		config.ErrorClassOverrides[strings.ToLower(key.Name())] = key.String()
+	}
+	return nil
+}
+
+// エラーを分類する
+// 具体的な理由から順に [error_class] セクション、デフォルトの扱いを探し、最初に見つかったものを使う
+func (c Config) classifyError(err error) ErrorClassification {
+	reasons := errorReasons(err)
+	for _, reason := range reasons {
+		key := strings.ToLower(reason)
+		if class, ok := c.ErrorClassOverrides[key]; ok {
+			return ErrorClassification{Reason: reasons[0], Class: class}
+		}
+		if class, ok := defaultErrorClasses[key]; ok {
+			return ErrorClassification{Reason: reasons[0], Class: class}
+		}
+	}
+	return ErrorClassification{Reason: reasons[0], Class: ErrorClassRetryLater}
+}
+
+// エラーの理由を具体的なものから順に返す
+func errorReasons(err error) []string {
+	if errors.Is(err, context.Canceled) {
+		return []string{ErrorReasonCanceled}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return []string{ErrorReasonTimeout}
+	}
+
+	var errResp minio.ErrorResponse
+	if errors.As(err, &errResp) && (errResp.Code != "" || errResp.StatusCode != 0) {
+		var reasons []string
+		if errResp.Code != "" {
+			reasons = append(reasons, errResp.Code)
+		}
+		if errResp.StatusCode != 0 {
+			reasons = append(reasons,
+				"http_"+strconv.Itoa(errResp.StatusCode),
+				fmt.Sprintf("http_%dxx", errResp.StatusCode/100),
+			)
+		}
+		return append(reasons, ErrorReasonUnknown)
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return []string{ErrorReasonInvalidJSON}
+	}
+
+	// fs.PathError が包む syscall.Errno は Timeout() と Temporary() を持ち、errors.As で net.Error として取り出せてしまうので、
+	// 先にローカルのファイルのエラーを確認する
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && strings.HasSuffix(pathErr.Path, ".json"):
+			return []string{ErrorReasonJSONNotExist, ErrorReasonLocalIO}
+		case errors.Is(err, fs.ErrNotExist):
+			return []string{ErrorReasonMediaNotExist, ErrorReasonLocalIO}
+		case errors.Is(err, fs.ErrPermission):
+			return []string{ErrorReasonPermissionDenied, ErrorReasonLocalIO}
+		}
+		return []string{ErrorReasonLocalIO}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return []string{ErrorReasonTimeout, ErrorReasonNetwork}
+		}
+		return []string{ErrorReasonNetwork}
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return []string{ErrorReasonNetwork}
+	}
+
+	return []string{ErrorReasonUnknown}
+}
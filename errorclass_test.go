@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	config := &Config{}
+
+	// S3 のエラーコード
+	assert.Equal(t, ErrorClassification{Reason: "NoSuchBucket", Class: ErrorClassQuarantine},
+		config.classifyError(minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: 404}))
+	assert.Equal(t, ErrorClassification{Reason: "EntityTooLarge", Class: ErrorClassQuarantine},
+		config.classifyError(minio.ErrorResponse{Code: "EntityTooLarge", StatusCode: 400}))
+	assert.Equal(t, ErrorClassification{Reason: "SignatureDoesNotMatch", Class: ErrorClassQuarantine},
+		config.classifyError(minio.ErrorResponse{Code: "SignatureDoesNotMatch", StatusCode: 403}))
+	assert.Equal(t, ErrorClassification{Reason: "SlowDown", Class: ErrorClassRetryLater},
+		config.classifyError(minio.ErrorResponse{Code: "SlowDown", StatusCode: 503}))
+	assert.Equal(t, ErrorClassification{Reason: "InternalError", Class: ErrorClassRetryNow},
+		config.classifyError(minio.ErrorResponse{Code: "InternalError", StatusCode: 500}))
+
+	// 知らないエラーコードは HTTP ステータスコードで分類する
+	assert.Equal(t, ErrorClassification{Reason: "Unknown5xx", Class: ErrorClassRetryNow},
+		config.classifyError(minio.ErrorResponse{Code: "Unknown5xx", StatusCode: 502}))
+	assert.Equal(t, ErrorClassification{Reason: "Unknown4xx", Class: ErrorClassQuarantine},
+		config.classifyError(minio.ErrorResponse{Code: "Unknown4xx", StatusCode: 403}))
+	assert.Equal(t, ErrorClassification{Reason: "http_429", Class: ErrorClassRetryLater},
+		config.classifyError(minio.ErrorResponse{StatusCode: 429}))
+
+	// ネットワークのエラー
+	connRefused := &url.Error{Op: "Put", URL: "https://s3.example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonNetwork, Class: ErrorClassRetryNow}, config.classifyError(connRefused))
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonTimeout, Class: ErrorClassRetryNow},
+		config.classifyError(fmt.Errorf("upload: %w", context.DeadlineExceeded)))
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonCanceled, Class: ErrorClassSkip},
+		config.classifyError(&url.Error{Op: "Put", URL: "https://s3.example.com", Err: context.Canceled}))
+
+	// ローカルのファイルのエラー
+	dir := t.TempDir()
+	_, err := os.Open(filepath.Join(dir, "archive-A.json"))
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonJSONNotExist, Class: ErrorClassSkip}, config.classifyError(err))
+	_, err = os.Open(filepath.Join(dir, "archive-A.webm"))
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonMediaNotExist, Class: ErrorClassQuarantine}, config.classifyError(err))
+	err = &fs.PathError{Op: "open", Path: filepath.Join(dir, "archive-A.webm"), Err: fs.ErrPermission}
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonPermissionDenied, Class: ErrorClassRetryLater}, config.classifyError(err))
+	err = &fs.PathError{Op: "read", Path: filepath.Join(dir, "archive-A.webm"), Err: syscall.EIO}
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonLocalIO, Class: ErrorClassRetryLater}, config.classifyError(err))
+	var am ArchiveMetadata
+	err = json.Unmarshal([]byte("{"), &am)
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonInvalidJSON, Class: ErrorClassQuarantine}, config.classifyError(err))
+
+	assert.Equal(t, ErrorClassification{Reason: ErrorReasonUnknown, Class: ErrorClassRetryLater},
+		config.classifyError(errors.New("unexpected")))
+}
+
+func TestClassifyErrorOverrides(t *testing.T) {
+	root := t.TempDir()
+	config, err := newConfig(writeTestConfig(t, `
+archive_dir_full_path = `+root+`/archive
+evacuate_dir_full_path = `+root+`/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+upload_workers = 1
+
+[error_class]
+AccessDenied = retry-later
+http_5xx = retry-later
+network = skip
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrorClassRetryLater, config.classifyError(minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}).Class)
+	assert.Equal(t, ErrorClassRetryLater, config.classifyError(minio.ErrorResponse{Code: "BadGateway", StatusCode: 502}).Class)
+	assert.Equal(t, ErrorClassSkip, config.classifyError(&net.OpError{Op: "dial", Err: syscall.ECONNRESET}).Class)
+	// より具体的な理由のデフォルトの扱いが優先される
+	assert.Equal(t, ErrorClassRetryNow, config.classifyError(minio.ErrorResponse{Code: "InternalError", StatusCode: 500}).Class)
+	// 設定していない理由はデフォルトの扱いになる
+	assert.Equal(t, ErrorClassQuarantine, config.classifyError(minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: 404}).Class)
+
+	_, err = newConfig(writeTestConfig(t, `
+archive_dir_full_path = `+root+`/archive
+evacuate_dir_full_path = `+root+`/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+upload_workers = 1
+
+[error_class]
+SlowDown = retry
+`))
+	require.Error(t, err)
+	assert.Equal(t, []string{`error_class: slowdown: unsupported value: "retry"`}, configErrorMessages(err))
+}
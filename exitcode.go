@@ -0,0 +1,32 @@
+package archive
+
+// sora-archive-uploader の終了コード
+// systemd の OnFailure= や監視ツールで処理結果を判別できるようにする
+const (
+	// すべてのファイルの処理に成功した
+	ExitCodeSuccess = 0
+	// 予期しないエラーで終了した、または 2 回目の停止シグナルで強制終了した
+	ExitCodeError = 1
+	// 処理対象のファイルが見つからなかった、または他のプロセスが実行中だった
+	ExitCodeNothingToDo = 3
+	// 処理に失敗したファイルがあり、次回の実行で再度処理する
+	ExitCodeRetryableFailure = 4
+	// リトライしないエラーで処理に失敗したファイルがある、または失敗した回数が上限に達した録画ディレクトリがある
+	ExitCodeNonRetryableFailure = 5
+	// 設定の誤りなどで起動できなかった
+	ExitCodeConfigError = 6
+)
+
+// タイマーモードの処理結果から終了コードを決める
+// 失敗の種類が混在する場合は、対応が必要なリトライしないエラーを優先する
+func (s *RunSummary) exitCode() int {
+	switch {
+	case s.NonRetryableFailures > 0, s.FailedRecordings > 0:
+		return ExitCodeNonRetryableFailure
+	case s.FailedFiles > 0:
+		return ExitCodeRetryableFailure
+	case s.RecordingsFound == 0:
+		return ExitCodeNothingToDo
+	}
+	return ExitCodeSuccess
+}
@@ -0,0 +1,15 @@
+package archive
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunSummaryExitCode(t *testing.T) {
+	assert.Equal(t, ExitCodeNothingToDo, (&RunSummary{}).exitCode())
+	assert.Equal(t, ExitCodeSuccess, (&RunSummary{RecordingsFound: 2}).exitCode())
+	assert.Equal(t, ExitCodeRetryableFailure, (&RunSummary{RecordingsFound: 2, FailedFiles: 1}).exitCode())
+	// リトライしないエラーを優先する
+	assert.Equal(t, ExitCodeNonRetryableFailure, (&RunSummary{RecordingsFound: 2, FailedFiles: 2, NonRetryableFailures: 1}).exitCode())
+}
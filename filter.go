@@ -0,0 +1,449 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// フィルタを指定するセクション名のプレフィックス
+	// [filter.<name>] の形式で指定する
+	FilterSectionPrefix = "filter."
+
+	FilterRuleActionInclude = "include"
+	FilterRuleActionExclude = "exclude"
+
+	// 除外した録画ファイルの扱い
+	FilterExcludedActionKeep   = "keep"
+	FilterExcludedActionMove   = "move"
+	FilterExcludedActionDelete = "delete"
+)
+
+// 除外したファイルを移動または削除した録画ディレクトリに書き出す判定結果のファイル名
+// archive- や report- で始まらないため、処理対象のファイルとして扱われない
+// メディアファイルがなくなった後に書き出された report ファイルも、この判定結果で除外する
+const filterExcludedFilename = "filter-excluded.json"
+
+// 録画ディレクトリに保存する除外の判定結果
+type FilterExcluded struct {
+	RecordingID string    `json:"recording_id"`
+	ChannelID   string    `json:"channel_id"`
+	Filter      string    `json:"filter"`
+	ExcludedAt  time.Time `json:"excluded_at"`
+}
+
+// 録画ファイルのフィルタ
+// 指定した条件をすべて満たした場合にマッチする
+type FilterRule struct {
+	Name string `ini:"-"`
+
+	// include または exclude
+	Action string `ini:"action"`
+
+	ChannelIDGlob   string `ini:"channel_id_glob"`
+	ChannelIDRegexp string `ini:"channel_id_regexp"`
+
+	// webm または mp4
+	MediaType string `ini:"media_type"`
+
+	// メディアファイルのサイズ
+	MinFileSizeMB int64 `ini:"min_file_size_mb"`
+	MaxFileSizeMB int64 `ini:"max_file_size_mb"`
+
+	// 録画ファイルが書き出されてからの経過時間
+	MinRecordingAgeS int64 `ini:"min_recording_age_s"`
+	MaxRecordingAgeS int64 `ini:"max_recording_age_s"`
+
+	channelIDRegexp *regexp.Regexp
+}
+
+// フィルタの判定に利用する録画ファイルの情報
+type filterTarget struct {
+	RecordingID string
+	ChannelID   string
+	// メディアファイルを持たない場合は空文字
+	MediaType string
+	FileSize  int64
+	Age       time.Duration
+}
+
+func loadFilterRules(iniConfig *ini.File, config *Config) error {
+	for _, section := range iniConfig.Sections() {
+		if !strings.HasPrefix(section.Name(), FilterSectionPrefix) {
+			continue
+		}
+		rule := &FilterRule{
+			Name: strings.TrimPrefix(section.Name(), FilterSectionPrefix),
+		}
+		if err := section.StrictMapTo(rule); err != nil {
+			return err
+		}
+		switch rule.Action {
+		case FilterRuleActionInclude, FilterRuleActionExclude:
+		default:
+			return fmt.Errorf("%s: unsupported action: %q", section.Name(), rule.Action)
+		}
+		switch rule.MediaType {
+		case "", "webm", "mp4":
+		default:
+			return fmt.Errorf("%s: unsupported media_type: %q", section.Name(), rule.MediaType)
+		}
+		if rule.ChannelIDGlob != "" {
+			if _, err := filepath.Match(rule.ChannelIDGlob, ""); err != nil {
+				return fmt.Errorf("%s: invalid channel_id_glob: %w", section.Name(), err)
+			}
+		}
+		if rule.ChannelIDRegexp != "" {
+			re, err := regexp.Compile(rule.ChannelIDRegexp)
+			if err != nil {
+				return fmt.Errorf("%s: invalid channel_id_regexp: %w", section.Name(), err)
+			}
+			rule.channelIDRegexp = re
+		}
+		config.FilterRules = append(config.FilterRules, rule)
+	}
+	return nil
+}
+
+// メディアファイルの種類やサイズを条件に含むか
+func (r *FilterRule) hasMediaCondition() bool {
+	return r.MediaType != "" || r.MinFileSizeMB > 0 || r.MaxFileSizeMB > 0
+}
+
+func (r *FilterRule) match(t filterTarget) bool {
+	if r.ChannelIDGlob != "" {
+		if ok, _ := filepath.Match(r.ChannelIDGlob, t.ChannelID); !ok {
+			return false
+		}
+	}
+	if r.channelIDRegexp != nil && !r.channelIDRegexp.MatchString(t.ChannelID) {
+		return false
+	}
+	if r.MediaType != "" && r.MediaType != t.MediaType {
+		return false
+	}
+	if r.MinFileSizeMB > 0 && t.FileSize < r.MinFileSizeMB*1024*1024 {
+		return false
+	}
+	if r.MaxFileSizeMB > 0 && t.FileSize > r.MaxFileSizeMB*1024*1024 {
+		return false
+	}
+	if r.MinRecordingAgeS > 0 && t.Age < time.Duration(r.MinRecordingAgeS)*time.Second {
+		return false
+	}
+	if r.MaxRecordingAgeS > 0 && t.Age > time.Duration(r.MaxRecordingAgeS)*time.Second {
+		return false
+	}
+	return true
+}
+
+// フィルタを評価して、除外するかどうかと判定に利用したフィルタ名を返す
+// include のフィルタが 1 つ以上ある場合は、いずれかにマッチしたものだけを対象にする
+// exclude のフィルタにマッチしたものは対象外にする
+// メディアファイルを持たない report や split-archive-end ファイルには、メディアファイルの条件を含むフィルタは適用しない
+func evaluateFilterRules(rules []*FilterRule, t filterTarget) (bool, string) {
+	var hasIncludeRule bool
+	var includedBy string
+	for _, rule := range rules {
+		if t.MediaType == "" && rule.hasMediaCondition() {
+			continue
+		}
+		switch rule.Action {
+		case FilterRuleActionExclude:
+			if rule.match(t) {
+				return true, rule.Name
+			}
+		case FilterRuleActionInclude:
+			hasIncludeRule = true
+			if includedBy == "" && rule.match(t) {
+				includedBy = rule.Name
+			}
+		}
+	}
+	if hasIncludeRule && includedBy == "" {
+		return true, ""
+	}
+	return false, includedBy
+}
+
+// JSON ファイルをパースしてフィルタの判定に必要な情報を集める
+func newFilterTarget(jsonFilePath string) (*filterTarget, []string, error) {
+	fileInfo, err := os.Stat(jsonFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := os.ReadFile(jsonFilePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	target := &filterTarget{
+		FileSize: fileInfo.Size(),
+		Age:      time.Since(fileInfo.ModTime()),
+	}
+	// フィルタで除外した際に一緒に扱うファイル
+	files := []string{jsonFilePath}
+
+	filename := filepath.Base(jsonFilePath)
+	switch {
+	case strings.HasPrefix(filename, "report-"):
+		var rr RecordingReport
+		if err := json.Unmarshal(raw, &rr); err != nil {
+			return nil, nil, err
+		}
+		target.RecordingID = rr.RecordingID
+		target.ChannelID = rr.ChannelID
+	case strings.HasPrefix(filename, "split-archive-end-"):
+		var aem ArchiveEndMetadata
+		if err := json.Unmarshal(raw, &aem); err != nil {
+			return nil, nil, err
+		}
+		target.RecordingID = aem.RecordingID
+		target.ChannelID = aem.ChannelID
+	default:
+		var am ArchiveMetadata
+		if err := json.Unmarshal(raw, &am); err != nil {
+			return nil, nil, err
+		}
+		target.RecordingID = am.RecordingID
+		target.ChannelID = am.ChannelID
+		mediaFilepath := filepath.Join(filepath.Dir(jsonFilePath), filepath.Base(am.Filename))
+		mediaFileInfo, err := os.Stat(mediaFilepath)
+		if err != nil {
+			return nil, nil, err
+		}
+		target.MediaType = strings.TrimPrefix(filepath.Ext(mediaFilepath), ".")
+		target.FileSize = mediaFileInfo.Size()
+		files = append(files, mediaFilepath)
+	}
+	return target, files, nil
+}
+
+// 録画単位のフィルタの判定結果
+type filterDecision struct {
+	excluded bool
+	// 判定に利用したフィルタ名
+	filter      string
+	recordingID string
+	channelID   string
+}
+
+// 録画ディレクトリの json ファイルにフィルタを評価し、録画単位で判定する
+// いずれかのファイルを除外する場合は、report ファイルを含めて録画全体を除外する
+// ファイルごとに判定すると、除外したファイルを残したまま report ファイルを処理して録画ディレクトリを退避してしまう
+// メディアファイルの条件は report ファイルには適用できないため、archive ファイルが残っている場合は archive ファイルだけで判定する
+// 以前の実行で除外したファイルを移動または削除した録画は、保存した判定結果で除外する
+func evaluateRecordingFilter(rules []*FilterRule, recordingDir string) (*filterDecision, error) {
+	raw, err := os.ReadFile(filepath.Join(recordingDir, filterExcludedFilename))
+	if err == nil {
+		var fe FilterExcluded
+		if err := json.Unmarshal(raw, &fe); err != nil {
+			return nil, err
+		}
+		return &filterDecision{
+			excluded:    true,
+			filter:      fe.Filter,
+			recordingID: fe.RecordingID,
+			channelID:   fe.ChannelID,
+		}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(recordingDir)
+	if err != nil {
+		return nil, err
+	}
+	var targets, mediaTargets []*filterTarget
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" || recordingFileType(entry.Name()) == RecordingFileTypeOther {
+			continue
+		}
+		target, _, err := newFilterTarget(filepath.Join(recordingDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+		if target.MediaType != "" {
+			mediaTargets = append(mediaTargets, target)
+		}
+	}
+	if len(mediaTargets) > 0 {
+		targets = mediaTargets
+	}
+
+	decision := &filterDecision{}
+	for _, target := range targets {
+		if decision.recordingID == "" {
+			decision.recordingID = target.RecordingID
+			decision.channelID = target.ChannelID
+		}
+		excluded, ruleName := evaluateFilterRules(rules, *target)
+		if excluded {
+			decision.excluded = true
+			decision.filter = ruleName
+			return decision, nil
+		}
+		if decision.filter == "" {
+			decision.filter = ruleName
+		}
+	}
+	return decision, nil
+}
+
+// 前回と同じ判定をログに出力した録画ディレクトリ
+// keep の場合は同じ録画を毎回判定するため、2 回目以降は Debug で出力する
+// 録画ディレクトリを退避または削除した場合と、録画ディレクトリがなくなった場合に削除する
+var loggedFilterDecisions sync.Map
+
+// 録画ディレクトリの判定を忘れる
+func forgetFilterDecision(recordingDir string) {
+	loggedFilterDecisions.Delete(recordingDir)
+}
+
+// 移動や手動の操作でなくなった録画ディレクトリの判定を忘れる
+// 常駐モードで探索するたびに呼び出し、録画ディレクトリが増え続けても保持する判定が増え続けないようにする
+func pruneFilterDecisions() {
+	loggedFilterDecisions.Range(func(key, _ any) bool {
+		if _, err := os.Stat(key.(string)); errors.Is(err, os.ErrNotExist) {
+			loggedFilterDecisions.Delete(key)
+		}
+		return true
+	})
+}
+
+// 録画のフィルタを評価し、判定をログに出力する
+func decideRecordingFilter(ctx context.Context, config *Config, recordingDir string) (*filterDecision, error) {
+	decision, err := evaluateRecordingFilter(config.FilterRules, recordingDir)
+	if err != nil {
+		return nil, err
+	}
+	action := config.filterExcludedAction()
+	key := fmt.Sprintf("%t:%s:%s", decision.excluded, decision.filter, action)
+	event := zerolog.Ctx(ctx).Info()
+	if previous, loaded := loggedFilterDecisions.Swap(recordingDir, key); loaded && previous == key {
+		event = zerolog.Ctx(ctx).Debug()
+	}
+	event = event.
+		Str("channel_id", decision.channelID).
+		Str("filter", decision.filter)
+	if !decision.excluded {
+		event.Msg("FILTER-INCLUDED")
+		return decision, nil
+	}
+	event.
+		Str("action", action).
+		Msg("FILTER-EXCLUDED")
+	return decision, nil
+}
+
+// フィルタで除外する場合は設定に従ってファイルを処理し true を返す
+func (u Uploader) excludeFile(ctx context.Context, jsonFilePath string) bool {
+	if len(u.config.FilterRules) == 0 {
+		return false
+	}
+
+	var decision *filterDecision
+	var err error
+	if u.recordingFilter != nil {
+		decision, err = u.recordingFilter(ctx, jsonFilePath)
+	} else {
+		decision, err = decideRecordingFilter(ctx, u.config, filepath.Dir(jsonFilePath))
+	}
+	if err != nil {
+		// パースできない場合はフィルタを適用せず、後続の処理でエラーとして扱う
+		zerolog.Ctx(ctx).Warn().
+			Err(err).
+			Msg("FILTER-TARGET-PARSE-ERROR")
+		return false
+	}
+	if !decision.excluded {
+		return false
+	}
+
+	// json ファイルと、archive ファイルの場合はメディアファイルを一緒に扱う
+	files := []string{jsonFilePath}
+	if _, targetFiles, err := newFilterTarget(jsonFilePath); err == nil {
+		files = targetFiles
+	}
+	if u.config.filterExcludedAction() != FilterExcludedActionKeep {
+		saveFilterExcluded(ctx, filepath.Dir(jsonFilePath), decision)
+	}
+	switch u.config.filterExcludedAction() {
+	case FilterExcludedActionMove:
+		u.moveExcludedFiles(ctx, files)
+	case FilterExcludedActionDelete:
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				zerolog.Ctx(ctx).Error().
+					Err(err).
+					Str("path", f).
+					Msg("FAILED-REMOVE-EXCLUDED-FILE")
+			} else {
+				zerolog.Ctx(ctx).Info().
+					Str("path", f).
+					Msg("REMOVED-EXCLUDED-FILE")
+			}
+		}
+	}
+	return true
+}
+
+// 後から書き出される report ファイルも除外できるように、録画ディレクトリに判定結果を保存する
+func saveFilterExcluded(ctx context.Context, recordingDir string, decision *filterDecision) {
+	path := filepath.Join(recordingDir, filterExcludedFilename)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	fe := &FilterExcluded{
+		RecordingID: decision.recordingID,
+		ChannelID:   decision.channelID,
+		Filter:      decision.filter,
+		ExcludedAt:  time.Now().UTC(),
+	}
+	if err := writeJSONFileAtomic(path, fe); err != nil {
+		zerolog.Ctx(ctx).Error().
+			Err(err).
+			Str("path", path).
+			Msg("FAILED-SAVE-FILTER-EXCLUDED")
+	}
+}
+
+// アーカイブディレクトリからの相対パスを維持して除外ディレクトリに移動する
+func (u Uploader) moveExcludedFiles(ctx context.Context, files []string) {
+	for _, f := range files {
+		newDirPath := u.config.relocatedPath(filepath.Dir(f), u.config.FilterExcludedDirFullPath)
+		if err := os.MkdirAll(newDirPath, 0755); err != nil {
+			zerolog.Ctx(ctx).Error().
+				Err(err).
+				Str("excluded_dir_path", newDirPath).
+				Msg("EXCLUDED-DIRECTORY-CREATE-ERROR")
+			return
+		}
+		newPath := filepath.Join(newDirPath, filepath.Base(f))
+		if err := os.Rename(f, newPath); err != nil {
+			zerolog.Ctx(ctx).Error().
+				Err(err).
+				Str("old_path", f).
+				Str("new_path", newPath).
+				Msg("EXCLUDED-FILE-MOVE-ERROR")
+		} else {
+			zerolog.Ctx(ctx).Info().
+				Str("old_path", f).
+				Str("new_path", newPath).
+				Msg("EXCLUDED-FILE-MOVE-SUCCESSFULLY")
+		}
+	}
+}
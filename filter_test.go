@@ -0,0 +1,208 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateFilterRules(t *testing.T) {
+	rules := []*FilterRule{
+		{Name: "test-channels", Action: FilterRuleActionExclude, ChannelIDGlob: "test-*"},
+		{Name: "large-webm", Action: FilterRuleActionExclude, MediaType: "webm", MinFileSizeMB: 10},
+		{Name: "old", Action: FilterRuleActionExclude, MinRecordingAgeS: 3600},
+	}
+
+	excluded, rule := evaluateFilterRules(rules, filterTarget{ChannelID: "test-1", MediaType: "mp4"})
+	assert.True(t, excluded)
+	assert.Equal(t, "test-channels", rule)
+
+	excluded, rule = evaluateFilterRules(rules, filterTarget{ChannelID: "prod", MediaType: "webm", FileSize: 20 * 1024 * 1024})
+	assert.True(t, excluded)
+	assert.Equal(t, "large-webm", rule)
+
+	excluded, _ = evaluateFilterRules(rules, filterTarget{ChannelID: "prod", MediaType: "mp4", FileSize: 20 * 1024 * 1024})
+	assert.False(t, excluded)
+
+	// report ファイルにはメディアファイルの条件を含むフィルタは適用しない
+	excluded, _ = evaluateFilterRules(rules, filterTarget{ChannelID: "prod", FileSize: 20 * 1024 * 1024})
+	assert.False(t, excluded)
+
+	excluded, rule = evaluateFilterRules(rules, filterTarget{ChannelID: "prod", Age: 2 * time.Hour})
+	assert.True(t, excluded)
+	assert.Equal(t, "old", rule)
+}
+
+func TestEvaluateFilterRulesInclude(t *testing.T) {
+	rules := []*FilterRule{
+		{Name: "prod", Action: FilterRuleActionInclude, channelIDRegexp: regexp.MustCompile(`^prod-`)},
+		{Name: "mp4", Action: FilterRuleActionInclude, MediaType: "mp4"},
+	}
+
+	excluded, rule := evaluateFilterRules(rules, filterTarget{ChannelID: "prod-1", MediaType: "webm"})
+	assert.False(t, excluded)
+	assert.Equal(t, "prod", rule)
+
+	excluded, rule = evaluateFilterRules(rules, filterTarget{ChannelID: "dev-1", MediaType: "mp4"})
+	assert.False(t, excluded)
+	assert.Equal(t, "mp4", rule)
+
+	excluded, _ = evaluateFilterRules(rules, filterTarget{ChannelID: "dev-1", MediaType: "webm"})
+	assert.True(t, excluded)
+
+	// include のフィルタにマッチしない report ファイルは除外する
+	excluded, _ = evaluateFilterRules(rules, filterTarget{ChannelID: "dev-1"})
+	assert.True(t, excluded)
+}
+
+func TestEvaluateRecordingFilter(t *testing.T) {
+	recDir := filepath.Join(t.TempDir(), "REC1")
+	require.NoError(t, os.MkdirAll(recDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "report-REC1.json"),
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.json"),
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1","connection_id":"A","filename":"archive-A.mp4"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.mp4"), []byte("media"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-B.json"),
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1","connection_id":"B","filename":"archive-B.webm"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-B.webm"), []byte("media"), 0644))
+
+	// 1 つでも除外するファイルがあれば録画全体を除外する
+	decision, err := evaluateRecordingFilter([]*FilterRule{
+		{Name: "webm", Action: FilterRuleActionExclude, MediaType: "webm"},
+	}, recDir)
+	require.NoError(t, err)
+	assert.True(t, decision.excluded)
+	assert.Equal(t, "webm", decision.filter)
+	assert.Equal(t, "REC1", decision.recordingID)
+	assert.Equal(t, "ch1", decision.channelID)
+
+	// メディアファイルの条件を含む include のフィルタで report ファイルだけを除外しない
+	decision, err = evaluateRecordingFilter([]*FilterRule{
+		{Name: "media", Action: FilterRuleActionInclude, MediaType: "mp4"},
+		{Name: "webm", Action: FilterRuleActionInclude, MediaType: "webm"},
+	}, recDir)
+	require.NoError(t, err)
+	assert.False(t, decision.excluded)
+	assert.Equal(t, "media", decision.filter)
+
+	// archive ファイルが残っていない場合は report ファイルで判定する
+	for _, f := range []string{"archive-A.json", "archive-A.mp4", "archive-B.json", "archive-B.webm"} {
+		require.NoError(t, os.Remove(filepath.Join(recDir, f)))
+	}
+	decision, err = evaluateRecordingFilter([]*FilterRule{
+		{Name: "ch1", Action: FilterRuleActionExclude, ChannelIDGlob: "ch*"},
+	}, recDir)
+	require.NoError(t, err)
+	assert.True(t, decision.excluded)
+}
+
+func TestExcludeFileKeepRecording(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zlog.Logger
+	zlog.Logger = newLogger(&buf).Level(zerolog.InfoLevel)
+	t.Cleanup(func() { zlog.Logger = logger })
+
+	recDir := filepath.Join(t.TempDir(), "REC1")
+	require.NoError(t, os.MkdirAll(recDir, 0755))
+	reportFile := filepath.Join(recDir, "report-REC1.json")
+	require.NoError(t, os.WriteFile(reportFile, []byte(`{"recording_id":"REC1","channel_id":"ch1"}`), 0644))
+	archiveFile := filepath.Join(recDir, "archive-A.json")
+	require.NoError(t, os.WriteFile(archiveFile,
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1","connection_id":"A","filename":"archive-A.webm"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.webm"), []byte("media"), 0644))
+
+	config := &Config{
+		FilterRules: []*FilterRule{
+			{Name: "webm", Action: FilterRuleActionExclude, MediaType: "webm"},
+		},
+		FilterExcludedAction: FilterExcludedActionKeep,
+	}
+	g := newGateKeeper(config)
+	g.processRun(recDir)
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+	u.recordingFilter = g.recordingFilter
+
+	// report ファイルにはメディアファイルの条件を適用できないが、録画単位で除外して退避しない
+	assert.True(t, u.excludeFile(context.Background(), archiveFile))
+	assert.True(t, u.excludeFile(context.Background(), reportFile))
+	assert.FileExists(t, filepath.Join(recDir, "archive-A.webm"))
+	assert.FileExists(t, reportFile)
+	assert.Equal(t, 1, strings.Count(buf.String(), "FILTER-EXCLUDED"))
+
+	// 次の実行で同じ判定になった場合は Info で出力しない
+	buf.Reset()
+	g = newGateKeeper(config)
+	g.processRun(recDir)
+	u.recordingFilter = g.recordingFilter
+	assert.True(t, u.excludeFile(context.Background(), archiveFile))
+	assert.NotContains(t, buf.String(), "FILTER-EXCLUDED")
+}
+
+func TestExcludeFileReportAfterDelete(t *testing.T) {
+	recDir := filepath.Join(t.TempDir(), "REC1")
+	require.NoError(t, os.MkdirAll(recDir, 0755))
+	archiveFile := filepath.Join(recDir, "archive-A.json")
+	require.NoError(t, os.WriteFile(archiveFile,
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1","connection_id":"A","filename":"archive-A.webm"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.webm"), []byte("media"), 0644))
+
+	config := &Config{
+		FilterRules: []*FilterRule{
+			{Name: "webm", Action: FilterRuleActionExclude, MediaType: "webm"},
+		},
+		FilterExcludedAction: FilterExcludedActionDelete,
+	}
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+	assert.True(t, u.excludeFile(context.Background(), archiveFile))
+	assert.NoFileExists(t, filepath.Join(recDir, "archive-A.webm"))
+	assert.FileExists(t, filepath.Join(recDir, filterExcludedFilename))
+
+	// メディアファイルを削除した後に書き出された report ファイルも、保存した判定結果で除外する
+	reportFile := filepath.Join(recDir, "report-REC1.json")
+	require.NoError(t, os.WriteFile(reportFile, []byte(`{"recording_id":"REC1","channel_id":"ch1"}`), 0644))
+	decision, err := evaluateRecordingFilter(config.FilterRules, recDir)
+	require.NoError(t, err)
+	assert.True(t, decision.excluded)
+	assert.Equal(t, "webm", decision.filter)
+	assert.True(t, u.excludeFile(context.Background(), reportFile))
+	assert.NoFileExists(t, reportFile)
+
+	// report ファイルまで除外した録画ディレクトリは判定結果と一緒に削除する
+	g := newGateKeeper(config)
+	g.processRun(recDir)
+	g.addProcessingCounter(1)
+	g.recordingExcluded(reportFile)
+	assert.NoDirExists(t, recDir)
+}
+
+func TestPruneFilterDecisions(t *testing.T) {
+	recDir := filepath.Join(t.TempDir(), "REC1")
+	require.NoError(t, os.MkdirAll(recDir, 0755))
+	missingDir := filepath.Join(t.TempDir(), "REC2")
+	loggedFilterDecisions.Store(recDir, "true:webm:keep")
+	loggedFilterDecisions.Store(missingDir, "true:webm:keep")
+	t.Cleanup(func() { forgetFilterDecision(recDir) })
+
+	pruneFilterDecisions()
+	_, ok := loggedFilterDecisions.Load(recDir)
+	assert.True(t, ok)
+	_, ok = loggedFilterDecisions.Load(missingDir)
+	assert.False(t, ok)
+
+	forgetFilterDecision(recDir)
+	_, ok = loggedFilterDecisions.Load(recDir)
+	assert.False(t, ok)
+}
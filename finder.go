@@ -9,79 +9,173 @@ import (
 	zlog "github.com/rs/zerolog/log"
 )
 
-func runFileFinder(archiveDir string) ([]string, error) {
+var replaceFilenamePattern = regexp.MustCompile(`.json$`)
+
+// 録画ファイルの種類
+const (
+	RecordingFileTypeArchive         = "archive"
+	RecordingFileTypeSplitArchive    = "split-archive"
+	RecordingFileTypeSplitArchiveEnd = "split-archive-end"
+	RecordingFileTypeReport          = "report"
+	RecordingFileTypeOther           = "other"
+)
+
+// ファイル名から録画ファイルの種類を返す
+// メディアファイルは対応する JSON ファイルと同じ種類になる
+func recordingFileType(filename string) string {
+	switch {
+	case strings.HasPrefix(filename, "report-"):
+		return RecordingFileTypeReport
+	case strings.HasPrefix(filename, "split-archive-end-"):
+		return RecordingFileTypeSplitArchiveEnd
+	case strings.HasPrefix(filename, "split-archive-"):
+		return RecordingFileTypeSplitArchive
+	case strings.HasPrefix(filename, "archive-"):
+		return RecordingFileTypeArchive
+	}
+	return RecordingFileTypeOther
+}
+
+// 設定されているすべてのアーカイブディレクトリから処理対象のファイルを探す
+func runFileFinder(config *Config) ([]string, error) {
 	var result []string
-	zlog.Debug().Str("archive-dir", archiveDir).Msg("START-SCRAPE-DIRECTORY")
-	files, err := os.ReadDir(archiveDir)
-	if err != nil {
-		zlog.Err(err).Msg("ERROR-RUN-FILE-FINDER")
-		return result, err
+	err := walkRecordingDirectories(config, func(dirPath string, entries []os.DirEntry) {
+		result = append(result, scanRecordingDirectory(dirPath, entries)...)
+	})
+	return result, err
+}
+
+// 録画ディレクトリとして扱うディレクトリごとに呼び出される
+type recordingDirVisitor func(dirPath string, entries []os.DirEntry)
+
+// 設定されているすべてのアーカイブディレクトリを探索して、録画ディレクトリごとに visit を呼び出す
+func walkRecordingDirectories(config *Config, visit recordingDirVisitor) error {
+	// 退避先や除外先、隔離先、ウェブフックの保存先、ロックファイルや失敗履歴の置き場所がアーカイブディレクトリ配下に指定されていても探索しないようにする
+	excludeDirs := make(map[string]struct{})
+	for _, root := range config.ArchiveRoots {
+		excludeDirs[filepath.Clean(root.EvacuateDirFullPath)] = struct{}{}
+	}
+	if config.FilterExcludedDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.FilterExcludedDirFullPath)] = struct{}{}
+	}
+	if config.QuarantineDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.QuarantineDirFullPath)] = struct{}{}
 	}
-	replaceFilenamePattern := regexp.MustCompile(`.json$`)
-	for _, f := range files {
+	if config.StuckRecordingQuarantineDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.StuckRecordingQuarantineDirFullPath)] = struct{}{}
+	}
+	if config.WebhookPayloadStoreDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.WebhookPayloadStoreDirFullPath)] = struct{}{}
+	}
+	if config.RecordingLockDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.RecordingLockDirFullPath)] = struct{}{}
+	}
+	if config.UploadAttemptsDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.UploadAttemptsDirFullPath)] = struct{}{}
+	}
+	if config.UploadFailedDirFullPath != "" {
+		excludeDirs[filepath.Clean(config.UploadFailedDirFullPath)] = struct{}{}
+	}
+	maxDepth := config.archiveDirMaxDepth()
+	for _, root := range config.ArchiveRoots {
+		archiveDir := root.ArchiveDirFullPath
+		zlog.Debug().
+			Str("archive-dir", archiveDir).
+			Int("max_depth", maxDepth).
+			Msg("START-SCRAPE-DIRECTORY")
+		files, err := os.ReadDir(archiveDir)
+		if err != nil {
+			zlog.Err(err).Str("archive-dir", archiveDir).Msg("ERROR-RUN-FILE-FINDER")
+			return err
+		}
+		walkDirectories(archiveDir, files, 1, maxDepth, excludeDirs, visit)
+		zlog.Debug().Str("archive-dir", archiveDir).Msg("END-SCRAPE-DIRECTORY")
+	}
+	return nil
+}
+
+// parentDir 直下のディレクトリを録画ディレクトリとして扱い、maxDepth に達するまで再帰的に探索する
+func walkDirectories(parentDir string, entries []os.DirEntry, depth, maxDepth int, excludeDirs map[string]struct{}, visit recordingDirVisitor) {
+	for _, f := range entries {
 		if !f.IsDir() {
 			continue
 		}
-		dirPath := filepath.Join(archiveDir, f.Name())
+		dirPath := filepath.Join(parentDir, f.Name())
+		if _, ok := excludeDirs[dirPath]; ok {
+			zlog.Debug().
+				Str("dir_path", dirPath).
+				Msg("IGNORE-EVACUATE-DIRECTORY")
+			continue
+		}
 		archiveFiles, err := os.ReadDir(dirPath)
 		if err != nil {
-			zlog.Err(err).Msg("ERROR-READ-DIRECTORY")
+			zlog.Err(err).Str("dir_path", dirPath).Msg("ERROR-READ-DIRECTORY")
 			continue
 		}
-		var reportFile *string
-		for _, archiveFile := range archiveFiles {
-			fullpath := filepath.Join(dirPath, archiveFile.Name())
-			filename := archiveFile.Name()
-			if !(strings.HasSuffix(filename, ".json")) {
-				zlog.Debug().
-					Str("file_path", fullpath).
-					Msg("IGNORE-FILE-TYPE")
-				continue
-			}
-			// 以下の処理は .json ファイルであることが保証される
-			if strings.HasPrefix(filename, "report-") {
+		visit(dirPath, archiveFiles)
+		if depth < maxDepth {
+			walkDirectories(dirPath, archiveFiles, depth+1, maxDepth, excludeDirs, visit)
+		}
+	}
+}
+
+func scanRecordingDirectory(dirPath string, archiveFiles []os.DirEntry) []string {
+	var result []string
+	var reportFile *string
+	for _, archiveFile := range archiveFiles {
+		fullpath := filepath.Join(dirPath, archiveFile.Name())
+		filename := archiveFile.Name()
+		if archiveFile.IsDir() {
+			continue
+		}
+		if !(strings.HasSuffix(filename, ".json")) {
+			zlog.Debug().
+				Str("file_path", fullpath).
+				Msg("IGNORE-FILE-TYPE")
+			continue
+		}
+		// 以下の処理は .json ファイルであることが保証される
+		if strings.HasPrefix(filename, "report-") {
+			zlog.Debug().
+				Str("file_path", fullpath).
+				Msg("FOUND-AT-FINDER")
+			reportFile = &fullpath
+		} else if strings.HasPrefix(filename, "split-archive-end-") {
+			zlog.Debug().
+				Str("file_path", fullpath).
+				Msg("FOUND-AT-FINDER")
+			result = append(result, fullpath)
+		} else if strings.HasPrefix(filename, "archive-") || strings.HasPrefix(filename, "split-archive-") {
+			// webm または mp4 ファイルの存在を確認し、ファイルが存在したら後続の処理にファイルパスを渡す
+			// webm または mp4 ファイルが存在しない場合は、次回のスクレイピングのタイミングで処理する
+			webmFilename := replaceFilenamePattern.ReplaceAllString(filename, ".webm")
+			webmFullpath := filepath.Join(dirPath, webmFilename)
+			if info, err := os.Stat(webmFullpath); err == nil && !info.IsDir() {
 				zlog.Debug().
 					Str("file_path", fullpath).
+					Str("media_file_path", webmFullpath).
 					Msg("FOUND-AT-FINDER")
-				reportFile = &fullpath
-			} else if strings.HasPrefix(filename, "split-archive-end-") {
+				result = append(result, fullpath)
+			}
+			// .mp4 でも同様に確認する
+			mp4FileName := replaceFilenamePattern.ReplaceAllString(filename, ".mp4")
+			mp4Fullpath := filepath.Join(dirPath, mp4FileName)
+			if info, err := os.Stat(mp4Fullpath); err == nil && !info.IsDir() {
 				zlog.Debug().
 					Str("file_path", fullpath).
+					Str("media_file_path", mp4Fullpath).
 					Msg("FOUND-AT-FINDER")
 				result = append(result, fullpath)
-			} else if strings.HasPrefix(filename, "archive-") || strings.HasPrefix(filename, "split-archive-") {
-				// webm または mp4 ファイルの存在を確認し、ファイルが存在したら後続の処理にファイルパスを渡す
-				// webm または mp4 ファイルが存在しない場合は、次回のスクレイピングのタイミングで処理する
-				webmFilename := replaceFilenamePattern.ReplaceAllString(filename, ".webm")
-				webmFullpath := filepath.Join(dirPath, webmFilename)
-				if info, err := os.Stat(webmFullpath); err == nil && !info.IsDir() {
-					zlog.Debug().
-						Str("file_path", fullpath).
-						Str("media_file_path", webmFullpath).
-						Msg("FOUND-AT-FINDER")
-					result = append(result, fullpath)
-				}
-				// .mp4 でも同様に確認する
-				mp4FileName := replaceFilenamePattern.ReplaceAllString(filename, ".mp4")
-				mp4Fullpath := filepath.Join(dirPath, mp4FileName)
-				if info, err := os.Stat(mp4Fullpath); err == nil && !info.IsDir() {
-					zlog.Debug().
-						Str("file_path", fullpath).
-						Str("media_file_path", mp4Fullpath).
-						Msg("FOUND-AT-FINDER")
-					result = append(result, fullpath)
-				}
-			} else {
-				zlog.Debug().
-					Str("file_path", fullpath).
-					Msg("IGNORE-FILE")
 			}
+		} else {
+			zlog.Debug().
+				Str("file_path", fullpath).
+				Msg("IGNORE-FILE")
 		}
-		// ディレクトリ内に report json ファイルが見つかった場合は、最後に流す
-		if reportFile != nil {
-			result = append(result, *reportFile)
-		}
 	}
-	zlog.Debug().Str("archive-dir", archiveDir).Msg("END-SCRAPE-DIRECTORY")
-	return result, nil
+	// ディレクトリ内に report json ファイルが見つかった場合は、最後に流す
+	if reportFile != nil {
+		result = append(result, *reportFile)
+	}
+	return result
 }
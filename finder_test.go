@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestFile(t *testing.T, path string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+}
+
+func TestRunFileFinder(t *testing.T) {
+	root1 := t.TempDir()
+	root2 := t.TempDir()
+
+	writeTestFile(t, filepath.Join(root1, "REC1", "archive-A.json"))
+	writeTestFile(t, filepath.Join(root1, "REC1", "archive-A.webm"))
+	writeTestFile(t, filepath.Join(root1, "REC1", "report-REC1.json"))
+	// メディアファイルが存在しない場合は対象外
+	writeTestFile(t, filepath.Join(root1, "REC2", "archive-B.json"))
+	// 日付ごとに階層化されたディレクトリ
+	writeTestFile(t, filepath.Join(root2, "2025", "01", "REC3", "split-archive-C.json"))
+	writeTestFile(t, filepath.Join(root2, "2025", "01", "REC3", "split-archive-C.mp4"))
+	writeTestFile(t, filepath.Join(root2, "2025", "01", "REC3", "split-archive-end-C.json"))
+	// 退避ディレクトリは探索しない
+	writeTestFile(t, filepath.Join(root2, "evacuate", "REC4", "report-REC4.json"))
+
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{Name: "default", ArchiveDirFullPath: root1, EvacuateDirFullPath: filepath.Join(root1, "..", "evacuate")},
+			{Name: "nested", ArchiveDirFullPath: root2, EvacuateDirFullPath: filepath.Join(root2, "evacuate")},
+		},
+	}
+
+	files, err := runFileFinder(config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root1, "REC1", "archive-A.json"),
+		filepath.Join(root1, "REC1", "report-REC1.json"),
+	}, files)
+
+	config.ArchiveDirMaxDepth = 3
+	files, err = runFileFinder(config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(root1, "REC1", "archive-A.json"),
+		filepath.Join(root1, "REC1", "report-REC1.json"),
+		filepath.Join(root2, "2025", "01", "REC3", "split-archive-C.json"),
+		filepath.Join(root2, "2025", "01", "REC3", "split-archive-end-C.json"),
+	}, files)
+}
+
+func TestConfigObjectKey(t *testing.T) {
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: "/var/sora/archive"},
+			{ArchiveDirFullPath: "/var/sora2/archive", ObjectKeyPrefix: "/sora2/"},
+		},
+	}
+	assert.Equal(t, "REC1/report-REC1.json",
+		config.objectKey("/var/sora/archive/REC1/report-REC1.json", "REC1", "report-REC1.json"))
+	assert.Equal(t, "sora2/REC2/report-REC2.json",
+		config.objectKey("/var/sora2/archive/2025/REC2/report-REC2.json", "REC2", "report-REC2.json"))
+}
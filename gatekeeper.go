@@ -2,13 +2,18 @@ package archive
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	zlog "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type RecordingUnit struct {
@@ -16,12 +21,52 @@ type RecordingUnit struct {
 	recordingID string
 	counter     int32
 	reportFile  string
+	// 録画単位のスパン
+	ctx  context.Context
+	span trace.Span
+	// 退避または削除まで終わった
+	finished atomic.Bool
+	// 処理に失敗したファイルがある
+	failed atomic.Bool
+	// 録画単位のフィルタの判定結果
+	filterOnce     sync.Once
+	filterDecision *filterDecision
+	filterErr      error
 }
 
-func newRecordingUnit(recordingID string) *RecordingUnit {
+type RecordingState struct {
+	Dir         string `json:"dir"`
+	RecordingID string `json:"recording_id"`
+	// 処理待ちまたは処理中の report 以外のファイル数
+	PendingFiles int32 `json:"pending_files"`
+	// 他のファイルの処理が終わるのを待っている report ファイル
+	WaitingReportFile string `json:"waiting_report_file,omitempty"`
+	Finished          bool   `json:"finished"`
+}
+
+func (ru *RecordingUnit) state(recordingDir string) *RecordingState {
+	ru.mutex.RLock()
+	defer ru.mutex.RUnlock()
+	return &RecordingState{
+		Dir:               recordingDir,
+		RecordingID:       ru.recordingID,
+		PendingFiles:      atomic.LoadInt32(&ru.counter),
+		WaitingReportFile: ru.reportFile,
+		Finished:          ru.finished.Load(),
+	}
+}
+
+func newRecordingUnit(recordingDir string) *RecordingUnit {
+	recordingID := filepath.Base(recordingDir)
+	ctx, span := tracer.Start(context.Background(), "recording", trace.WithAttributes(
+		attribute.String("recording.id", recordingID),
+		attribute.String("recording.dir", recordingDir),
+	))
 	return &RecordingUnit{
 		recordingID: recordingID,
 		counter:     0,
+		ctx:         ctx,
+		span:        span,
 	}
 }
 
@@ -69,6 +114,11 @@ type GateKeeper struct {
 	processingList    sync.Map
 	processingCounter int64
 	out               chan string
+	// 処理に失敗したファイルがあるため処理しない report ファイル
+	skippedReports chan string
+	// 処理が終わったファイル数と、そのうち失敗したファイル数
+	completedFiles atomic.Int64
+	failedFiles    atomic.Int64
 }
 
 func newGateKeeper(config *Config) *GateKeeper {
@@ -76,11 +126,17 @@ func newGateKeeper(config *Config) *GateKeeper {
 		config:         config,
 		processingList: sync.Map{},
 		out:            make(chan string, 50),
+		skippedReports: make(chan string),
 	}
 	return g
 }
 
 func (g *GateKeeper) stop() {
+	// 中断された録画のスパンを終了する
+	g.processingList.Range(func(_, v any) bool {
+		v.(*RecordingUnit).span.End()
+		return true
+	})
 	close(g.out)
 	zlog.Debug().Msg("STOPPED-GATE-KEEPER")
 }
@@ -92,13 +148,16 @@ func (g *GateKeeper) run(ctx context.Context, infiles []string) <-chan string {
 
 		processArchiveFile := func(infile string) {
 			filename := filepath.Base(infile)
-			recordingID := filepath.Base(filepath.Dir(infile))
-			atomic.AddInt64(&g.processingCounter, 1)
+			// 複数のアーカイブディレクトリで録画 ID が重複しても区別できるように、ディレクトリのパスで管理する
+			recordingDir := filepath.Dir(infile)
+			g.addProcessingCounter(1)
 			if strings.HasPrefix(filename, "report-") {
 				g.mutex.Lock()
-				ru, ok := g.getRecordingUnit(recordingID)
+				ru, ok := g.getRecordingUnit(recordingDir)
 				if !ok {
 					// report-* の前に他のファイルが処理されてない
+					// トレースのために録画単位だけ登録しておく
+					g.processingList.Store(recordingDir, newRecordingUnit(recordingDir))
 					g.mutex.Unlock()
 					go func() {
 						select {
@@ -111,6 +170,16 @@ func (g *GateKeeper) run(ctx context.Context, infiles []string) <-chan string {
 				g.mutex.Unlock()
 
 				if ru.canProcessAndSetReportFile(infile) {
+					if ru.failed.Load() {
+						// 処理が終わったことを確認できるように、メインループで処理する
+						go func() {
+							select {
+							case <-g.ctx.Done():
+							case g.skippedReports <- infile:
+							}
+						}()
+						return
+					}
 					go func() {
 						select {
 						case <-g.ctx.Done():
@@ -122,7 +191,7 @@ func (g *GateKeeper) run(ctx context.Context, infiles []string) <-chan string {
 				return
 			}
 			if strings.HasPrefix(filename, "split-archive-end-") {
-				g.processRun(recordingID)
+				g.processRun(recordingDir)
 				select {
 				case <-g.ctx.Done():
 				case g.out <- infile:
@@ -131,7 +200,7 @@ func (g *GateKeeper) run(ctx context.Context, infiles []string) <-chan string {
 			}
 			if strings.HasPrefix(filename, "archive-") || strings.HasPrefix(filename, "split-archive-") {
 				archiveID := strings.Split(filename, ".")[0]
-				g.processRun(recordingID)
+				g.processRun(recordingDir)
 				select {
 				case <-g.ctx.Done():
 					return
@@ -150,8 +219,8 @@ func (g *GateKeeper) run(ctx context.Context, infiles []string) <-chan string {
 	return g.out
 }
 
-func (g *GateKeeper) getRecordingUnit(recordingID string) (*RecordingUnit, bool) {
-	ru, ok := g.processingList.Load(recordingID)
+func (g *GateKeeper) getRecordingUnit(recordingDir string) (*RecordingUnit, bool) {
+	ru, ok := g.processingList.Load(recordingDir)
 	if ok {
 		return ru.(*RecordingUnit), ok
 	} else {
@@ -159,31 +228,90 @@ func (g *GateKeeper) getRecordingUnit(recordingID string) (*RecordingUnit, bool)
 	}
 }
 
-func (g *GateKeeper) processRun(recordingID string) {
+func (g *GateKeeper) processRun(recordingDir string) {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
-	ru, ok := g.getRecordingUnit(recordingID)
+	ru, ok := g.getRecordingUnit(recordingDir)
 	if !ok {
-		ru = newRecordingUnit(recordingID)
-		g.processingList.Store(recordingID, ru)
+		ru = newRecordingUnit(recordingDir)
+		g.processingList.Store(recordingDir, ru)
 	}
 	ru.run()
 }
 
-func (g *GateKeeper) processDone(infile string) {
+// ファイルが属する録画のトレースコンテキストを返す
+func (g *GateKeeper) traceContext(infile string) context.Context {
+	if ru, ok := g.getRecordingUnit(filepath.Dir(infile)); ok {
+		return ru.ctx
+	}
+	return context.Background()
+}
+
+// ファイルが属する録画のフィルタの判定結果を返す
+// 最初のファイルを処理する前に録画ごとに 1 回だけ評価し、同じ録画のファイルには同じ判定を使う
+func (g *GateKeeper) recordingFilter(ctx context.Context, infile string) (*filterDecision, error) {
+	recordingDir := filepath.Dir(infile)
+	ru, ok := g.getRecordingUnit(recordingDir)
+	if !ok {
+		return decideRecordingFilter(ctx, g.config, recordingDir)
+	}
+	ru.filterOnce.Do(func() {
+		ru.filterDecision, ru.filterErr = decideRecordingFilter(ctx, g.config, recordingDir)
+	})
+	return ru.filterDecision, ru.filterErr
+}
+
+// 録画の処理を終了し、スパンを終了する
+func (g *GateKeeper) finishRecordingUnit(infile string, attrs ...attribute.KeyValue) {
+	if ru, ok := g.getRecordingUnit(filepath.Dir(infile)); ok {
+		ru.finished.Store(true)
+		ru.span.SetAttributes(attrs...)
+		ru.span.End()
+	}
+}
+
+func (g *GateKeeper) recordingStates() []*RecordingState {
+	var result []*RecordingState
+	g.processingList.Range(func(k, v any) bool {
+		result = append(result, v.(*RecordingUnit).state(k.(string)))
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Dir < result[j].Dir
+	})
+	return result
+}
+
+// アップローダーの処理結果を数える
+func (g *GateKeeper) countResult(result UploaderResult) {
+	g.completedFiles.Add(1)
+	if !result.Success {
+		g.failedFiles.Add(1)
+		runSummary.fileFailed()
+	}
+}
+
+func (g *GateKeeper) processDone(infile string, success bool) {
 	g.mutex.Lock()
 	defer g.mutex.Unlock()
 	zlog.Debug().Str("infile", infile).Msg("PROCESS-DONE")
 
-	recordingID := filepath.Base(filepath.Dir(infile))
-	ru, ok := g.getRecordingUnit(recordingID)
+	ru, ok := g.getRecordingUnit(filepath.Dir(infile))
 	if !ok {
-		atomic.AddInt64(&g.processingCounter, -1)
+		g.addProcessingCounter(-1)
 		zlog.Error().Str("infile", infile).Msg("WAIT-GROUP-NOT-FOUND")
 		return
 	}
+	if !success {
+		ru.failed.Store(true)
+	}
 	ru.done()
 	if reportFile, ok := ru.canProcessAndGetReportFile(); ok {
+		if ru.failed.Load() {
+			g.skipReport(*reportFile)
+			g.addProcessingCounter(-1)
+			return
+		}
 		go func() {
 			select {
 			case <-g.ctx.Done():
@@ -191,19 +319,53 @@ func (g *GateKeeper) processDone(infile string) {
 			}
 		}()
 	}
-	atomic.AddInt64(&g.processingCounter, -1)
+	g.addProcessingCounter(-1)
+}
+
+// 処理に失敗したファイルがある録画は report を処理せずに残し、次回の探索で失敗したファイルと一緒に処理する
+// report を処理すると、失敗したファイルが残ったまま録画ディレクトリを退避してしまう
+func (g *GateKeeper) skipReport(reportFile string) {
+	zlog.Warn().
+		Str("report_file", reportFile).
+		Msg("SKIPPED-REPORT-AFTER-FAILURE")
+	g.finishRecordingUnit(reportFile, attribute.Bool("recording.failed", true))
+	g.addProcessingCounter(-1)
 }
 
 func (g *GateKeeper) recordingDone(infile string) {
 	zlog.Debug().Str("infile", infile).Msg("RECORDING-DONE")
 
-	// Recording ID のディレクトリを削除するべきだが、いきなり削除せず、mv で監視対象外のパスに移動しておく
 	dirname := filepath.Dir(infile)
-	newDirPath := filepath.Join(g.config.SoraEvacuateDirFullPath, filepath.Base(dirname))
-	var evacuatePath = g.config.SoraEvacuateDirFullPath
-	_, err := os.Stat(g.config.SoraEvacuateDirFullPath)
+	forgetFilterDecision(dirname)
+	// 設定されていれば、アップロードしたファイルを削除して空になったディレクトリは退避せずに削除する
+	if g.config.RemoveEmptyRecordingDirectory && removeEmptyRecordingDirectory(dirname) {
+		runSummary.recordingRemoved()
+		g.finishRecordingUnit(infile, attribute.Bool("recording.removed", true))
+		g.addProcessingCounter(-1)
+		return
+	}
+	// Recording ID のディレクトリを削除するべきだが、いきなり削除せず、mv で監視対象外のパスに移動しておく
+	if err := evacuateRecordingDirectory(g.config, dirname); err == nil {
+		runSummary.recordingEvacuated()
+	}
+	g.finishRecordingUnit(infile, attribute.Bool("recording.evacuated", true))
+	g.addProcessingCounter(-1)
+}
+
+// 録画ディレクトリをアーカイブディレクトリからの相対パスを維持して退避先に移動する
+func evacuateRecordingDirectory(config *Config, dirname string) error {
+	root := config.archiveRootOf(dirname)
+	if root == nil {
+		zlog.Error().
+			Str("path", dirname).
+			Msg("ARCHIVE-ROOT-NOT-FOUND")
+		return fmt.Errorf("archive root not found: %s", dirname)
+	}
+	newDirPath := config.relocatedPath(dirname, root.EvacuateDirFullPath)
+	var evacuatePath = filepath.Dir(newDirPath)
+	_, err := os.Stat(evacuatePath)
 	if err != nil {
-		err = os.Mkdir(evacuatePath, 0755)
+		err = os.MkdirAll(evacuatePath, 0755)
 		if err != nil {
 			zlog.Error().
 				Str("evacuate_dir_path", evacuatePath).
@@ -225,9 +387,77 @@ func (g *GateKeeper) recordingDone(infile string) {
 			Str("new_path", newDirPath).
 			Msg("RECORDING-DIRECTORY-MOVE-SUCCESSFULLY")
 	}
-	atomic.AddInt64(&g.processingCounter, -1)
+	return err
+}
+
+func (g *GateKeeper) recordingExcluded(infile string) {
+	zlog.Debug().Str("infile", infile).Msg("RECORDING-EXCLUDED")
+
+	// 除外したファイルを移動または削除した場合は、空になった録画ディレクトリを削除する
+	// keep の場合や、ファイルが残っている場合は削除に失敗するため、そのまま残る
+	if g.config.filterExcludedAction() != FilterExcludedActionKeep {
+		dirname := filepath.Dir(infile)
+		// report ファイルまで除外したため、保存した判定結果は不要になる
+		if err := os.Remove(filepath.Join(dirname, filterExcludedFilename)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			zlog.Error().
+				Err(err).
+				Str("path", dirname).
+				Msg("FAILED-REMOVE-FILTER-EXCLUDED")
+		}
+		if err := os.Remove(dirname); err == nil {
+			zlog.Debug().
+				Str("path", dirname).
+				Msg("REMOVED-EMPTY-RECORDING-DIRECTORY")
+		}
+		forgetFilterDecision(dirname)
+	}
+	g.finishRecordingUnit(infile, attribute.Bool("recording.excluded", true))
+	g.addProcessingCounter(-1)
+}
+
+func (g *GateKeeper) addProcessingCounter(delta int64) {
+	counter := atomic.AddInt64(&g.processingCounter, delta)
+	gateKeeperProcessingFiles.Set(float64(counter))
 }
 
 func (g *GateKeeper) isFileUploadFinished() bool {
 	return atomic.LoadInt64(&g.processingCounter) == 0
 }
+
+// 退避ディレクトリの録画ディレクトリを元のアーカイブディレクトリに戻す
+// target には録画 ID か退避ディレクトリからの相対パスを指定する
+func restoreEvacuatedRecordings(config *Config, target string) (int, error) {
+	target = filepath.Clean(target)
+	var restored int
+	for _, root := range config.ArchiveRoots {
+		recordings, err := collectEvacuatedRecordings(root.EvacuateDirFullPath, config.archiveDirMaxDepth())
+		if err != nil {
+			return restored, err
+		}
+		for _, r := range recordings {
+			relPath, err := filepath.Rel(root.EvacuateDirFullPath, r.path)
+			if err != nil {
+				continue
+			}
+			if target != filepath.Base(r.path) && target != relPath {
+				continue
+			}
+			newDirPath := filepath.Join(root.ArchiveDirFullPath, relPath)
+			if _, err := os.Stat(newDirPath); err == nil {
+				return restored, fmt.Errorf("recording directory already exists: %s", newDirPath)
+			}
+			if err := os.MkdirAll(filepath.Dir(newDirPath), 0755); err != nil {
+				return restored, err
+			}
+			if err := os.Rename(r.path, newDirPath); err != nil {
+				return restored, err
+			}
+			zlog.Info().
+				Str("old_path", r.path).
+				Str("new_path", newDirPath).
+				Msg("RESTORED-EVACUATED-RECORDING")
+			restored++
+		}
+	}
+	return restored, nil
+}
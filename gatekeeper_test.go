@@ -0,0 +1,36 @@
+package archive
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateKeeperSkipsReportAfterFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	archiveFile := filepath.Join(dir, "REC1", "archive-A.json")
+	reportFile := filepath.Join(dir, "REC1", "report-B.json")
+	g := newGateKeeper(&Config{})
+	out := g.run(ctx, []string{archiveFile, reportFile})
+
+	assert.Equal(t, archiveFile, <-out)
+	g.processDone(archiveFile, false)
+
+	// 失敗したファイルが残ったまま録画ディレクトリを退避しないように、report は処理しない
+	select {
+	case f := <-out:
+		t.Fatalf("unexpected file: %s", f)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, g.isFileUploadFinished())
+	states := g.recordingStates()
+	if assert.Len(t, states, 1) {
+		assert.True(t, states[0].Finished)
+	}
+}
@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// ロックを取得できなかった場合の動作
+const (
+	// すぐに終了する
+	LockModeExit = "exit"
+	// ロックが解放されるまで待つ
+	LockModeWait = "wait"
+)
+
+// 他のプロセスがロックを保持している
+var errLockHeld = errors.New("lock is held by another process")
+
+// flock による排他ロック
+type fileLock struct {
+	f *os.File
+}
+
+// ファイルの排他ロックを取得する
+// wait が false の場合、他のプロセスがロックを保持していれば errLockHeld を返す
+func acquireFileLock(lockFilePath string, wait bool) (*fileLock, error) {
+	f, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), how)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, errLockHeld
+		}
+		return nil, err
+	}
+	// 調査用にロックを保持しているプロセスの PID を書き込む
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &fileLock{f: f}, nil
+}
+
+// ロックを解放する、ロックファイルは削除しない
+// 削除すると、解放を待っているプロセスと新しく起動したプロセスが別のファイルをロックしてしまう
+func (l *fileLock) release() {
+	unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+	l.f.Close()
+}
+
+func (c Config) lockMode() string {
+	if c.LockMode == "" {
+		return LockModeExit
+	}
+	return c.LockMode
+}
+
+// lock_file_path のロックを取得する、設定されていない場合は nil を返す
+// 他のプロセスが実行中で lock_mode が exit の場合は errLockHeld を返す
+func acquireInstanceLock(config *Config) (*fileLock, error) {
+	if config.LockFilePath == "" {
+		return nil, nil
+	}
+	wait := config.lockMode() == LockModeWait
+	lock, err := acquireFileLock(config.LockFilePath, false)
+	if errors.Is(err, errLockHeld) && wait {
+		zlog.Info().
+			Str("lock_file_path", config.LockFilePath).
+			Msg("WAITING-FOR-INSTANCE-LOCK")
+		lock, err = acquireFileLock(config.LockFilePath, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	zlog.Debug().
+		Str("lock_file_path", config.LockFilePath).
+		Msg("ACQUIRED-INSTANCE-LOCK")
+	return lock, nil
+}
+
+// 録画ディレクトリごとのロック
+// 共有ストレージ上のアーカイブディレクトリを複数のプロセスで分担して処理するために使う
+type recordingLocks struct {
+	mutex sync.Mutex
+	locks map[string]*fileLock
+}
+
+func newRecordingLocks() *recordingLocks {
+	return &recordingLocks{
+		locks: make(map[string]*fileLock),
+	}
+}
+
+// 録画ディレクトリのロックファイルのパスを返す
+// 共有ストレージのマウント先がプロセスごとに異なっても同じロックファイルになるように、アーカイブディレクトリからの相対パスを使う
+func recordingLockFilePath(config *Config, recordingDir string) string {
+	return filepath.Join(config.RecordingLockDirFullPath, config.recordingName(recordingDir)+".lock")
+}
+
+// 録画ディレクトリのロックを待たずに取得する
+// 他のプロセスが処理中の場合は false を返す
+func (l *recordingLocks) tryLock(config *Config, recordingDir string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.locks[recordingDir]; ok {
+		return true
+	}
+	lockFilePath := recordingLockFilePath(config, recordingDir)
+	if err := os.MkdirAll(filepath.Dir(lockFilePath), 0755); err != nil {
+		zlog.Error().Err(err).Str("lock_file_path", lockFilePath).Msg("FAILED-CREATE-RECORDING-LOCK")
+		return false
+	}
+	lock, err := acquireFileLock(lockFilePath, false)
+	if err != nil {
+		if !errors.Is(err, errLockHeld) {
+			zlog.Error().Err(err).Str("lock_file_path", lockFilePath).Msg("FAILED-ACQUIRE-RECORDING-LOCK")
+		}
+		return false
+	}
+	l.locks[recordingDir] = lock
+	return true
+}
+
+func (l *recordingLocks) releaseAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for dir, lock := range l.locks {
+		lock.release()
+		delete(l.locks, dir)
+	}
+}
+
+// 他のプロセスが録画ディレクトリのロックを保持しているかを返す
+// ロックファイルの作成や PID の書き込みは行わない
+func recordingLockHeld(config *Config, recordingDir string) bool {
+	f, err := os.Open(recordingLockFilePath(config, recordingDir))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		return errors.Is(err, unix.EWOULDBLOCK)
+	}
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	return false
+}
+
+// ロックを取得できた録画ディレクトリのファイルだけを返す
+// ロックを取得するまでの間に他のプロセスが処理したファイルは除く
+func (l *recordingLocks) filterLockedFiles(config *Config, files []string) []string {
+	var result []string
+	for _, f := range files {
+		recordingDir := filepath.Dir(f)
+		if !l.tryLock(config, recordingDir) {
+			zlog.Debug().
+				Str("path", f).
+				Msg("RECORDING-LOCKED-BY-ANOTHER-PROCESS")
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
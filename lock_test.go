@@ -0,0 +1,86 @@
+package archive
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireFileLock(t *testing.T) {
+	lockFilePath := filepath.Join(t.TempDir(), "uploader.lock")
+	lock, err := acquireFileLock(lockFilePath, false)
+	require.NoError(t, err)
+
+	_, err = acquireFileLock(lockFilePath, false)
+	assert.ErrorIs(t, err, errLockHeld)
+
+	lock.release()
+	lock, err = acquireFileLock(lockFilePath, false)
+	require.NoError(t, err)
+	lock.release()
+}
+
+func TestAcquireInstanceLockWait(t *testing.T) {
+	config := &Config{
+		LockFilePath: filepath.Join(t.TempDir(), "uploader.lock"),
+		LockMode:     LockModeWait,
+	}
+	held, err := acquireFileLock(config.LockFilePath, false)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.release()
+	}()
+
+	start := time.Now()
+	lock, err := acquireInstanceLock(config)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	lock.release()
+
+	// exit の場合は待たない
+	config.LockMode = LockModeExit
+	held, err = acquireFileLock(config.LockFilePath, false)
+	require.NoError(t, err)
+	defer held.release()
+	_, err = acquireInstanceLock(config)
+	assert.ErrorIs(t, err, errLockHeld)
+
+	lock, err = acquireInstanceLock(&Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, lock)
+}
+
+func TestRecordingLocks(t *testing.T) {
+	root := t.TempDir()
+	archiveDir := filepath.Join(root, "archive")
+	writeTestFile(t, filepath.Join(archiveDir, "2025", "REC1", "archive-A.json"))
+	writeTestFile(t, filepath.Join(archiveDir, "2025", "REC2", "archive-B.json"))
+	config := &Config{
+		RecordingLockDirFullPath: filepath.Join(root, "lock"),
+		ArchiveRoots: []*ArchiveRoot{
+			{Name: "default", ArchiveDirFullPath: archiveDir},
+		},
+	}
+	assert.Equal(t, filepath.Join(root, "lock", "default", "2025", "REC1.lock"), recordingLockFilePath(config, filepath.Join(archiveDir, "2025", "REC1")))
+
+	// 他のプロセスが REC1 を処理中
+	other := newRecordingLocks()
+	require.True(t, other.tryLock(config, filepath.Join(archiveDir, "2025", "REC1")))
+
+	locks := newRecordingLocks()
+	files := locks.filterLockedFiles(config, []string{
+		filepath.Join(archiveDir, "2025", "REC1", "archive-A.json"),
+		filepath.Join(archiveDir, "2025", "REC2", "archive-B.json"),
+		// ロックを取得するまでの間に処理されたファイル
+		filepath.Join(archiveDir, "2025", "REC2", "archive-C.json"),
+	})
+	assert.Equal(t, []string{filepath.Join(archiveDir, "2025", "REC2", "archive-B.json")}, files)
+
+	other.releaseAll()
+	assert.True(t, locks.tryLock(config, filepath.Join(archiveDir, "2025", "REC1")))
+	locks.releaseAll()
+}
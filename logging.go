@@ -1,7 +1,9 @@
 package archive
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,6 +14,19 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// ログのイベント名とフィールドの定義のバージョン
+// LOG_EVENTS.md のイベント名やフィールドを変更した場合は上げる
+const LogSchemaVersion = 1
+
+func init() {
+	// ファイルの処理のコンテキストの外ではグローバルのロガーを使う
+	zerolog.DefaultContextLogger = &log.Logger
+}
+
+func newLogger(writer io.Writer) zerolog.Logger {
+	return zerolog.New(writer).With().Caller().Timestamp().Int("log_schema_version", LogSchemaVersion).Logger()
+}
+
 func initLogger(config *Config) error {
 	if f, err := os.Stat(config.LogDir); os.IsNotExist(err) || !f.IsDir() {
 		return err
@@ -26,11 +41,7 @@ func initLogger(config *Config) error {
 
 	zerolog.TimeFieldFormat = "2006-01-02T15:04:05.000000Z"
 
-	if config.Debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	setLogLevel(config)
 
 	if config.Debug && config.LogStdout {
 		writer := zerolog.ConsoleWriter{
@@ -43,10 +54,10 @@ func initLogger(config *Config) error {
 			NoColor: false,
 		}
 		prettyFormat(&writer)
-		log.Logger = zerolog.New(writer).With().Caller().Timestamp().Logger()
+		log.Logger = newLogger(writer)
 	} else if config.LogStdout {
 		writer := os.Stdout
-		log.Logger = zerolog.New(writer).With().Caller().Timestamp().Logger()
+		log.Logger = newLogger(writer)
 	} else {
 		var logRotateMaxSize, logRotateMaxBackups, logRotateMaxAge int
 		if config.LogRotateMaxSize == 0 {
@@ -66,7 +77,7 @@ func initLogger(config *Config) error {
 			MaxAge:     logRotateMaxAge,
 			Compress:   false,
 		}
-		log.Logger = zerolog.New(writer).With().Caller().Timestamp().Logger()
+		log.Logger = newLogger(writer)
 	}
 
 	return nil
@@ -120,3 +131,35 @@ func prettyFormat(w *zerolog.ConsoleWriter) {
 		return fmt.Sprintf("%s", i)
 	}
 }
+
+// debug の設定に合わせてログレベルを切り替える
+func setLogLevel(config *Config) {
+	if config.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
+// ファイルの処理中のログに共通で出力するフィールドを設定したロガーをコンテキストに追加する
+// 録画 ID は録画ディレクトリの名前から取得する
+func (u Uploader) contextWithFileLogger(ctx context.Context, inputFilepath, attemptID string) context.Context {
+	logger := log.With().
+		Int("uploader_id", u.id).
+		Str("attempt_id", attemptID).
+		Str("recording_id", filepath.Base(filepath.Dir(inputFilepath))).
+		Str("file_type", recordingFileType(filepath.Base(inputFilepath))).
+		Str("file_path", inputFilepath).
+		Logger()
+	return logger.WithContext(ctx)
+}
+
+// json ファイルから取得したチャネル ID と接続 ID をログのコンテキストに追加する
+func contextWithRecordingLogger(ctx context.Context, channelID, connectionID string) context.Context {
+	logContext := zerolog.Ctx(ctx).With().Str("channel_id", channelID)
+	if connectionID != "" {
+		logContext = logContext.Str("connection_id", connectionID)
+	}
+	logger := logContext.Logger()
+	return logger.WithContext(ctx)
+}
@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := zlog.Logger
+	zlog.Logger = newLogger(&buf)
+	t.Cleanup(func() { zlog.Logger = logger })
+
+	u, err := newUploader(2, &Config{})
+	require.NoError(t, err)
+	jsonFilePath := filepath.Join(t.TempDir(), "REC1", "archive-A.json")
+	ctx := u.contextWithFileLogger(context.Background(), jsonFilePath, "ATTEMPT1")
+	ctx = contextWithRecordingLogger(ctx, "CH1", "CONN1")
+	zerolog.Ctx(ctx).Info().Msg("TEST-EVENT")
+
+	var event map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, "TEST-EVENT", event["message"])
+	assert.Equal(t, float64(LogSchemaVersion), event["log_schema_version"])
+	assert.Equal(t, float64(2), event["uploader_id"])
+	assert.Equal(t, "ATTEMPT1", event["attempt_id"])
+	assert.Equal(t, "REC1", event["recording_id"])
+	assert.Equal(t, RecordingFileTypeArchive, event["file_type"])
+	assert.Equal(t, jsonFilePath, event["file_path"])
+	assert.Equal(t, "CH1", event["channel_id"])
+	assert.Equal(t, "CONN1", event["connection_id"])
+
+	// ファイルの処理のコンテキストの外ではグローバルのロガーを使う
+	buf.Reset()
+	zerolog.Ctx(context.Background()).Info().Msg("TEST-EVENT")
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, float64(LogSchemaVersion), event["log_schema_version"])
+}
@@ -0,0 +1,216 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	zlog "github.com/rs/zerolog/log"
+)
+
+const metricsNamespace = "sora_archive_uploader"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	uploadedFilesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_files_total",
+		Help:      "Number of files uploaded to the object storage.",
+	}, []string{"type"})
+	uploadedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Number of bytes uploaded to the object storage.",
+	}, []string{"type"})
+	uploadDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Time taken to upload a file to the object storage.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600},
+	}, []string{"type"})
+	uploadFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upload_failures_total",
+		Help:      "Number of failed uploads by minio error code.",
+	}, []string{"type", "code"})
+	fileFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "file_failures_total",
+		Help:      "Number of files failed to process by error reason and class.",
+	}, []string{"type", "reason", "class"})
+	storageRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_retries_total",
+		Help:      "Number of object storage operations retried within a run.",
+	}, []string{"operation", "reason"})
+
+	webhookDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_duration_seconds",
+		Help:      "Time taken to send a webhook request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+	webhookRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_requests_total",
+		Help:      "Number of webhook requests by status code.",
+	}, []string{"type", "status_code"})
+
+	gateKeeperProcessingFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "gatekeeper_processing_files",
+		Help:      "Number of files queued or in progress in the gatekeeper.",
+	})
+	activeUploaders = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_uploaders",
+		Help:      "Number of uploaders currently handling a file.",
+	})
+	pendingRecordings = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_recordings",
+		Help:      "Number of recording directories found at the last scan.",
+	})
+	oldestPendingFileAgeSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "oldest_pending_file_age_seconds",
+		Help:      "Age of the oldest file found at the last scan.",
+	})
+	inFlightBytesSent = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "in_flight_bytes_sent",
+		Help:      "Number of bytes sent for media files currently being uploaded.",
+	}, func() float64 {
+		sent, _ := uploadStatus.inFlightBytes()
+		return float64(sent)
+	})
+	inFlightBytesTotal = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "in_flight_bytes_total",
+		Help:      "Total size of media files currently being uploaded.",
+	}, func() float64 {
+		_, total := uploadStatus.inFlightBytes()
+		return float64(total)
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		uploadedFilesTotal,
+		uploadedBytesTotal,
+		uploadDurationSeconds,
+		uploadFailuresTotal,
+		fileFailuresTotal,
+		storageRetriesTotal,
+		webhookDurationSeconds,
+		webhookRequestsTotal,
+		gateKeeperProcessingFiles,
+		activeUploaders,
+		pendingRecordings,
+		oldestPendingFileAgeSeconds,
+		inFlightBytesSent,
+		inFlightBytesTotal,
+	)
+}
+
+func observeUpload(objectKey string, size int64, duration time.Duration) {
+	fileType := recordingFileType(filepath.Base(objectKey))
+	uploadedFilesTotal.WithLabelValues(fileType).Inc()
+	uploadedBytesTotal.WithLabelValues(fileType).Add(float64(size))
+	uploadDurationSeconds.WithLabelValues(fileType).Observe(duration.Seconds())
+	runSummary.uploaded(fileType, size)
+}
+
+func observeUploadFailure(objectKey string, err error) {
+	fileType := recordingFileType(filepath.Base(objectKey))
+	code := minio.ToErrorResponse(err).Code
+	if code == "" {
+		code = "unknown"
+	}
+	uploadFailuresTotal.WithLabelValues(fileType, code).Inc()
+	runSummary.uploadFailed(code)
+}
+
+func observeFileFailure(filePath string, classification ErrorClassification) {
+	fileType := recordingFileType(filepath.Base(filePath))
+	fileFailuresTotal.WithLabelValues(fileType, classification.Reason, classification.Class).Inc()
+}
+
+func observeStorageRetry(operation string, classification ErrorClassification) {
+	storageRetriesTotal.WithLabelValues(operation, classification.Reason).Inc()
+	runSummary.storageRetry()
+}
+
+// statusCode が 0 の場合はレスポンスを受け取れなかったものとして扱う
+func observeWebhook(webhookType string, statusCode int, duration time.Duration) {
+	status := "error"
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	webhookDurationSeconds.WithLabelValues(webhookType).Observe(duration.Seconds())
+	webhookRequestsTotal.WithLabelValues(webhookType, status).Inc()
+	runSummary.webhook(statusCode == http.StatusOK)
+}
+
+// 見つかったファイルから録画ディレクトリ数と最も古いファイルの経過時間を記録する
+func observePendingFiles(files []string) {
+	dirs := make(map[string]struct{})
+	var oldest time.Time
+	for _, f := range files {
+		dirs[filepath.Dir(f)] = struct{}{}
+		if info, err := os.Stat(f); err == nil {
+			if oldest.IsZero() || info.ModTime().Before(oldest) {
+				oldest = info.ModTime()
+			}
+		}
+	}
+	pendingRecordings.Set(float64(len(dirs)))
+	if oldest.IsZero() {
+		oldestPendingFileAgeSeconds.Set(0)
+	} else {
+		oldestPendingFileAgeSeconds.Set(time.Since(oldest).Seconds())
+	}
+}
+
+// 常駐モードでメトリクスを HTTP で公開する
+func runMetricsServer(ctx context.Context, listenAddr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			zlog.Error().Err(err).Str("listen_addr", listenAddr).Msg("METRICS-SERVER-ERROR")
+		}
+	}()
+	zlog.Info().Str("listen_addr", listenAddr).Msg("STARTED-METRICS-SERVER")
+	return nil
+}
+
+// タイマーモードで node_exporter の textfile collector 向けにメトリクスを書き出す
+func writeMetricsTextfile(path string) {
+	if err := prometheus.WriteToTextfile(path, metricsRegistry); err != nil {
+		zlog.Error().Err(err).Str("path", path).Msg("FAILED-WRITE-METRICS-TEXTFILE")
+		return
+	}
+	zlog.Debug().Str("path", path).Msg("WROTE-METRICS-TEXTFILE")
+}
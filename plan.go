@@ -0,0 +1,333 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	PlanFormatTable = "table"
+	PlanFormatJSON  = "json"
+
+	PlanActionUpload  = "upload"
+	PlanActionExclude = "exclude"
+	PlanActionError   = "error"
+	// 他のプロセスが録画ディレクトリを処理している
+	PlanActionLocked = "locked"
+	// 失敗した後、次に処理する時刻になっていない
+	PlanActionBackoff = "backoff"
+	// 失敗した回数が upload_max_attempts に達したため upload_failed_dir_full_path に移動する
+	PlanActionMoveToFailed = "move-to-failed"
+)
+
+// 実行した場合に行う処理
+type PlannedAction struct {
+	Path        string `json:"path"`
+	FileType    string `json:"file_type"`
+	RecordingID string `json:"recording_id,omitempty"`
+	ChannelID   string `json:"channel_id,omitempty"`
+	// upload / exclude / error / locked / backoff / move-to-failed
+	Action string `json:"action"`
+	// 判定に使ったフィルタ
+	Filter string `json:"filter,omitempty"`
+	// フィルタで除外した場合のファイルの扱い
+	ExcludedAction string           `json:"excluded_action,omitempty"`
+	Uploads        []*PlannedUpload `json:"uploads,omitempty"`
+	Webhook        *PlannedWebhook  `json:"webhook,omitempty"`
+	// report ファイルの処理後の録画ディレクトリの移動先、削除する場合は空文字
+	EvacuatePath string `json:"evacuate_path,omitempty"`
+	// 失敗した回数と次に処理する時刻
+	Attempts      int        `json:"attempts,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	// move-to-failed の場合の移動先
+	FailedPath string `json:"failed_path,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// 録画ディレクトリを処理するかどうか
+type recordingSchedule struct {
+	// 処理する場合は空文字
+	action        string
+	attempts      int
+	nextAttemptAt time.Time
+	failedPath    string
+}
+
+type PlannedUpload struct {
+	Path      string `json:"path"`
+	ObjectKey string `json:"object_key"`
+	Size      int64  `json:"size"`
+}
+
+type PlannedWebhook struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// GateKeeper と同じく、録画ディレクトリの report ファイルを他のファイルの後に並べる
+func planOrder(files []string) []string {
+	pending := make(map[string]int)
+	for _, f := range files {
+		if recordingFileType(filepath.Base(f)) != RecordingFileTypeReport {
+			pending[filepath.Dir(f)]++
+		}
+	}
+	var result, reports []string
+	for _, f := range files {
+		if recordingFileType(filepath.Base(f)) == RecordingFileTypeReport && pending[filepath.Dir(f)] > 0 {
+			reports = append(reports, f)
+			continue
+		}
+		result = append(result, f)
+	}
+	return append(result, reports...)
+}
+
+// ストレージやウェブフック、ローカルのファイルには触れずに処理内容を組み立てる
+func planFiles(config *Config) ([]*PlannedAction, error) {
+	foundFiles, err := runFileFinder(config)
+	if err != nil {
+		return nil, err
+	}
+	schedule := planRecordingSchedule(config, time.Now())
+	decide := planRecordingFilter(config)
+	var result []*PlannedAction
+	for _, f := range planOrder(foundFiles) {
+		if s := schedule(filepath.Dir(f)); s.action != "" {
+			action := &PlannedAction{
+				Path:       f,
+				FileType:   recordingFileType(filepath.Base(f)),
+				Action:     s.action,
+				Attempts:   s.attempts,
+				FailedPath: s.failedPath,
+			}
+			if !s.nextAttemptAt.IsZero() {
+				action.NextAttemptAt = &s.nextAttemptAt
+			}
+			result = append(result, action)
+			continue
+		}
+		result = append(result, planFile(config, f, decide))
+	}
+	return result, nil
+}
+
+// 実行時と同じく、録画ディレクトリのロックと失敗履歴で処理するかを判定する
+// ロックの取得や失敗履歴の更新、録画ディレクトリの移動は行わない
+func planRecordingSchedule(config *Config, now time.Time) func(string) *recordingSchedule {
+	schedules := make(map[string]*recordingSchedule)
+	return func(recordingDir string) *recordingSchedule {
+		if s, ok := schedules[recordingDir]; ok {
+			return s
+		}
+		s := &recordingSchedule{}
+		schedules[recordingDir] = s
+		if config.RecordingLockDirFullPath != "" && recordingLockHeld(config, recordingDir) {
+			s.action = PlanActionLocked
+			return s
+		}
+		if !config.uploadAttemptsEnabled() {
+			return s
+		}
+		// 失敗履歴を読み込めない場合、実行時は処理する
+		attempts, err := loadRecordingAttempts(config, recordingDir)
+		if err != nil {
+			return s
+		}
+		attempts.pruneMissingFiles()
+		s.action = uploadAttemptsAction(config, attempts, now)
+		switch s.action {
+		case PlanActionMoveToFailed:
+			s.attempts = attempts.maxAttempts()
+			s.failedPath = config.relocatedPath(recordingDir, config.UploadFailedDirFullPath)
+		case PlanActionBackoff:
+			s.attempts = attempts.maxAttempts()
+			s.nextAttemptAt = attempts.nextAttemptAt()
+		}
+		return s
+	}
+}
+
+// アップローダーと同じく、フィルタは録画ごとに 1 回だけ評価する
+// ログには出力しない
+func planRecordingFilter(config *Config) func(string) (*filterDecision, error) {
+	decisions := make(map[string]*filterDecision)
+	return func(jsonFilePath string) (*filterDecision, error) {
+		recordingDir := filepath.Dir(jsonFilePath)
+		if decision, ok := decisions[recordingDir]; ok {
+			return decision, nil
+		}
+		decision, err := evaluateRecordingFilter(config.FilterRules, recordingDir)
+		if err != nil {
+			return nil, err
+		}
+		decisions[recordingDir] = decision
+		return decision, nil
+	}
+}
+
+func planFile(config *Config, jsonFilePath string, decide func(string) (*filterDecision, error)) *PlannedAction {
+	filename := filepath.Base(jsonFilePath)
+	action := &PlannedAction{
+		Path:     jsonFilePath,
+		FileType: recordingFileType(filename),
+		Action:   PlanActionUpload,
+	}
+	planError := func(err error) *PlannedAction {
+		action.Action = PlanActionError
+		action.Error = err.Error()
+		return action
+	}
+
+	if len(config.FilterRules) > 0 {
+		decision, err := decide(jsonFilePath)
+		if err != nil {
+			return planError(err)
+		}
+		action.RecordingID = decision.recordingID
+		action.ChannelID = decision.channelID
+		action.Filter = decision.filter
+		if decision.excluded {
+			action.Action = PlanActionExclude
+			action.ExcludedAction = config.filterExcludedAction()
+			return action
+		}
+	}
+
+	raw, err := os.ReadFile(jsonFilePath)
+	if err != nil {
+		return planError(err)
+	}
+	jsonUpload, err := newPlannedUpload(jsonFilePath, "")
+	if err != nil {
+		return planError(err)
+	}
+
+	var webhookType string
+	var payload any
+	switch action.FileType {
+	case RecordingFileTypeReport:
+		var rr RecordingReport
+		if err := json.Unmarshal(raw, &rr); err != nil {
+			return planError(err)
+		}
+		action.RecordingID = rr.RecordingID
+		action.ChannelID = rr.ChannelID
+		jsonUpload.ObjectKey = config.objectKey(jsonFilePath, rr.RecordingID, filename)
+		action.Uploads = []*PlannedUpload{jsonUpload}
+		webhookType = config.WebhookTypeReportUploaded
+		payload = newWebhookReportUploaded(config, rr, filename, objectURL(config.ObjectStorageBucketName, jsonUpload.ObjectKey))
+		if !config.RemoveEmptyRecordingDirectory {
+			if root := config.archiveRootOf(jsonFilePath); root != nil {
+				action.EvacuatePath = config.relocatedPath(filepath.Dir(jsonFilePath), root.EvacuateDirFullPath)
+			}
+		}
+	case RecordingFileTypeSplitArchiveEnd:
+		var aem ArchiveEndMetadata
+		if err := json.Unmarshal(raw, &aem); err != nil {
+			return planError(err)
+		}
+		action.RecordingID = aem.RecordingID
+		action.ChannelID = aem.ChannelID
+		jsonUpload.ObjectKey = config.objectKey(jsonFilePath, aem.RecordingID, filename)
+		action.Uploads = []*PlannedUpload{jsonUpload}
+		webhookType = config.WebhookTypeSplitArchiveEndUploaded
+		payload = newWebhookArchiveEndUploaded(webhookType, aem, filename, objectURL(config.ObjectStorageBucketName, jsonUpload.ObjectKey))
+	default:
+		var am ArchiveMetadata
+		if err := json.Unmarshal(raw, &am); err != nil {
+			return planError(err)
+		}
+		action.RecordingID = am.RecordingID
+		action.ChannelID = am.ChannelID
+		jsonUpload.ObjectKey = config.objectKey(jsonFilePath, am.RecordingID, filename)
+		mediaFilename := filepath.Base(am.Filename)
+		mediaFilepath := filepath.Join(filepath.Dir(jsonFilePath), mediaFilename)
+		mediaUpload, err := newPlannedUpload(mediaFilepath, config.objectKey(jsonFilePath, am.RecordingID, mediaFilename))
+		if err != nil {
+			return planError(err)
+		}
+		action.Uploads = []*PlannedUpload{jsonUpload, mediaUpload}
+		webhookType = config.webhookTypeArchiveUploaded(action.FileType == RecordingFileTypeSplitArchive)
+		payload = newWebhookArchiveUploaded(webhookType, am,
+			mediaFilename, objectURL(config.ObjectStorageBucketName, mediaUpload.ObjectKey),
+			filename, objectURL(config.ObjectStorageBucketName, jsonUpload.ObjectKey),
+		)
+	}
+
+	if config.WebhookEndpointURL != "" {
+		buf, err := json.Marshal(payload)
+		if err != nil {
+			return planError(err)
+		}
+		action.Webhook = &PlannedWebhook{
+			Type:    webhookType,
+			Payload: buf,
+		}
+	}
+	return action
+}
+
+func newPlannedUpload(filePath, objectKey string) (*PlannedUpload, error) {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &PlannedUpload{
+		Path:      filePath,
+		ObjectKey: objectKey,
+		Size:      fileInfo.Size(),
+	}, nil
+}
+
+func writePlan(w io.Writer, actions []*PlannedAction, format string) error {
+	switch format {
+	case PlanFormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if actions == nil {
+			actions = []*PlannedAction{}
+		}
+		return encoder.Encode(actions)
+	case PlanFormatTable, "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "#\tACTION\tTYPE\tRECORDING_ID\tPATH\tOBJECT_KEYS\tWEBHOOK\tDETAIL")
+		for i, a := range actions {
+			var keys []string
+			for _, u := range a.Uploads {
+				keys = append(keys, u.ObjectKey)
+			}
+			webhook := "-"
+			if a.Webhook != nil {
+				webhook = a.Webhook.Type
+			}
+			var detail string
+			switch {
+			case a.Action == PlanActionError:
+				detail = a.Error
+			case a.Action == PlanActionExclude:
+				detail = fmt.Sprintf("filter=%s excluded_action=%s", a.Filter, a.ExcludedAction)
+			case a.Action == PlanActionBackoff:
+				detail = fmt.Sprintf("attempts=%d next_attempt_at=%s", a.Attempts, a.NextAttemptAt.UTC().Format(time.RFC3339))
+			case a.Action == PlanActionMoveToFailed:
+				detail = fmt.Sprintf("attempts=%d failed=%s", a.Attempts, a.FailedPath)
+			case a.EvacuatePath != "":
+				detail = "evacuate=" + a.EvacuatePath
+			case a.FileType == RecordingFileTypeReport:
+				detail = "remove-recording-directory-if-empty"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				i+1, a.Action, a.FileType, a.RecordingID, a.Path,
+				strings.Join(keys, ","), webhook, detail)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unsupported plan format: %q", format)
+	}
+}
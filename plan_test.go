@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanFiles(t *testing.T) {
+	root := t.TempDir()
+	recDir := filepath.Join(root, "REC1")
+	require.NoError(t, os.MkdirAll(recDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "report-REC1.json"),
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.json"),
+		[]byte(`{"recording_id":"REC1","channel_id":"ch1","connection_id":"A","filename":"archive-A.webm"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(recDir, "archive-A.webm"), []byte("media"), 0644))
+
+	config := &Config{
+		ObjectStorageBucketName: "bucket",
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: filepath.Join(root, "evacuate"), ObjectKeyPrefix: "prefix"},
+		},
+		WebhookEndpointURL:         "http://127.0.0.1/webhook",
+		WebhookTypeArchiveUploaded: "archive.uploaded",
+		WebhookTypeReportUploaded:  "report.uploaded",
+	}
+
+	actions, err := planFiles(config)
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+
+	// report ファイルは最後に処理する
+	archive := actions[0]
+	assert.Equal(t, PlanActionUpload, archive.Action)
+	assert.Equal(t, RecordingFileTypeArchive, archive.FileType)
+	require.Len(t, archive.Uploads, 2)
+	assert.Equal(t, "prefix/REC1/archive-A.json", archive.Uploads[0].ObjectKey)
+	assert.Equal(t, "prefix/REC1/archive-A.webm", archive.Uploads[1].ObjectKey)
+	assert.Equal(t, int64(5), archive.Uploads[1].Size)
+	require.NotNil(t, archive.Webhook)
+	assert.Equal(t, "archive.uploaded", archive.Webhook.Type)
+	var w WebhookArchiveUploaded
+	require.NoError(t, json.Unmarshal(archive.Webhook.Payload, &w))
+	assert.Equal(t, "s3://bucket/prefix/REC1/archive-A.webm", w.FileURL)
+	assert.Equal(t, "A", w.ConnectionID)
+
+	report := actions[1]
+	assert.Equal(t, RecordingFileTypeReport, report.FileType)
+	assert.Equal(t, "prefix/REC1/report-REC1.json", report.Uploads[0].ObjectKey)
+	assert.Equal(t, filepath.Join(root, "evacuate", "REC1"), report.EvacuatePath)
+
+	// ローカルのファイルには触れない
+	assert.FileExists(t, filepath.Join(recDir, "archive-A.webm"))
+	assert.NoDirExists(t, filepath.Join(root, "evacuate"))
+
+	var buf bytes.Buffer
+	require.NoError(t, writePlan(&buf, actions, PlanFormatTable))
+	assert.Contains(t, buf.String(), "prefix/REC1/archive-A.json,prefix/REC1/archive-A.webm")
+}
+
+func TestPlanFilesRecordingSchedule(t *testing.T) {
+	root := t.TempDir()
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: filepath.Join(root, "evacuate")},
+		},
+		UploadAttemptsDirFullPath: t.TempDir(),
+		UploadMaxAttempts:         3,
+		UploadFailedDirFullPath:   filepath.Join(root, "failed"),
+		RecordingLockDirFullPath:  t.TempDir(),
+	}
+	for _, id := range []string{"REC1", "REC2", "REC3"} {
+		writeTestFile(t, filepath.Join(root, id, "report-"+id+".json"))
+	}
+	next := time.Now().Add(time.Hour)
+	backoff := &RecordingAttempts{
+		RecordingDir: filepath.Join(root, "REC1"),
+		Files:        map[string]*FileAttempts{"report-REC1.json": {Attempts: 1, NextAttemptAt: next}},
+	}
+	require.NoError(t, backoff.save(config))
+	failed := &RecordingAttempts{
+		RecordingDir: filepath.Join(root, "REC2"),
+		Files:        map[string]*FileAttempts{"report-REC2.json": {Attempts: 3}},
+	}
+	require.NoError(t, failed.save(config))
+	// 録画ディレクトリからなくなったファイルの履歴は判定に使わない
+	missing := &RecordingAttempts{
+		RecordingDir: filepath.Join(root, "REC3"),
+		Files:        map[string]*FileAttempts{"archive-A.json": {Attempts: 3}},
+	}
+	require.NoError(t, missing.save(config))
+
+	actions, err := planFiles(config)
+	require.NoError(t, err)
+	byPath := make(map[string]*PlannedAction)
+	for _, a := range actions {
+		byPath[a.Path] = a
+	}
+	rec1 := byPath[filepath.Join(root, "REC1", "report-REC1.json")]
+	assert.Equal(t, PlanActionBackoff, rec1.Action)
+	assert.Equal(t, 1, rec1.Attempts)
+	require.NotNil(t, rec1.NextAttemptAt)
+	assert.True(t, next.Equal(*rec1.NextAttemptAt))
+	rec2 := byPath[filepath.Join(root, "REC2", "report-REC2.json")]
+	assert.Equal(t, PlanActionMoveToFailed, rec2.Action)
+	assert.Equal(t, filepath.Join(root, "failed", "REC2"), rec2.FailedPath)
+	assert.Equal(t, PlanActionUpload, byPath[filepath.Join(root, "REC3", "report-REC3.json")].Action)
+
+	// 録画ディレクトリの移動や失敗履歴の更新は行わない
+	assert.DirExists(t, filepath.Join(root, "REC2"))
+	assert.FileExists(t, uploadAttemptsFilePath(config, filepath.Join(root, "REC3")))
+
+	// 他のプロセスがロックしている録画ディレクトリ
+	lock, err := acquireFileLock(recordingLockFilePath(config, filepath.Join(root, "REC3")), false)
+	require.NoError(t, err)
+	defer lock.release()
+	actions, err = planFiles(config)
+	require.NoError(t, err)
+	for _, a := range actions {
+		if a.Path == filepath.Join(root, "REC3", "report-REC3.json") {
+			assert.Equal(t, PlanActionLocked, a.Action)
+		}
+	}
+	assert.False(t, recordingLockHeld(config, filepath.Join(root, "REC1")))
+}
@@ -0,0 +1,141 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// 転送速度を計算する間隔
+const uploadProgressSampleInterval = time.Second
+
+type UploadProgress struct {
+	ObjectKey       string  `json:"object_key"`
+	BytesSent       int64   `json:"bytes_sent"`
+	TotalBytes      int64   `json:"total_bytes"`
+	Percent         float64 `json:"percent"`
+	RateBytesPerSec float64 `json:"rate_bytes_per_sec"`
+	// 現在の転送速度から計算した残り時間、転送速度が 0 の場合は -1
+	ETASeconds float64 `json:"eta_seconds"`
+}
+
+// minio の PutObjectOptions.Progress に渡して送信したバイト数を数える
+// minio は送信したバイト数と同じ長さで Read を呼び出す
+type uploadProgress struct {
+	objectKey string
+	total     int64
+	sent      atomic.Int64
+
+	mutex      sync.Mutex
+	sampledAt  time.Time
+	sampleSent int64
+	rate       float64
+}
+
+func newUploadProgress(objectKey string, total int64) *uploadProgress {
+	return &uploadProgress{
+		objectKey: objectKey,
+		total:     total,
+		sampledAt: time.Now(),
+	}
+}
+
+func (p *uploadProgress) Read(b []byte) (int, error) {
+	p.sent.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// 前回からの差分で現在の転送速度を計算する
+func (p *uploadProgress) sample() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	sent := p.sent.Load()
+	if elapsed := now.Sub(p.sampledAt).Seconds(); elapsed > 0 {
+		p.rate = float64(sent-p.sampleSent) / elapsed
+	}
+	p.sampledAt = now
+	p.sampleSent = sent
+}
+
+func (p *uploadProgress) snapshot() *UploadProgress {
+	p.mutex.Lock()
+	rate := p.rate
+	p.mutex.Unlock()
+
+	sent := p.sent.Load()
+	// multipart アップロードの再送で合計を超える場合がある
+	if sent > p.total {
+		sent = p.total
+	}
+	var percent float64
+	if p.total > 0 {
+		percent = float64(sent) / float64(p.total) * 100
+	}
+	eta := -1.0
+	if rate > 0 {
+		eta = float64(p.total-sent) / rate
+	}
+	return &UploadProgress{
+		ObjectKey:       p.objectKey,
+		BytesSent:       sent,
+		TotalBytes:      p.total,
+		Percent:         percent,
+		RateBytesPerSec: rate,
+		ETASeconds:      eta,
+	}
+}
+
+// アップロードが終わるまで転送速度を計算し、設定した間隔で進捗をログに出力する
+func (p *uploadProgress) watch(ctx context.Context, logInterval time.Duration) {
+	sampleTicker := time.NewTicker(uploadProgressSampleInterval)
+	defer sampleTicker.Stop()
+	var logTicker <-chan time.Time
+	if logInterval > 0 {
+		t := time.NewTicker(logInterval)
+		defer t.Stop()
+		logTicker = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sampleTicker.C:
+			p.sample()
+		case <-logTicker:
+			s := p.snapshot()
+			zerolog.Ctx(ctx).Info().
+				Str("dst", s.ObjectKey).
+				Int64("bytes_sent", s.BytesSent).
+				Int64("total_bytes", s.TotalBytes).
+				Float64("percent", s.Percent).
+				Float64("rate_bytes_per_sec", s.RateBytesPerSec).
+				Float64("eta_seconds", s.ETASeconds).
+				Msg("MEDIA-FILE-UPLOAD-PROGRESS")
+		}
+	}
+}
+
+// multipart アップロードのパートを読み込んだバイト数を進捗に加える
+// パートの送信に失敗した場合は rewind で加えた分を戻し、送信し直した分を重複して数えないようにする
+type partProgressReader struct {
+	r        io.Reader
+	progress *uploadProgress
+	read     int64
+}
+
+func (r *partProgressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.read += int64(n)
+	r.progress.sent.Add(int64(n))
+	return n, err
+}
+
+func (r *partProgressReader) rewind() {
+	r.progress.sent.Add(-r.read)
+	r.read = 0
+}
@@ -0,0 +1,35 @@
+package archive
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadProgressSnapshot(t *testing.T) {
+	p := newUploadProgress("REC1/archive-A.webm", 1000)
+
+	s := p.snapshot()
+	assert.Equal(t, int64(0), s.BytesSent)
+	assert.Equal(t, float64(0), s.Percent)
+	// 転送速度がわからない間は残り時間を計算しない
+	assert.Equal(t, -1.0, s.ETASeconds)
+
+	p.sampledAt = time.Now().Add(-time.Second)
+	n, err := p.Read(make([]byte, 250))
+	assert.NoError(t, err)
+	assert.Equal(t, 250, n)
+	p.sample()
+
+	s = p.snapshot()
+	assert.Equal(t, int64(250), s.BytesSent)
+	assert.Equal(t, int64(1000), s.TotalBytes)
+	assert.Equal(t, 25.0, s.Percent)
+	assert.InDelta(t, 250, s.RateBytesPerSec, 10)
+	assert.InDelta(t, 3, s.ETASeconds, 0.2)
+
+	// 再送で合計を超えても 100% を超えない
+	p.Read(make([]byte, 1000))
+	assert.Equal(t, 100.0, p.snapshot().Percent)
+}
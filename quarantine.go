@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+)
+
+// 隔離したファイルと一緒に保存する理由ファイルのプレフィックス
+// archive- や report- で始まらないため、再投入後も処理対象のファイルとして扱われない
+const quarantineReasonFilePrefix = "reason-"
+
+// 隔離した理由
+type QuarantineReason struct {
+	Filename     string    `json:"filename"`
+	Files        []string  `json:"files"`
+	OriginalPath string    `json:"original_path"`
+	ObjectKey    string    `json:"object_key"`
+	ErrorCode    string    `json:"error_code"`
+	ErrorReason  string    `json:"error_reason"`
+	ErrorMessage string    `json:"error_message"`
+	Timestamp    time.Time `json:"timestamp"`
+	Attempts     int       `json:"attempts"`
+}
+
+func quarantineReasonFilename(jsonFilePath string) string {
+	return quarantineReasonFilePrefix + filepath.Base(jsonFilePath)
+}
+
+// quarantine に分類したエラーで処理に失敗したファイルを、理由ファイルと一緒に隔離ディレクトリに移動する
+// 隔離ディレクトリが設定されていない場合はファイルを移動せず、次回の実行で再度処理する
+// 存在しないファイルは移動しない
+func (u Uploader) quarantineFiles(ctx context.Context, jsonFilePath string, files []string, objectKey string, cause error) error {
+	runSummary.nonRetryableFailure()
+	if u.config.QuarantineDirFullPath == "" {
+		zerolog.Ctx(ctx).Error().
+			Msg("QUARANTINE-DIR-NOT-CONFIGURED")
+		return nil
+	}
+
+	var existingFiles []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existingFiles = append(existingFiles, f)
+		}
+	}
+	if len(existingFiles) == 0 {
+		zerolog.Ctx(ctx).Warn().
+			Msg("QUARANTINE-FILES-NOT-FOUND")
+		return nil
+	}
+
+	dirname := filepath.Dir(jsonFilePath)
+	newDirPath := u.config.relocatedPath(dirname, u.config.QuarantineDirFullPath)
+	if err := os.MkdirAll(newDirPath, 0755); err != nil {
+		zerolog.Ctx(ctx).Error().
+			Err(err).
+			Str("quarantine_dir_path", newDirPath).
+			Msg("QUARANTINE-DIRECTORY-CREATE-ERROR")
+		return err
+	}
+
+	reason := QuarantineReason{
+		Filename:     filepath.Base(jsonFilePath),
+		OriginalPath: jsonFilePath,
+		ObjectKey:    objectKey,
+		ErrorCode:    minio.ToErrorResponse(cause).Code,
+		ErrorReason:  u.config.classifyError(cause).Reason,
+		ErrorMessage: cause.Error(),
+		Timestamp:    time.Now().UTC(),
+		Attempts:     previousUploadAttempts(u.config, jsonFilePath) + 1,
+	}
+	for _, f := range existingFiles {
+		reason.Files = append(reason.Files, filepath.Base(f))
+	}
+	buf, err := json.MarshalIndent(reason, "", "  ")
+	if err != nil {
+		return err
+	}
+	reasonFilePath := filepath.Join(newDirPath, quarantineReasonFilename(jsonFilePath))
+	if err := os.WriteFile(reasonFilePath, buf, 0644); err != nil {
+		zerolog.Ctx(ctx).Error().
+			Err(err).
+			Str("reason_file_path", reasonFilePath).
+			Msg("QUARANTINE-REASON-FILE-WRITE-ERROR")
+		return err
+	}
+
+	for _, f := range existingFiles {
+		newPath := filepath.Join(newDirPath, filepath.Base(f))
+		if err := os.Rename(f, newPath); err != nil {
+			zerolog.Ctx(ctx).Error().
+				Err(err).
+				Str("old_path", f).
+				Str("new_path", newPath).
+				Msg("QUARANTINE-FILE-MOVE-ERROR")
+			return err
+		}
+	}
+	zerolog.Ctx(ctx).Warn().
+		Str("quarantine_dir_path", newDirPath).
+		Str("error_code", reason.ErrorCode).
+		Str("error_reason", reason.ErrorReason).
+		Msg("QUARANTINED-FILES")
+	return nil
+}
+
+// 隔離ディレクトリのファイルを元の録画ディレクトリに戻す
+// targets を指定した場合は、録画ディレクトリ名または隔離ディレクトリからの相対パスが一致するものだけを戻す
+func requeueQuarantinedFiles(config *Config, targets []string) (int, error) {
+	quarantineDir := filepath.Clean(config.QuarantineDirFullPath)
+	var reasonFiles []string
+	err := filepath.WalkDir(quarantineDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), quarantineReasonFilePrefix) {
+			return nil
+		}
+		if len(targets) > 0 && !matchRequeueTarget(quarantineDir, filepath.Dir(path), targets) {
+			return nil
+		}
+		reasonFiles = append(reasonFiles, path)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var requeued int
+	for _, reasonFilePath := range reasonFiles {
+		if err := requeueQuarantinedFile(quarantineDir, reasonFilePath); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("reason_file_path", reasonFilePath).
+				Msg("FAILED-REQUEUE-QUARANTINED-FILE")
+			continue
+		}
+		requeued++
+	}
+	return requeued, nil
+}
+
+func matchRequeueTarget(quarantineDir, dirPath string, targets []string) bool {
+	relPath, err := filepath.Rel(quarantineDir, dirPath)
+	if err != nil {
+		return false
+	}
+	for _, target := range targets {
+		target = filepath.Clean(target)
+		if target == filepath.Base(dirPath) || target == relPath || target == dirPath {
+			return true
+		}
+	}
+	return false
+}
+
+func requeueQuarantinedFile(quarantineDir, reasonFilePath string) error {
+	raw, err := os.ReadFile(reasonFilePath)
+	if err != nil {
+		return err
+	}
+	var reason QuarantineReason
+	if err := json.Unmarshal(raw, &reason); err != nil {
+		return err
+	}
+
+	dirPath := filepath.Dir(reasonFilePath)
+	originalDir := filepath.Dir(reason.OriginalPath)
+	if err := os.MkdirAll(originalDir, 0755); err != nil {
+		return err
+	}
+	for _, filename := range reason.Files {
+		oldPath := filepath.Join(dirPath, filename)
+		newPath := filepath.Join(originalDir, filename)
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+		zlog.Info().
+			Str("old_path", oldPath).
+			Str("new_path", newPath).
+			Msg("REQUEUED-QUARANTINED-FILE")
+	}
+	if err := os.Remove(reasonFilePath); err != nil {
+		return err
+	}
+	// 空になった隔離先のディレクトリを削除する
+	for dir := dirPath; dir != quarantineDir && len(dir) > len(quarantineDir); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantineAndRequeueFiles(t *testing.T) {
+	root := t.TempDir()
+	archiveDir := filepath.Join(root, "archive")
+	quarantineDir := filepath.Join(root, "quarantine")
+	jsonFilePath := filepath.Join(archiveDir, "REC1", "archive-A.json")
+	mediaFilePath := filepath.Join(archiveDir, "REC1", "archive-A.webm")
+	writeTestFile(t, jsonFilePath)
+	writeTestFile(t, mediaFilePath)
+
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: archiveDir, EvacuateDirFullPath: filepath.Join(root, "evacuate")},
+		},
+		QuarantineDirFullPath: quarantineDir,
+	}
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+
+	// 存在しないファイルは移動しない
+	files := []string{jsonFilePath, mediaFilePath, filepath.Join(archiveDir, "REC1", "archive-A.mp4")}
+	require.NoError(t, u.quarantineFiles(context.Background(), jsonFilePath, files, "REC1/archive-A.webm", errors.New("broken")))
+
+	assert.NoFileExists(t, jsonFilePath)
+	assert.NoFileExists(t, mediaFilePath)
+	assert.FileExists(t, filepath.Join(quarantineDir, "REC1", "archive-A.json"))
+	assert.FileExists(t, filepath.Join(quarantineDir, "REC1", "archive-A.webm"))
+
+	raw, err := os.ReadFile(filepath.Join(quarantineDir, "REC1", "reason-archive-A.json"))
+	require.NoError(t, err)
+	var reason QuarantineReason
+	require.NoError(t, json.Unmarshal(raw, &reason))
+	assert.Equal(t, "archive-A.json", reason.Filename)
+	assert.Equal(t, []string{"archive-A.json", "archive-A.webm"}, reason.Files)
+	assert.Equal(t, jsonFilePath, reason.OriginalPath)
+	assert.Equal(t, "REC1/archive-A.webm", reason.ObjectKey)
+	assert.Equal(t, "broken", reason.ErrorMessage)
+	assert.Equal(t, 1, reason.Attempts)
+
+	// 対象に一致しない録画ディレクトリは戻さない
+	requeued, err := requeueQuarantinedFiles(config, []string{"REC2"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, requeued)
+
+	requeued, err = requeueQuarantinedFiles(config, []string{"REC1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+	assert.FileExists(t, jsonFilePath)
+	assert.FileExists(t, mediaFilePath)
+	assert.NoDirExists(t, filepath.Join(quarantineDir, "REC1"))
+}
@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"reflect"
+	"strings"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// SIGHUP で再読み込みできる設定項目
+// webhook_ から始まる設定項目もすべて再読み込みできる
+var reloadableConfigKeys = map[string]bool{
+	"debug":                              true,
+	"upload_workers":                     true,
+	"disk_pressure_upload_workers":       true,
+	"upload_file_rate_limit_mbps":        true,
+	"upload_progress_log_interval_s":     true,
+	"exclude_webhook_recording_metadata": true,
+	"filter_excluded_action":             true,
+	"filter_excluded_dir_full_path":      true,
+}
+
+func isReloadableConfigKey(key string) bool {
+	return reloadableConfigKeys[key] || strings.HasPrefix(key, "webhook_")
+}
+
+// 現在の設定に next の再読み込みできる設定項目を反映した設定を返す
+// 反映した設定項目と、再起動が必要なため反映しなかった設定項目も返す
+func (c *Config) reloaded(next *Config) (*Config, []string, []string) {
+	result := *c
+	var applied, ignored []string
+
+	rv := reflect.ValueOf(&result).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("ini")
+		if key == "" || key == "-" {
+			continue
+		}
+		if reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !isReloadableConfigKey(key) {
+			ignored = append(ignored, key)
+			continue
+		}
+		rv.Field(i).Set(nv.Field(i))
+		applied = append(applied, key)
+	}
+
+	// フィルタは再読み込みできる
+	if !reflect.DeepEqual(sectionFields(c.FilterRules), sectionFields(next.FilterRules)) {
+		result.FilterRules = next.FilterRules
+		applied = append(applied, strings.TrimSuffix(FilterSectionPrefix, "."))
+	}
+	// アーカイブディレクトリの変更は探索中の録画ディレクトリに影響するため再起動が必要
+	if !reflect.DeepEqual(sectionFields(c.ArchiveRoots), sectionFields(next.ArchiveRoots)) {
+		ignored = append(ignored, strings.TrimSuffix(ArchiveRootSectionPrefix, "."))
+	}
+	result.envOverriddenKeys = next.envOverriddenKeys
+	return &result, applied, ignored
+}
+
+// [archive_root.<name>] や [filter.<name>] セクションを比較できる形にする
+func sectionFields[T any](sections []*T) []map[string]any {
+	result := make([]map[string]any, 0, len(sections))
+	for _, section := range sections {
+		fields := make(map[string]any)
+		rv := reflect.ValueOf(section).Elem()
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			if !rt.Field(i).IsExported() {
+				continue
+			}
+			fields[rt.Field(i).Name] = rv.Field(i).Interface()
+		}
+		result = append(result, fields)
+	}
+	return result
+}
+
+// 設定ファイルを読み込み直し、検証に成功した場合のみ再読み込みできる設定項目を反映する
+// 処理中のアップロードは読み込み前の設定のまま続け、次の探索から新しい設定を使う
+func (m *Main) reload(configFilePath string) error {
+	next, err := newConfig(configFilePath)
+	if err == nil {
+		err = next.validateDirectories()
+	}
+	if err != nil {
+		zlog.Error().
+			Err(err).
+			Str("config_file_path", configFilePath).
+			Msg("CONFIG-RELOAD-REJECTED")
+		return err
+	}
+
+	config, applied, ignored := m.currentConfig().reloaded(next)
+	m.config.Store(config)
+	setLogLevel(config)
+
+	if len(ignored) > 0 {
+		zlog.Warn().
+			Strs("keys", ignored).
+			Msg("CONFIG-RELOAD-REQUIRES-RESTART")
+	}
+	zlog.Info().
+		Str("config_file_path", configFilePath).
+		Strs("applied_keys", applied).
+		Interface("config", config.redacted()).
+		Msg("CONFIG-RELOADED")
+	return nil
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMainReload(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(root+"/archive", 0755))
+	require.NoError(t, os.Mkdir(root+"/archive2", 0755))
+	base := `
+log_dir = ` + root + `
+log_stdout = true
+evacuate_dir_full_path = ` + root + `/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+`
+	configFilePath := writeTestConfig(t, base+`
+archive_dir_full_path = `+root+`/archive
+upload_workers = 4
+`)
+	config, err := newConfig(configFilePath)
+	require.NoError(t, err)
+	m := newMain(config)
+
+	require.NoError(t, os.WriteFile(configFilePath, []byte(base+`
+archive_dir_full_path = `+root+`/archive2
+upload_workers = 8
+webhook_endpoint_url = https://example.com/webhook
+webhook_type_header_name = sora-archive-uploader-webhook-type
+
+[filter.exclude-test]
+action = exclude
+channel_id_glob = test-*
+`), 0644))
+	require.NoError(t, m.reload(configFilePath))
+
+	reloaded := m.currentConfig()
+	assert.Equal(t, 8, reloaded.UploadWorkers)
+	assert.Equal(t, "https://example.com/webhook", reloaded.WebhookEndpointURL)
+	require.Len(t, reloaded.FilterRules, 1)
+	// アーカイブディレクトリは再起動するまで変わらない
+	assert.Equal(t, root+"/archive", reloaded.ArchiveRoots[0].ArchiveDirFullPath)
+	assert.Equal(t, root+"/archive", reloaded.SoraArchiveDirFullPath)
+	// 読み込み前の設定は変更しない
+	assert.Equal(t, 4, config.UploadWorkers)
+
+	// 検証に失敗した場合は反映しない
+	require.NoError(t, os.WriteFile(configFilePath, []byte(base+`
+archive_dir_full_path = `+root+`/archive
+upload_workers = 0
+`), 0644))
+	require.Error(t, m.reload(configFilePath))
+	assert.Same(t, reloaded, m.currentConfig())
+}
+
+func TestConfigReloaded(t *testing.T) {
+	current := &Config{
+		UploadWorkers:            4,
+		ScanIntervalS:            60,
+		WebhookBasicAuthPassword: "old",
+		FilterRules:              []*FilterRule{{Name: "a", Action: FilterRuleActionExclude}},
+	}
+	next := &Config{
+		UploadWorkers:            4,
+		ScanIntervalS:            30,
+		WebhookBasicAuthPassword: "new",
+		FilterRules:              []*FilterRule{{Name: "a", Action: FilterRuleActionExclude}},
+		ArchiveRoots:             []*ArchiveRoot{{Name: "default"}},
+	}
+	config, applied, ignored := current.reloaded(next)
+	assert.Equal(t, []string{"webhook_basic_auth_password"}, applied)
+	assert.Equal(t, []string{"scan_interval_s", "archive_root"}, ignored)
+	assert.Equal(t, "new", config.WebhookBasicAuthPassword)
+	assert.Equal(t, 60, config.ScanIntervalS)
+	assert.Empty(t, config.ArchiveRoots)
+}
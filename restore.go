@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/shiguredo/sora-archive-uploader/s3"
+)
+
+type RestoredObject struct {
+	ObjectKey string `json:"object_key"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	// アップロード時に保存した MD5 か、multipart アップロードではないオブジェクトの ETag で検証する
+	// どちらもない場合はサイズのみ検証する
+	ChecksumVerified bool   `json:"checksum_verified"`
+	Error            string `json:"error,omitempty"`
+}
+
+// 設定されているオブジェクトキーのプレフィックスから録画のオブジェクトを探す
+func recordingObjectPrefixes(config *Config, recordingID string) []string {
+	seen := make(map[string]struct{})
+	var result []string
+	for _, root := range config.ArchiveRoots {
+		prefix := path.Join(strings.Trim(root.ObjectKeyPrefix, "/"), recordingID) + "/"
+		if _, ok := seen[prefix]; ok {
+			continue
+		}
+		seen[prefix] = struct{}{}
+		result = append(result, prefix)
+	}
+	if len(result) == 0 {
+		result = append(result, recordingID+"/")
+	}
+	return result
+}
+
+func listRecordingObjects(ctx context.Context, client *minio.Client, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	var result []minio.ObjectInfo
+	for object := range client.ListObjects(ctx, bucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		result = append(result, object)
+	}
+	return result, nil
+}
+
+// 録画のオブジェクトをダウンロードして destDir/<録画 ID>/ に録画ディレクトリを復元する
+func restoreRecording(ctx context.Context, config *Config, recordingID, destDir string) ([]*RestoredObject, error) {
+	recordingID = filepath.Base(recordingID)
+	osConfig := config.objectStorageConfig()
+	client, err := s3.NewClient(osConfig.Endpoint, newCredentials(osConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix string
+	var objects []minio.ObjectInfo
+	for _, p := range recordingObjectPrefixes(config, recordingID) {
+		objects, err = listRecordingObjects(ctx, client, osConfig.BucketName, p)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) > 0 {
+			prefix = p
+			break
+		}
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("recording not found in bucket: %s", recordingID)
+	}
+
+	recordingDir := filepath.Join(destDir, recordingID)
+	if err := os.MkdirAll(recordingDir, 0755); err != nil {
+		return nil, err
+	}
+
+	workers := config.UploadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]*RestoredObject, len(objects))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				object := objects[i]
+				r := &RestoredObject{
+					ObjectKey: object.Key,
+					Path:      filepath.Join(recordingDir, filepath.FromSlash(strings.TrimPrefix(object.Key, prefix))),
+					Size:      object.Size,
+				}
+				verified, err := downloadObject(ctx, client, osConfig.BucketName, object, r.Path)
+				if err != nil {
+					r.Error = err.Error()
+					zlog.Error().
+						Err(err).
+						Str("object_key", r.ObjectKey).
+						Str("path", r.Path).
+						Msg("FAILED-RESTORE-OBJECT")
+				} else {
+					r.ChecksumVerified = verified
+					zlog.Info().
+						Str("object_key", r.ObjectKey).
+						Str("path", r.Path).
+						Int64("size", r.Size).
+						Bool("checksum_verified", verified).
+						Msg("RESTORED-OBJECT")
+				}
+				results[i] = r
+			}
+		}()
+	}
+	for i := range objects {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results, nil
+}
+
+// 一時ファイルにダウンロードし、サイズとチェックサムを検証してから配置する
+// 既にファイルがある場合は上書きしない
+func downloadObject(ctx context.Context, client *minio.Client, bucketName string, object minio.ObjectInfo, destPath string) (bool, error) {
+	if _, err := os.Stat(destPath); err == nil {
+		return false, fmt.Errorf("file already exists: %s", destPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return false, err
+	}
+
+	reader, err := client.GetObject(ctx, bucketName, object.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	// 一覧ではユーザーメタデータを取得できないため、ダウンロードするオブジェクトの情報を使う
+	info, err := reader.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tmpPath := destPath + ".part"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+
+	if n != info.Size {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("size mismatch: expected=%d actual=%d", info.Size, n)
+	}
+	// アップロード時に保存した MD5 がなく、multipart アップロードの場合は検証できない
+	expected := objectMD5(info)
+	verified := expected != ""
+	if verified && expected != hex.EncodeToString(hash.Sum(nil)) {
+		os.Remove(tmpPath)
+		return false, errors.New("checksum mismatch")
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	return verified, nil
+}
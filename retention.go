@@ -0,0 +1,239 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"github.com/shiguredo/sora-archive-uploader/s3"
+)
+
+// 退避ディレクトリの保持ポリシー
+// 0 の場合は制限しない
+type retentionPolicy struct {
+	maxAge       time.Duration
+	maxTotalSize int64
+	// 空き容量が不足している間は true を返す
+	pressure func() bool
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.maxAge > 0 || p.maxTotalSize > 0 || p.pressure != nil
+}
+
+// 退避ディレクトリ内の録画ディレクトリ
+type evacuatedRecording struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c Config) evacuateRetentionPolicy() retentionPolicy {
+	return retentionPolicy{
+		maxAge:       time.Duration(c.EvacuateRetentionMaxAgeH) * time.Hour,
+		maxTotalSize: c.EvacuateRetentionMaxTotalSizeMB * 1024 * 1024,
+	}
+}
+
+// すべての退避ディレクトリに保持ポリシーを適用する
+func purgeEvacuateDirectories(config *Config, policy retentionPolicy) {
+	if !policy.enabled() {
+		return
+	}
+	for _, root := range config.ArchiveRoots {
+		purgeEvacuateDirectory(root.EvacuateDirFullPath, config.archiveDirMaxDepth(), policy)
+	}
+}
+
+// 保持期間を過ぎた録画ディレクトリを削除し、合計サイズが上限を超えている場合や空き容量が不足している場合は古いものから削除する
+func purgeEvacuateDirectory(evacuateDir string, maxDepth int, policy retentionPolicy) {
+	recordings, err := collectEvacuatedRecordings(evacuateDir, maxDepth)
+	if err != nil {
+		zlog.Error().
+			Err(err).
+			Str("evacuate_dir_path", evacuateDir).
+			Msg("FAILED-COLLECT-EVACUATED-RECORDINGS")
+		return
+	}
+	// 古い順に並べる
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+
+	var totalSize int64
+	for _, r := range recordings {
+		totalSize += r.size
+	}
+
+	now := time.Now()
+	for _, r := range recordings {
+		var reason string
+		if policy.maxAge > 0 && now.Sub(r.modTime) > policy.maxAge {
+			reason = "max-age"
+		} else if policy.maxTotalSize > 0 && totalSize > policy.maxTotalSize {
+			reason = "max-total-size"
+		} else if policy.pressure != nil && policy.pressure() {
+			reason = "disk-pressure"
+		} else {
+			// 古い順に並べているため、残りの録画ディレクトリも削除の対象にならない
+			break
+		}
+		if err := removeEvacuatedRecording(evacuateDir, r.path); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", r.path).
+				Str("reason", reason).
+				Msg("FAILED-REMOVE-EVACUATED-RECORDING")
+			continue
+		}
+		totalSize -= r.size
+		zlog.Info().
+			Str("path", r.path).
+			Str("reason", reason).
+			Int64("size", r.size).
+			Time("modified_at", r.modTime).
+			Int64("total_size", totalSize).
+			Msg("REMOVED-EVACUATED-RECORDING")
+	}
+}
+
+// 退避ディレクトリ内の録画ディレクトリを集める
+// サブディレクトリを持たないディレクトリか、maxDepth の深さにあるディレクトリを録画ディレクトリとして扱う
+func collectEvacuatedRecordings(evacuateDir string, maxDepth int) ([]*evacuatedRecording, error) {
+	entries, err := os.ReadDir(evacuateDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return collectEvacuatedRecordingsInDir(evacuateDir, entries, 1, maxDepth), nil
+}
+
+func collectEvacuatedRecordingsInDir(parentDir string, entries []os.DirEntry, depth, maxDepth int) []*evacuatedRecording {
+	var result []*evacuatedRecording
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(parentDir, entry.Name())
+		if depth < maxDepth {
+			children, err := os.ReadDir(dirPath)
+			if err != nil {
+				continue
+			}
+			if hasSubDirectory(children) {
+				result = append(result, collectEvacuatedRecordingsInDir(dirPath, children, depth+1, maxDepth)...)
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, &evacuatedRecording{
+			path:    dirPath,
+			size:    directorySize(dirPath),
+			modTime: info.ModTime(),
+		})
+	}
+	return result
+}
+
+func hasSubDirectory(entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func directorySize(dirPath string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// 録画ディレクトリを削除し、空になった親ディレクトリを退避ディレクトリの直下まで削除する
+func removeEvacuatedRecording(evacuateDir, recordingDir string) error {
+	if err := os.RemoveAll(recordingDir); err != nil {
+		return err
+	}
+	evacuateDir = filepath.Clean(evacuateDir)
+	for dir := filepath.Dir(recordingDir); dir != evacuateDir && len(dir) > len(evacuateDir); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// アップロードしたオブジェクトのサイズと MD5 がローカルのファイルと一致することを確認する
+// remove_empty_recording_directory を有効にした場合は録画ディレクトリを退避せずに削除するため、
+// ローカルのファイルを削除する前に確認し、一致しない場合はアップロードに失敗したものとして扱う
+func (u Uploader) verifyUploadedObject(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, objectKey, filePath, md5Sum string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	var object minio.ObjectInfo
+	err = u.retryStorageOperation(ctx, "verify-uploaded-object", objectKey, func(ctx context.Context) error {
+		var err error
+		object, err = statObject(ctx, osConfig, objectKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if object.Size != info.Size() || objectMD5(object) != md5Sum {
+		zerolog.Ctx(ctx).Error().
+			Str("object_key", objectKey).
+			Str("file_path", filePath).
+			Int64("size", info.Size()).
+			Int64("object_size", object.Size).
+			Str("md5", md5Sum).
+			Str("object_md5", objectMD5(object)).
+			Msg("UPLOADED-OBJECT-MISMATCH")
+		return fmt.Errorf("uploaded object does not match local file: %s", objectKey)
+	}
+	return nil
+}
+
+// アップロードしたファイルを削除して空になった録画ディレクトリを削除する
+// ローカルのファイルはアップロードしたオブジェクトを確認してから削除しているため、ここでは確認しない
+// ファイルが残っている場合は削除せずに false を返す
+func removeEmptyRecordingDirectory(dirname string) bool {
+	entries, err := os.ReadDir(dirname)
+	if err != nil || len(entries) > 0 {
+		return false
+	}
+	if err := os.Remove(dirname); err != nil {
+		zlog.Error().
+			Err(err).
+			Str("path", dirname).
+			Msg("FAILED-REMOVE-EMPTY-RECORDING-DIRECTORY")
+		return false
+	}
+	zlog.Info().
+		Str("path", dirname).
+		Msg("REMOVED-EMPTY-RECORDING-DIRECTORY")
+	return true
+}
@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 録画ディレクトリに size バイトのファイルを作り、更新時刻を age だけ前にする
+func writeEvacuatedRecording(t *testing.T, dirPath string, size int, age time.Duration) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(dirPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dirPath, "archive-A.webm"), make([]byte, size), 0644))
+	modTime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(dirPath, modTime, modTime))
+}
+
+func TestPurgeEvacuateDirectoryMaxAge(t *testing.T) {
+	evacuateDir := t.TempDir()
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "2025-01-01", "REC1"), 10, 48*time.Hour)
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "2025-01-02", "REC2"), 10, time.Hour)
+
+	purgeEvacuateDirectory(evacuateDir, 2, retentionPolicy{maxAge: 24 * time.Hour})
+
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "2025-01-01", "REC1"))
+	// 空になった親ディレクトリも削除する
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "2025-01-01"))
+	assert.DirExists(t, filepath.Join(evacuateDir, "2025-01-02", "REC2"))
+	assert.DirExists(t, evacuateDir)
+}
+
+func TestPurgeEvacuateDirectoryMaxTotalSize(t *testing.T) {
+	evacuateDir := t.TempDir()
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC1"), 100, 3*time.Hour)
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC2"), 100, 2*time.Hour)
+	writeEvacuatedRecording(t, filepath.Join(evacuateDir, "REC3"), 100, time.Hour)
+
+	// 上限を下回るまで古いものから削除する
+	purgeEvacuateDirectory(evacuateDir, 1, retentionPolicy{maxTotalSize: 250})
+
+	assert.NoDirExists(t, filepath.Join(evacuateDir, "REC1"))
+	assert.DirExists(t, filepath.Join(evacuateDir, "REC2"))
+	assert.DirExists(t, filepath.Join(evacuateDir, "REC3"))
+}
+
+func TestRemoveEmptyRecordingDirectory(t *testing.T) {
+	root := t.TempDir()
+	emptyDir := filepath.Join(root, "REC1")
+	require.NoError(t, os.MkdirAll(emptyDir, 0755))
+	assert.True(t, removeEmptyRecordingDirectory(emptyDir))
+	assert.NoDirExists(t, emptyDir)
+
+	// ファイルが残っている場合は削除しない
+	recDir := filepath.Join(root, "REC2")
+	writeTestFile(t, filepath.Join(recDir, "archive-A.webm"))
+	assert.False(t, removeEmptyRecordingDirectory(recDir))
+	assert.FileExists(t, filepath.Join(recDir, "archive-A.webm"))
+}
+
+// PUT したオブジェクトのサイズと MD5 を HEAD で返すサーバー
+// corrupt が true の場合は HEAD で 1 バイト短いサイズを返す
+func newVerifyStorageServer(t *testing.T, corrupt bool) *httptest.Server {
+	var mutex sync.Mutex
+	objects := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			// バケットのリージョンの確認
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<LocationConstraint>us-east-1</LocationConstraint>`))
+		case http.MethodPut:
+			// 署名付きのチャンクで送信するため、元のサイズはヘッダーで確認する
+			_, _ = io.Copy(io.Discard, r.Body)
+			size, _ := strconv.Atoi(r.Header.Get("X-Amz-Decoded-Content-Length"))
+			if size == 0 {
+				size = int(r.ContentLength)
+			}
+			if corrupt {
+				size--
+			}
+			header := http.Header{}
+			header.Set("Content-Length", strconv.Itoa(size))
+			header.Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+			header.Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			header.Set("X-Amz-Meta-Md5", r.Header.Get("X-Amz-Meta-Md5"))
+			objects[r.URL.Path] = header
+			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		case http.MethodHead:
+			header, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestVerifyUploadedObject(t *testing.T) {
+	jsonFilePath := filepath.Join(t.TempDir(), "REC1", "archive-A.json")
+	writeTestFile(t, jsonFilePath)
+
+	server := newVerifyStorageServer(t, false)
+	config := &Config{
+		ObjectStorageEndpoint:         server.URL,
+		ObjectStorageBucketName:       "bucket",
+		ObjectStorageAccessKeyID:      "access-key-id",
+		ObjectStorageSecretAccessKey:  "secret-access-key",
+		RemoveEmptyRecordingDirectory: true,
+	}
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+	_, err = u.uploadJSONFile(context.Background(), config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.NoError(t, err)
+
+	// アップロードしたオブジェクトがローカルのファイルと一致しない場合は失敗する
+	server = newVerifyStorageServer(t, true)
+	config.ObjectStorageEndpoint = server.URL
+	_, err = u.uploadJSONFile(context.Background(), config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.Error(t, err)
+
+	// remove_empty_recording_directory を使わない場合は確認しない
+	config.RemoveEmptyRecordingDirectory = false
+	_, err = u.uploadJSONFile(context.Background(), config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.NoError(t, err)
+}
@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/rs/zerolog"
+)
+
+const (
+	DefaultStorageRetryIntervalInitialMS = 1000
+	DefaultStorageRetryIntervalMaxMS     = 30000
+)
+
+// 混雑していることを示す S3 のエラーコード
+var throttlingErrorCodes = map[string]bool{
+	"SlowDown":             true,
+	"SlowDownWrite":        true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"RequestThrottled":     true,
+}
+
+// retries 回目のリトライまでの待ち時間を返す
+// storage_retry_interval_initial_ms から倍々に増やし、半分をランダムにする
+func (c Config) storageRetryInterval(retries int) time.Duration {
+	initial := time.Duration(c.StorageRetryIntervalInitialMS) * time.Millisecond
+	if initial <= 0 {
+		initial = DefaultStorageRetryIntervalInitialMS * time.Millisecond
+	}
+	maxInterval := c.storageRetryIntervalMax()
+	interval := initial
+	for i := 1; i < retries && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	interval = min(interval, maxInterval)
+	return interval/2 + rand.N(interval/2+1)
+}
+
+func (c Config) storageRetryIntervalMax() time.Duration {
+	if c.StorageRetryIntervalMaxMS <= 0 {
+		return DefaultStorageRetryIntervalMaxMS * time.Millisecond
+	}
+	return time.Duration(c.StorageRetryIntervalMaxMS) * time.Millisecond
+}
+
+// 失敗した操作を同じ実行中にリトライするか判断し、待ち時間を返す
+// retry-now に分類したエラーと、混雑している場合の retry-later に分類したエラーをリトライする
+// Retry-After ヘッダーで指定された待ち時間が storage_retry_interval_max_ms を超える場合はリトライしない
+func (c Config) storageRetryWait(classification ErrorClassification, err error, retries int, retryAfter time.Duration) (time.Duration, bool) {
+	switch classification.Class {
+	case ErrorClassRetryNow:
+	case ErrorClassRetryLater:
+		if retryAfter <= 0 && !isThrottlingError(err) {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	if retryAfter > c.storageRetryIntervalMax() {
+		return 0, false
+	}
+	return max(c.storageRetryInterval(retries), retryAfter), true
+}
+
+func isThrottlingError(err error) bool {
+	var errResp minio.ErrorResponse
+	if !errors.As(err, &errResp) {
+		return false
+	}
+	return throttlingErrorCodes[errResp.Code] ||
+		errResp.StatusCode == http.StatusTooManyRequests ||
+		errResp.StatusCode == http.StatusServiceUnavailable
+}
+
+// ファイルごとの同じ実行中にリトライできる残り回数
+type storageRetryBudget struct {
+	mutex     sync.Mutex
+	remaining int
+}
+
+type storageRetryBudgetKey struct{}
+
+func contextWithStorageRetryBudget(ctx context.Context, budget int) context.Context {
+	return context.WithValue(ctx, storageRetryBudgetKey{}, &storageRetryBudget{remaining: budget})
+}
+
+// 残り回数があれば 1 減らして true を返す
+func storageRetryBudgetTake(ctx context.Context) (int, bool) {
+	budget, ok := ctx.Value(storageRetryBudgetKey{}).(*storageRetryBudget)
+	if !ok {
+		return 0, false
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if budget.remaining <= 0 {
+		return 0, false
+	}
+	budget.remaining--
+	return budget.remaining, true
+}
+
+// レスポンスの Retry-After ヘッダーの待ち時間を記録する
+type retryAfterRecorder struct {
+	mutex      sync.Mutex
+	retryAfter time.Duration
+}
+
+type retryAfterRecorderKey struct{}
+
+func (r *retryAfterRecorder) get() time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.retryAfter
+}
+
+// リクエストのコンテキストに retryAfterRecorder があれば、Retry-After ヘッダーを記録する
+type retryAfterTransport struct {
+	http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	recorder, ok := req.Context().Value(retryAfterRecorderKey{}).(*retryAfterRecorder)
+	if !ok {
+		return res, err
+	}
+	if d, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+		recorder.mutex.Lock()
+		recorder.retryAfter = d
+		recorder.mutex.Unlock()
+	}
+	return res, err
+}
+
+// Retry-After ヘッダーの秒数または HTTP 日付を待ち時間にする
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(value); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// オブジェクトストレージの操作に失敗した場合、ファイルごとの残り回数の範囲で同じ実行中にリトライする
+func (u Uploader) retryStorageOperation(ctx context.Context, operation, objectKey string, op func(context.Context) error) error {
+	for retries := 1; ; retries++ {
+		recorder := &retryAfterRecorder{}
+		err := op(context.WithValue(ctx, retryAfterRecorderKey{}, recorder))
+		if err == nil || ctx.Err() != nil || u.config.StorageRetryBudget <= 0 {
+			return err
+		}
+		classification := u.config.classifyError(err)
+		wait, ok := u.config.storageRetryWait(classification, err, retries, recorder.get())
+		if !ok {
+			return err
+		}
+		remaining, ok := storageRetryBudgetTake(ctx)
+		if !ok {
+			zerolog.Ctx(ctx).Warn().
+				Str("operation", operation).
+				Str("object_key", objectKey).
+				Int("retries", retries-1).
+				Msg("STORAGE-RETRY-BUDGET-EXHAUSTED")
+			return err
+		}
+		zerolog.Ctx(ctx).Warn().
+			Err(err).
+			Str("operation", operation).
+			Str("object_key", objectKey).
+			Str("error_reason", classification.Reason).
+			Str("error_class", classification.Class).
+			Int("retries", retries).
+			Int("remaining_retries", remaining).
+			Int64("wait_ms", wait.Milliseconds()).
+			Msg("RETRY-STORAGE-OPERATION")
+		observeStorageRetry(operation, classification)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
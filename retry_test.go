@@ -0,0 +1,231 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("3", now)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, d)
+	d, ok = parseRetryAfter("Wed, 01 Jan 2025 00:00:10 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, d)
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+}
+
+func TestStorageRetryWait(t *testing.T) {
+	config := &Config{StorageRetryIntervalInitialMS: 100, StorageRetryIntervalMaxMS: 1000}
+
+	// 倍々に増やし、半分をランダムにする
+	for range 10 {
+		interval := config.storageRetryInterval(1)
+		assert.GreaterOrEqual(t, interval, 50*time.Millisecond)
+		assert.LessOrEqual(t, interval, 100*time.Millisecond)
+		interval = config.storageRetryInterval(3)
+		assert.GreaterOrEqual(t, interval, 200*time.Millisecond)
+		assert.LessOrEqual(t, interval, 400*time.Millisecond)
+		interval = config.storageRetryInterval(10)
+		assert.GreaterOrEqual(t, interval, 500*time.Millisecond)
+		assert.LessOrEqual(t, interval, 1000*time.Millisecond)
+	}
+
+	timeout := errors.New("timeout")
+	_, ok := config.storageRetryWait(ErrorClassification{Reason: ErrorReasonTimeout, Class: ErrorClassRetryNow}, timeout, 1, 0)
+	assert.True(t, ok)
+
+	// Retry-After の待ち時間を優先する
+	wait, ok := config.storageRetryWait(ErrorClassification{Reason: ErrorReasonTimeout, Class: ErrorClassRetryNow}, timeout, 1, 800*time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, 800*time.Millisecond, wait)
+	_, ok = config.storageRetryWait(ErrorClassification{Reason: ErrorReasonTimeout, Class: ErrorClassRetryNow}, timeout, 1, 2*time.Second)
+	assert.False(t, ok)
+
+	// retry-later は混雑している場合だけリトライする
+	slowDown := minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}
+	_, ok = config.storageRetryWait(config.classifyError(slowDown), slowDown, 1, 0)
+	assert.True(t, ok)
+	skewed := minio.ErrorResponse{Code: "RequestTimeTooSkewed", StatusCode: http.StatusForbidden}
+	_, ok = config.storageRetryWait(config.classifyError(skewed), skewed, 1, 0)
+	assert.False(t, ok)
+	_, ok = config.storageRetryWait(config.classifyError(skewed), skewed, 1, 100*time.Millisecond)
+	assert.True(t, ok)
+
+	noSuchBucket := minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: http.StatusNotFound}
+	_, ok = config.storageRetryWait(config.classifyError(noSuchBucket), noSuchBucket, 1, 0)
+	assert.False(t, ok)
+}
+
+// 最初の failures 回の PUT を失敗させるオブジェクトストレージ
+func newFlakyStorageServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	var puts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// バケットのリージョンの確認
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<LocationConstraint>us-east-1</LocationConstraint>`))
+			return
+		}
+		if puts.Add(1) <= failures {
+			w.Header().Set("Content-Type", "application/xml")
+			// minio のクライアント内のリトライの対象にならないエラーコードとステータスコードで返す
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<Error><Code>TransientError</Code><Message>Please try again.</Message></Error>`))
+			return
+		}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	}))
+	t.Cleanup(server.Close)
+	return server, &puts
+}
+
+func TestRetryStorageOperation(t *testing.T) {
+	jsonFilePath := filepath.Join(t.TempDir(), "REC1", "archive-A.json")
+	writeTestFile(t, jsonFilePath)
+
+	server, puts := newFlakyStorageServer(t, 2)
+	config := &Config{
+		ObjectStorageEndpoint:         server.URL,
+		ObjectStorageBucketName:       "bucket",
+		ObjectStorageAccessKeyID:      "access-key-id",
+		ObjectStorageSecretAccessKey:  "secret-access-key",
+		StorageRetryBudget:            2,
+		StorageRetryIntervalInitialMS: 1,
+		StorageRetryIntervalMaxMS:     10,
+		ErrorClassOverrides:           map[string]string{"transienterror": ErrorClassRetryNow},
+	}
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+	ctx := contextWithStorageRetryBudget(context.Background(), config.StorageRetryBudget)
+	fileURL, err := u.uploadJSONFile(ctx, config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.NoError(t, err)
+	assert.Equal(t, "s3://bucket/REC1/archive-A.json", fileURL)
+	assert.Equal(t, int32(3), puts.Load())
+
+	// ファイルごとの残り回数を使い切ったらリトライしない
+	server, puts = newFlakyStorageServer(t, 2)
+	config.ObjectStorageEndpoint = server.URL
+	config.StorageRetryBudget = 1
+	ctx = contextWithStorageRetryBudget(context.Background(), config.StorageRetryBudget)
+	_, err = u.uploadJSONFile(ctx, config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.Error(t, err)
+	assert.Equal(t, "TransientError", minio.ToErrorResponse(err).Code)
+	assert.Equal(t, int32(2), puts.Load())
+
+	// 0 の場合はリトライしない
+	server, puts = newFlakyStorageServer(t, 1)
+	config.ObjectStorageEndpoint = server.URL
+	config.StorageRetryBudget = 0
+	_, err = u.uploadJSONFile(context.Background(), config.objectStorageConfig(), "REC1/archive-A.json", jsonFilePath)
+	require.Error(t, err)
+	assert.Equal(t, int32(1), puts.Load())
+}
+
+// 最初の failures 回のパートの PUT を失敗させる multipart アップロードに対応したオブジェクトストレージ
+func newFlakyMultipartStorageServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32, *atomic.Int32) {
+	var parts, aborts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/xml")
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodGet:
+			// バケットのリージョンの確認
+			w.Write([]byte(`<LocationConstraint>us-east-1</LocationConstraint>`))
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			w.Write([]byte(`<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>REC1/archive-A.webm</Key><UploadId>U1</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			if parts.Add(1) <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+				return
+			}
+			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			w.Write([]byte(`<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>REC1/archive-A.webm</Key><ETag>"d41d8cd98f00b204e9800998ecf8427e-2"</ETag></CompleteMultipartUploadResult>`))
+		case r.Method == http.MethodDelete:
+			aborts.Add(1)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &parts, &aborts
+}
+
+func TestRetryStorageOperationMultipartMediaFile(t *testing.T) {
+	mediaFilePath := filepath.Join(t.TempDir(), "REC1", "archive-A.webm")
+	writeTestFile(t, mediaFilePath)
+	require.NoError(t, os.Truncate(mediaFilePath, multipartUploadThreshold+1))
+
+	server, parts, aborts := newFlakyMultipartStorageServer(t, 1)
+	config := &Config{
+		ObjectStorageEndpoint:         server.URL,
+		ObjectStorageBucketName:       "bucket",
+		ObjectStorageAccessKeyID:      "access-key-id",
+		ObjectStorageSecretAccessKey:  "secret-access-key",
+		StorageRetryBudget:            2,
+		StorageRetryIntervalInitialMS: 1,
+		StorageRetryIntervalMaxMS:     10,
+	}
+	u, err := newUploader(1, config)
+	require.NoError(t, err)
+	// 失敗したパートだけを送信し直す
+	ctx := contextWithStorageRetryBudget(context.Background(), config.StorageRetryBudget)
+	fileURL, err := u.uploadMediaFile(ctx, config.objectStorageConfig(), "REC1/archive-A.webm", mediaFilePath)
+	require.NoError(t, err)
+	assert.Equal(t, "s3://bucket/REC1/archive-A.webm", fileURL)
+	assert.Equal(t, int32(3), parts.Load())
+	assert.Equal(t, int32(0), aborts.Load())
+
+	// 残り回数を使い切った場合は multipart アップロードを中止する
+	server, parts, aborts = newFlakyMultipartStorageServer(t, 10)
+	config.ObjectStorageEndpoint = server.URL
+	config.StorageRetryBudget = 1
+	ctx = contextWithStorageRetryBudget(context.Background(), config.StorageRetryBudget)
+	_, err = u.uploadMediaFile(ctx, config.objectStorageConfig(), "REC1/archive-A.webm", mediaFilePath)
+	require.Error(t, err)
+	assert.Equal(t, "SlowDown", minio.ToErrorResponse(err).Code)
+	assert.Equal(t, int32(1), aborts.Load())
+}
+
+func TestStorageClientMaxRetries(t *testing.T) {
+	// 同じ実行中にリトライする場合は、クライアントライブラリ内ではリトライしない
+	assert.Equal(t, 1, Config{StorageRetryBudget: 3, StorageClientMaxRetries: 5}.storageClientMaxRetries())
+	assert.Equal(t, 5, Config{StorageClientMaxRetries: 5}.storageClientMaxRetries())
+	assert.Equal(t, 0, Config{}.storageClientMaxRetries())
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &retryAfterTransport{RoundTripper: http.DefaultTransport}}
+	recorder := &retryAfterRecorder{}
+	ctx := context.WithValue(context.Background(), retryAfterRecorderKey{}, recorder)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, server.URL, nil)
+	require.NoError(t, err)
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 3*time.Second, recorder.get())
+}
@@ -2,55 +2,173 @@ package archive
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
 )
 
+// アーカイブディレクトリや退避ディレクトリを利用できない
+// タイマーモードでは設定の誤りとして終了し、常駐モードでは次の探索で再度確認する
+var errArchiveDirUnavailable = errors.New("archive directory unavailable")
+
 type Main struct {
-	config *Config
+	// SIGHUP で再読み込みした設定に置き換える
+	config atomic.Pointer[Config]
+	// 処理中の GateKeeper
+	gateKeeper atomic.Pointer[GateKeeper]
+	// 常駐モードで次の探索を待たずに探索する
+	rescan chan struct{}
 }
 
 func newMain(config *Config) *Main {
-	return &Main{
-		config: config,
+	m := &Main{
+		rescan: make(chan struct{}, 1),
 	}
+	m.config.Store(config)
+	return m
 }
 
-func (m *Main) run(ctx context.Context, cancel context.CancelFunc) error {
-	var archiveDir = m.config.SoraArchiveDirFullPath
-	zlog.Debug().Str("path", archiveDir).Msg("WATCHING-ROOT-DIR")
-	fileInfo, err := os.Stat(archiveDir)
-	if err != nil {
-		// 対象のディレクトリが存在しなければ終わる
-		zlog.Fatal().Err(err).Str("path", archiveDir).Msg("NOT-FOUND-TARGET-PATH")
+// 現在の設定を返す
+// 再読み込みした設定は次の探索から使う
+func (m *Main) currentConfig() *Config {
+	return m.config.Load()
+}
+
+func (m *Main) requestRescan() {
+	select {
+	case m.rescan <- struct{}{}:
+	default:
 	}
-	if !fileInfo.IsDir() {
-		// 対象のパスが Directory でなければ終わる
-		zlog.Fatal().Str("path", archiveDir).Msg("TARGET-PATH-DOES-NOT-DIRECTORY")
+}
+
+func (m *Main) recordingStates() []*RecordingState {
+	gateKeeper := m.gateKeeper.Load()
+	if gateKeeper == nil {
+		return []*RecordingState{}
 	}
-	// TODO: パーミッションチェック
+	return gateKeeper.recordingStates()
+}
 
-	// ディレクトリ退避先を作成する
-	var evacuatePath = m.config.SoraEvacuateDirFullPath
-	_, err = os.Stat(m.config.SoraEvacuateDirFullPath)
-	if err != nil {
-		err = os.Mkdir(evacuatePath, 0755)
+func (m *Main) run(ctx context.Context, cancel context.CancelFunc) error {
+	baseConfig := m.currentConfig()
+	if len(baseConfig.ArchiveRoots) == 0 {
+		// 監視対象のディレクトリが 1 つも設定されていなければ終わる
+		zlog.Error().Msg("ARCHIVE-DIR-NOT-CONFIGURED")
+		return errArchiveDirUnavailable
+	}
+	for _, root := range baseConfig.ArchiveRoots {
+		var archiveDir = root.ArchiveDirFullPath
+		zlog.Debug().
+			Str("name", root.Name).
+			Str("path", archiveDir).
+			Msg("WATCHING-ROOT-DIR")
+		fileInfo, err := os.Stat(archiveDir)
 		if err != nil {
-			zlog.Fatal().
-				Str("evacuate_dir_path", evacuatePath).
-				Msg("CANT-CREATE-DIRECTORY")
+			// 対象のディレクトリが存在しなければ終わる
+			zlog.Error().Err(err).Str("path", archiveDir).Msg("NOT-FOUND-TARGET-PATH")
+			return fmt.Errorf("%w: %w", errArchiveDirUnavailable, err)
+		}
+		if !fileInfo.IsDir() {
+			// 対象のパスが Directory でなければ終わる
+			zlog.Error().Str("path", archiveDir).Msg("TARGET-PATH-DOES-NOT-DIRECTORY")
+			return fmt.Errorf("%w: not a directory: %s", errArchiveDirUnavailable, archiveDir)
 		}
+		// アップロードしたファイルの削除と録画ディレクトリの移動ができるか確認する
+		if err := unix.Access(archiveDir, unix.R_OK|unix.W_OK|unix.X_OK); err != nil {
+			zlog.Error().Err(err).Str("path", archiveDir).Msg("TARGET-PATH-PERMISSION-DENIED")
+			return fmt.Errorf("%w: %s: %w", errArchiveDirUnavailable, archiveDir, err)
+		}
+
+		// ディレクトリ退避先を作成する
+		var evacuatePath = root.EvacuateDirFullPath
+		_, err = os.Stat(evacuatePath)
+		if err != nil {
+			err = os.MkdirAll(evacuatePath, 0755)
+			if err != nil {
+				zlog.Error().
+					Err(err).
+					Str("evacuate_dir_path", evacuatePath).
+					Msg("CANT-CREATE-DIRECTORY")
+				return fmt.Errorf("%w: %w", errArchiveDirUnavailable, err)
+			}
+		}
+	}
+
+	// 退避ディレクトリの保持ポリシーを適用する
+	purgeEvacuateDirectories(baseConfig, baseConfig.evacuateRetentionPolicy())
+
+	// 空き容量が不足している場合は緊急モードの設定で処理する
+	config := baseConfig
+	diskPressures := checkDiskPressure(baseConfig)
+	handleDiskPressure(baseConfig, diskPressures)
+	if len(diskPressures) > 0 {
+		config = baseConfig.diskPressureConfig()
 	}
 
-	foundFiles, err := runFileFinder(archiveDir)
+	foundFiles, err := runFileFinder(config)
+	if err != nil {
+		return err
+	}
+	pruneFilterDecisions()
+	// 他のプロセスが処理中の録画ディレクトリは処理しない
+	allFiles := foundFiles
+	var locks *recordingLocks
+	if config.RecordingLockDirFullPath != "" {
+		locks = newRecordingLocks()
+		defer locks.releaseAll()
+		foundFiles = locks.filterLockedFiles(config, foundFiles)
+	}
+	// 放置された録画ディレクトリを検出する
+	// 他のプロセスが処理中の録画ディレクトリを放置されたものとして扱わないように、ロック前のファイルを渡す
+	stuckRecordings, err := detectStuckRecordings(config, allFiles)
 	if err != nil {
 		return err
 	}
+	// 放置された録画ディレクトリを移動またはアップロードする場合は、report ファイルを処理して退避しないように通常の処理から外す
+	if config.stuckRecordingAction() != StuckRecordingActionReport {
+		foundFiles = excludeStuckRecordings(foundFiles, stuckRecordings)
+	}
+	// 失敗した録画ディレクトリは待ち時間を空けてから処理し、失敗した回数が上限に達したものは移動する
+	foundFiles = applyUploadAttempts(config, foundFiles)
+	if len(diskPressures) > 0 {
+		// 空き容量を早く確保するため、サイズの大きい録画ディレクトリから処理する
+		foundFiles = sortByRecordingSize(foundFiles)
+	}
+	observePendingFiles(foundFiles)
+	runSummary.recordingsFound(foundFiles)
+	uploadStatus.setQueue(foundFiles)
+	defer uploadStatus.clearQueue()
+
+	// 放置された録画ディレクトリを処理する
+	if len(stuckRecordings) > 0 {
+		uploader, err := newUploader(0, config)
+		if err != nil {
+			return err
+		}
+		// 停止シグナルを受け取った場合はアップロードを中断する
+		stop := context.AfterFunc(ctx, uploader.Stop)
+		for _, sr := range stuckRecordings {
+			if ctx.Err() != nil {
+				break
+			}
+			if locks != nil && !locks.tryLock(config, sr.DirPath) {
+				continue
+			}
+			uploader.handleStuckRecording(sr)
+		}
+		stop()
+		uploader.Stop()
+	}
+
 	if len(foundFiles) == 0 {
 		// 処理対象のファイルが見つからなかったので終わる
 		cancel()
@@ -58,80 +176,221 @@ func (m *Main) run(ctx context.Context, cancel context.CancelFunc) error {
 		return nil
 	}
 
+	return m.process(ctx, cancel, config, foundFiles)
+}
+
+// 見つかったファイルを GateKeeper で順番を制御しながらアップローダーで処理する
+// すべてのファイルの処理が終わったら cancel を呼び出す
+// shutdown_drain_timeout_s が設定されている場合、停止シグナルを受け取ると新しいファイルの受け取りを止め、
+// 処理中のファイルとウェブフックの送信が終わるまで待ってから停止する
+func (m *Main) process(ctx context.Context, cancel context.CancelFunc, config *Config, foundFiles []string) error {
 	processContext, processContextCancel := context.WithCancel(context.Background())
-	gateKeeper := newGateKeeper(m.config)
+	acceptContext, acceptContextCancel := context.WithCancel(processContext)
+	defer acceptContextCancel()
+	gateKeeper := newGateKeeper(config)
+	m.gateKeeper.Store(gateKeeper)
+	defer m.gateKeeper.Store(nil)
 	recordingFileStream := gateKeeper.run(processContext, foundFiles)
 
 	uploaderManager := newUploaderManager()
-	_, err = uploaderManager.run(processContext, m.config, recordingFileStream)
+	_, err := uploaderManager.run(processContext, acceptContext, config, gateKeeper.traceContext, gateKeeper.recordingFilter, recordingFileStream)
 	if err != nil {
 		processContextCancel()
 		return err
 	}
 
+	// 処理中のファイルを中断して停止する
+	abort := func() error {
+		processContextCancel()
+		// 停止ログ出力待ちのため、500ms 待ってから停止している
+		<-time.After(500 * time.Millisecond)
+		return nil
+	}
+	// すべてのファイルの処理が終わって cancel を呼び出した
+	var finished bool
+	done := ctx.Done()
+	var drainTimeout <-chan time.Time
+	var uploadersStopped <-chan struct{}
+	finish := func() {
+		if gateKeeper.isFileUploadFinished() {
+			finished = true
+			cancel()
+		}
+	}
+
 	for {
 		select {
-		case <-ctx.Done():
-			processContextCancel()
-			// 停止ログ出力待ちのため、500ms 待ってから停止している
-			<-time.After(500 * time.Millisecond)
-			return nil
+		case <-done:
+			if finished {
+				return abort()
+			}
+			drainTimeoutS := config.ShutdownDrainTimeoutS
+			if drainTimeoutS <= 0 {
+				m.logShutdownSummary(ShutdownReasonAborted)
+				return abort()
+			}
+			zlog.Info().
+				Int("in_flight_files", uploadStatus.inFlightCount()).
+				Int("drain_timeout_s", drainTimeoutS).
+				Msg("SHUTDOWN-DRAIN-STARTED")
+			done = nil
+			acceptContextCancel()
+			uploadersStopped = uploaderManager.stopped
+			drainTimeout = time.After(time.Duration(drainTimeoutS) * time.Second)
+		case <-uploadersStopped:
+			m.logShutdownSummary(ShutdownReasonDrained)
+			return abort()
+		case <-drainTimeout:
+			zlog.Warn().
+				Int("in_flight_files", uploadStatus.inFlightCount()).
+				Msg("SHUTDOWN-DRAIN-TIMEOUT")
+			m.logShutdownSummary(ShutdownReasonDrainTimeout)
+			return abort()
 		case archiveFileResult := <-uploaderManager.ArchiveStream:
+			gateKeeper.countResult(archiveFileResult)
+			recordUploadResult(config, archiveFileResult)
 			if !archiveFileResult.Success {
 				zlog.Warn().
 					Str("archive_file", archiveFileResult.Filepath).
-					Msg("FAILED-UPLOAD-ARCHIVE-END")
+					Str("error_reason", archiveFileResult.ErrorReason).
+					Str("error_class", archiveFileResult.ErrorClass).
+					Str("attempt_id", archiveFileResult.AttemptID).
+					Msg("FAILED-UPLOAD-ARCHIVE")
 			}
 			// zlog.Info().
 			// 	Str("archive_file", archiveFileResult.Filepath).
 			// 	Msg("UPLOADED-ARCHIVE-FILE")
-			gateKeeper.processDone(archiveFileResult.Filepath)
-			if gateKeeper.isFileUploadFinished() {
-				cancel()
-			}
+			gateKeeper.processDone(archiveFileResult.Filepath, archiveFileResult.Success)
+			finish()
 		case archiveEndFileResult := <-uploaderManager.ArchiveEndStream:
+			gateKeeper.countResult(archiveEndFileResult)
+			recordUploadResult(config, archiveEndFileResult)
 			if !archiveEndFileResult.Success {
 				zlog.Warn().
 					Str("archive_end_file", archiveEndFileResult.Filepath).
+					Str("error_reason", archiveEndFileResult.ErrorReason).
+					Str("error_class", archiveEndFileResult.ErrorClass).
+					Str("attempt_id", archiveEndFileResult.AttemptID).
 					Msg("FAILED-UPLOAD-ARCHIVE-END")
 			}
 			// zlog.Info().
 			// 	Str("archive_end_file", archiveEndFileResult.Filepath).
 			// 	Msg("UPLOADED-ARCHIVE-END-FILE")
-			gateKeeper.processDone(archiveEndFileResult.Filepath)
-			if gateKeeper.isFileUploadFinished() {
-				cancel()
-			}
+			gateKeeper.processDone(archiveEndFileResult.Filepath, archiveEndFileResult.Success)
+			finish()
+		case reportFile := <-gateKeeper.skippedReports:
+			gateKeeper.skipReport(reportFile)
+			finish()
 		case reportFileResult := <-uploaderManager.ReportStream:
+			gateKeeper.countResult(reportFileResult)
+			recordUploadResult(config, reportFileResult)
 			if !reportFileResult.Success {
 				zlog.Warn().
 					Str("report_file", reportFileResult.Filepath).
-					Msg("FAILED-UPLOAD-ARCHIVE-END")
+					Str("error_reason", reportFileResult.ErrorReason).
+					Str("error_class", reportFileResult.ErrorClass).
+					Str("attempt_id", reportFileResult.AttemptID).
+					Msg("FAILED-UPLOAD-REPORT")
 			}
 			// zlog.Info().
 			// 	Str("report_file", reportFileResult.Filepath).
 			// 	Msg("UPLOADED-REPORT-FILE")
-			gateKeeper.recordingDone(reportFileResult.Filepath)
-			if gateKeeper.isFileUploadFinished() {
-				cancel()
+			if reportFileResult.Excluded {
+				// フィルタで除外された録画は退避ディレクトリに移動しない
+				gateKeeper.recordingExcluded(reportFileResult.Filepath)
+			} else {
+				gateKeeper.recordingDone(reportFileResult.Filepath)
 			}
+			finish()
 		}
 	}
 }
 
+// scan_interval_s の間隔でアーカイブディレクトリの探索とアップロードを繰り返す
+// アーカイブディレクトリが一時的に見つからない場合などの探索の失敗は、ログに出力して次の探索で再度処理する
+// 停止シグナルを受け取るまで戻らない
+func (m *Main) runResident(ctx context.Context) {
+	// scan_interval_s は再読み込みしない
+	interval := time.Duration(m.currentConfig().ScanIntervalS) * time.Second
+	for {
+		runCtx, runCancel := context.WithCancel(ctx)
+		runSummary.start("resident")
+		err := m.run(runCtx, runCancel)
+		runCancel()
+		// 常駐モードでは録画ディレクトリが見つかった探索のみ出力する
+		if summary := runSummary.finish(); summary.RecordingsFound > 0 {
+			reportRunSummary(m.currentConfig(), summary)
+		}
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Dur("next_scan_in", interval).
+				Msg("FAILED-RESIDENT-SCAN")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.rescan:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// 処理結果に応じた終了コードで終了する
 func Run(configFilePath *string) {
+	if exitCode := run(configFilePath); exitCode != ExitCodeSuccess {
+		os.Exit(exitCode)
+	}
+}
+
+// 終了コードを返す
+// 終了前にトレースの送信とロックの解放を行うため、os.Exit は呼び出し側で行う
+func run(configFilePath *string) int {
+	// 起動時の確認で Fatal になった場合は設定の誤りとして終了する
+	zerolog.FatalExitFunc = func() {
+		os.Exit(ExitCodeConfigError)
+	}
+
 	// INI をパース
 	config, err := newConfig(*configFilePath)
 	if err != nil {
-		// パースに失敗した場合 Fatal で終了
-		log.Fatal("cannot parse config file, err=", err)
+		// パースに失敗した場合は終了
+		log.Print("cannot parse config file, err=", err)
+		return ExitCodeConfigError
+	}
+	// 起動前にディレクトリの存在とパーミッションを確認する
+	if err := config.validateDirectories(); err != nil {
+		log.Print("invalid config, err=", err)
+		return ExitCodeConfigError
 	}
 
 	// ロガー初期化
 	err = initLogger(config)
 	if err != nil {
-		// ロガー初期化に失敗したら Fatal で終了
-		log.Fatal("cannot parse config file, err=", err)
+		// ロガー初期化に失敗したら終了
+		log.Print("cannot parse config file, err=", err)
+		return ExitCodeConfigError
+	}
+
+	// 環境変数やファイルから読み込んだ値を含めた設定を、秘密情報を伏せて出力する
+	zlog.Info().
+		Interface("config", config.redacted()).
+		Strs("env_overridden_keys", config.envOverriddenKeys).
+		Msg("LOADED-CONFIG")
+
+	// 多重起動を防ぐ
+	instanceLock, err := acquireInstanceLock(config)
+	if errors.Is(err, errLockHeld) {
+		zlog.Info().
+			Str("lock_file_path", config.LockFilePath).
+			Msg("ANOTHER-INSTANCE-RUNNING")
+		return ExitCodeNothingToDo
+	}
+	if err != nil {
+		zlog.Fatal().Err(err).Str("lock_file_path", config.LockFilePath).Msg("FAILED-ACQUIRE-INSTANCE-LOCK")
+	}
+	if instanceLock != nil {
+		defer instanceLock.release()
 	}
 
 	// もしあれば mTLS の設定確認と Webhook のヘルスチェック
@@ -151,6 +410,19 @@ func Run(configFilePath *string) {
 		resp.Body.Close()
 	}
 
+	// トレースの送信先が設定されていれば OTLP でスパンを送信する
+	shutdownTracer, err := initTracer(context.Background(), config)
+	if err != nil {
+		zlog.Fatal().Err(err).Msg("FAILED-INIT-TRACER")
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracer(ctx); err != nil {
+			zlog.Error().Err(err).Msg("FAILED-SHUTDOWN-TRACER")
+		}
+	}()
+
 	zlog.Debug().Msg("STARTED-SORA-ARCHIVE-UPLOADER")
 
 	// シグナルをキャッチして停止処理
@@ -161,26 +433,123 @@ func Run(configFilePath *string) {
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, trapSignals...)
 	ctx, cancel := context.WithCancel(context.Background())
-	doneShutdown := make(chan interface{})
-	defer close(doneShutdown)
+	// ディレクトリ監視とアップロード処理
+	m := newMain(config)
 	go func() {
 		sig := <-signalChannel
 		zlog.Debug().Str("signal", sig.String()).Msg("RECEIVED-SIGNAL")
 
 		cancel()
-		doneShutdown <- struct{}{}
+		// 処理中のファイルの完了を待っている間に再度シグナルを受け取ったらすぐに終了する
+		go func() {
+			sig := <-signalChannel
+			zlog.Warn().Str("signal", sig.String()).Msg("SHUTDOWN-FORCED")
+			m.logShutdownSummary(ShutdownReasonForced)
+			m.flushBeforeForcedExit(shutdownTracer)
+			os.Exit(ExitCodeError)
+		}()
 	}()
 
-	// ディレクトリ監視とアップロード処理
-	m := newMain(config)
-	if err := m.run(ctx, cancel); err != nil {
-		zlog.Error().Err(err).Msg("FAILED-RUN")
-		os.Exit(1)
+	// SIGHUP で設定を再読み込みする
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reloadChannel:
+				zlog.Info().Msg("RECEIVED-RELOAD-SIGNAL")
+				m.reload(*configFilePath)
+			}
+		}
+	}()
+	if config.AdminListenAddr != "" {
+		if err := runAdminServer(ctx, config, m, cancel); err != nil {
+			zlog.Fatal().Err(err).Str("listen_addr", config.AdminListenAddr).Msg("FAILED-START-ADMIN-SERVER")
+		}
+	}
+	var runErr error
+	// 常駐モードでは停止シグナルで終了した場合も成功として扱う
+	exitCode := ExitCodeSuccess
+	if config.ScanIntervalS > 0 {
+		// 常駐モードではメトリクスを HTTP で公開する
+		if config.MetricsListenAddr != "" {
+			if err := runMetricsServer(ctx, config.MetricsListenAddr); err != nil {
+				zlog.Fatal().Err(err).Str("listen_addr", config.MetricsListenAddr).Msg("FAILED-START-METRICS-SERVER")
+			}
+		}
+		m.runResident(ctx)
 	} else {
-		go func() {
-			doneShutdown <- struct{}{}
-		}()
+		if config.MetricsListenAddr != "" {
+			zlog.Warn().
+				Str("listen_addr", config.MetricsListenAddr).
+				Msg("METRICS-LISTENER-IGNORED-IN-TIMER-MODE")
+		}
+		runSummary.start("timer")
+		runErr = m.run(ctx, cancel)
+		summary := runSummary.finish()
+		reportRunSummary(m.currentConfig(), summary)
+		exitCode = summary.exitCode()
+		// タイマーモードではメトリクスをファイルに書き出す
+		if config.MetricsTextfilePath != "" {
+			writeMetricsTextfile(config.MetricsTextfilePath)
+		}
+	}
+	if runErr != nil {
+		zlog.Error().Err(runErr).Msg("FAILED-RUN")
+		if errors.Is(runErr, errArchiveDirUnavailable) {
+			return ExitCodeConfigError
+		}
+		return ExitCodeError
+	}
+	zlog.Debug().Int("exit_code", exitCode).Msg("STOPPED-SORA-ARCHIVE-UPLOADER")
+	return exitCode
+}
+
+// 隔離ディレクトリのファイルを元の録画ディレクトリに戻す
+func Requeue(configFilePath *string, targets []string) {
+	config, err := newConfig(*configFilePath)
+	if err != nil {
+		log.Fatal("cannot parse config file, err=", err)
+	}
+
+	err = initLogger(config)
+	if err != nil {
+		log.Fatal("cannot parse config file, err=", err)
+	}
+
+	if config.QuarantineDirFullPath == "" {
+		zlog.Fatal().Msg("QUARANTINE-DIR-NOT-CONFIGURED")
+	}
+
+	requeued, err := requeueQuarantinedFiles(config, targets)
+	if err != nil {
+		zlog.Error().Err(err).Msg("FAILED-REQUEUE")
+		os.Exit(1)
+	}
+	zlog.Info().
+		Strs("targets", targets).
+		Int("requeued", requeued).
+		Msg("REQUEUED-QUARANTINED-FILES")
+}
+
+// 実行した場合に行う処理を出力する
+// ストレージやウェブフック、ローカルのファイルには触れない
+func Plan(configFilePath *string, format string) {
+	config := loadCommandConfig(configFilePath)
+	// 処理内容を標準出力に出力するため、ログは標準エラー出力に出力する
+	if config.LogStdout {
+		zlog.Logger = zlog.Output(os.Stderr)
+	}
+
+	actions, err := planFiles(config)
+	if err != nil {
+		zlog.Error().Err(err).Msg("FAILED-PLAN")
+		os.Exit(ExitCodeError)
+	}
+	if err := writePlan(os.Stdout, actions, format); err != nil {
+		log.Print("cannot write plan, err=", err)
+		os.Exit(ExitCodeError)
 	}
-	<-doneShutdown
-	zlog.Debug().Msg("STOPPED-SORA-ARCHIVE-UPLOADER")
 }
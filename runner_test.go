@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunResidentContinuesAfterScanError(t *testing.T) {
+	root := t.TempDir()
+	archiveDir := filepath.Join(root, "archive")
+	evacuateDir := filepath.Join(root, "evacuate")
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: archiveDir, EvacuateDirFullPath: evacuateDir},
+		},
+		ScanIntervalS: 3600,
+	}
+	m := newMain(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		m.runResident(ctx)
+	}()
+
+	// アーカイブディレクトリが見つからなくても終了せずに次の探索を待つ
+	select {
+	case <-stopped:
+		t.Fatal("resident mode stopped after scan error")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.NoDirExists(t, evacuateDir)
+
+	// アーカイブディレクトリが戻った後の探索では処理を続ける
+	require.NoError(t, os.MkdirAll(archiveDir, 0755))
+	m.requestRescan()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(evacuateDir)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("resident mode did not stop")
+	}
+}
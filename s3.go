@@ -3,58 +3,164 @@ package archive
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
-	zlog "github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"github.com/shiguredo/sora-archive-uploader/s3"
 
 	"github.com/conduitio/bwlimit"
 )
 
-func uploadJSONFile(
-	ctx context.Context,
-	osConfig *s3.S3CompatibleObjectStorage,
-	dst, filePath string,
-) (string, error) {
-	var creds *credentials.Credentials
+func (c Config) objectStorageConfig() *s3.S3CompatibleObjectStorage {
+	return &s3.S3CompatibleObjectStorage{
+		Endpoint:        c.ObjectStorageEndpoint,
+		BucketName:      c.ObjectStorageBucketName,
+		AccessKeyID:     c.ObjectStorageAccessKeyID,
+		SecretAccessKey: c.ObjectStorageSecretAccessKey,
+		MaxRetries:      c.storageClientMaxRetries(),
+	}
+}
+
+// クライアントライブラリ内でリクエストをリトライする回数を返す
+// 同じ実行中のリトライを行う場合は、待ち時間や Retry-After ヘッダーの扱いをそちらに任せるため、クライアントライブラリ内ではリトライしない
+func (c Config) storageClientMaxRetries() int {
+	if c.StorageRetryBudget > 0 {
+		return 1
+	}
+	return c.StorageClientMaxRetries
+}
+
+// multipart アップロードするメディアファイルのサイズ
+// これより大きいファイルはパートごとにアップロードし、失敗したパートだけを送信し直す
+const multipartUploadThreshold = 16 * 1024 * 1024
+
+// 帯域を制限しない場合に並列でアップロードするパートの数
+const multipartUploadThreads = 4
+
+// 失敗した操作を同じ実行中にリトライする
+type storageRetryFunc func(ctx context.Context, operation string, op func(context.Context) error) error
+
+// アップロードしたファイルの MD5 を保存するユーザーメタデータのキー
+// x-amz-meta-md5 ヘッダーで送信する
+// multipart アップロードの ETag は MD5 ではないため、復元と監査ではこの値でチェックサムを検証する
+const objectMD5MetadataKey = "Md5"
+
+// オブジェクトの内容の MD5 を返す
+// ユーザーメタデータにない場合は、multipart アップロードでなければ ETag を使う
+// どちらもない場合は空文字を返す
+func objectMD5(object minio.ObjectInfo) string {
+	if sum := object.UserMetadata[objectMD5MetadataKey]; sum != "" {
+		return sum
+	}
+	etag := strings.Trim(object.ETag, `"`)
+	if strings.Contains(etag, "-") {
+		return ""
+	}
+	return etag
+}
+
+// アップロードするファイルの MD5 を保存するユーザーメタデータを返す
+func objectMD5Metadata(md5Sum string) map[string]string {
+	return map[string]string{objectMD5MetadataKey: md5Sum}
+}
+
+func objectURL(bucketName, objectKey string) string {
+	return fmt.Sprintf("s3://%s/%s", bucketName, objectKey)
+}
+
+// 設定、環境変数、IAM の順で認証情報を探す
+func newCredentials(osConfig *s3.S3CompatibleObjectStorage) *credentials.Credentials {
 	if (osConfig.AccessKeyID != "") || (osConfig.SecretAccessKey != "") {
-		creds = credentials.NewStaticV4(
+		return credentials.NewStaticV4(
 			osConfig.AccessKeyID,
 			osConfig.SecretAccessKey,
 			"",
 		)
 	} else if (len(os.Getenv("AWS_ACCESS_KEY_ID")) > 0) && (len(os.Getenv("AWS_SECRET_ACCESS_KEY")) > 0) {
-		creds = credentials.NewEnvAWS()
-	} else {
-		creds = credentials.NewIAM("")
+		return credentials.NewEnvAWS()
+	}
+	return credentials.NewIAM("")
+}
+
+func statObject(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, objectKey string) (minio.ObjectInfo, error) {
+	s3Client, err := s3.NewClient(osConfig.Endpoint, newCredentials(osConfig))
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return s3Client.StatObject(ctx, osConfig.BucketName, objectKey, minio.StatObjectOptions{})
+}
+
+// アップロード用のクライアントを作成する
+// リトライの待ち時間に使えるように、レスポンスの Retry-After ヘッダーを記録する
+func newUploadClient(osConfig *s3.S3CompatibleObjectStorage, transport *http.Transport) (*minio.Client, error) {
+	return s3.NewClientWithOptions(osConfig.Endpoint, newCredentials(osConfig), s3.ClientOptions{
+		Transport:  &retryAfterTransport{RoundTripper: transport},
+		MaxRetries: osConfig.MaxRetries,
+	})
+}
+
+// 使用帯域を制限したアップロード用のクライアントを作成する
+func newRateLimitedUploadClient(osConfig *s3.S3CompatibleObjectStorage, rateLimitMpbs int) (*minio.Client, error) {
+	// bit を byte にする
+	rateLimitMByteps := (bwlimit.Byte(rateLimitMpbs) * bwlimit.MiB) / 8
+
+	// 受信には制限をかけない
+	dialer := bwlimit.NewDialer(&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}, rateLimitMByteps, 0)
+
+	transport, err := s3.DefaultTransport(osConfig.Endpoint)
+	if err != nil {
+		return nil, err
 	}
+	transport.DialContext = dialer.DialContext
+
+	return newUploadClient(osConfig, transport)
+}
 
-	s3Client, err := s3.NewClient(osConfig.Endpoint, creds)
+func uploadJSONFile(
+	ctx context.Context,
+	osConfig *s3.S3CompatibleObjectStorage,
+	dst, filePath, md5Sum string,
+) (string, error) {
+	transport, err := s3.DefaultTransport(osConfig.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	s3Client, err := newUploadClient(osConfig, transport)
 	if err != nil {
 		return "", err
 	}
 
+	start := time.Now()
 	n, err := s3Client.FPutObject(ctx,
 		osConfig.BucketName, dst, filePath,
-		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+		minio.PutObjectOptions{ContentType: "application/octet-stream", UserMetadata: objectMD5Metadata(md5Sum)},
 	)
 	if err != nil {
+		observeUploadFailure(dst, err)
 		return "", err
 	}
-	zlog.Debug().
+	observeUpload(dst, n.Size, time.Since(start))
+	zerolog.Ctx(ctx).Debug().
 		Str("dst", dst).
 		Int64("size", n.Size).
-		Msg("UPLAOD-SUCCESSFULLY")
+		Msg("UPLOAD-JSON-FILE-SUCCESSFULLY")
 
 	reqParams := make(url.Values)
 	filename := filepath.Base(dst)
-	zlog.Debug().
+	zerolog.Ctx(ctx).Debug().
 		Str("filename", filename).
 		Msg("CREATE-CONTENT-DISPOSITION-FILENAME")
 	reqParams.Set(
@@ -62,102 +168,53 @@ func uploadJSONFile(
 		fmt.Sprintf("attachment; filename=\"%s\"", filename),
 	)
 
-	objectURL := fmt.Sprintf("s3://%s/%s", n.Bucket, n.Key)
-	return objectURL, nil
+	return objectURL(n.Bucket, n.Key), nil
 }
 
-func uploadMediaFile(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, dst, filePath string) (string, error) {
-	var creds *credentials.Credentials
-	if (osConfig.AccessKeyID != "") || (osConfig.SecretAccessKey != "") {
-		creds = credentials.NewStaticV4(
-			osConfig.AccessKeyID,
-			osConfig.SecretAccessKey,
-			"",
-		)
-	} else if (len(os.Getenv("AWS_ACCESS_KEY_ID")) > 0) && (len(os.Getenv("AWS_SECRET_ACCESS_KEY")) > 0) {
-		creds = credentials.NewEnvAWS()
-	} else {
-		creds = credentials.NewIAM("")
+func uploadMediaFile(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, dst, filePath, md5Sum string, progress io.Reader) (string, error) {
+	transport, err := s3.DefaultTransport(osConfig.Endpoint)
+	if err != nil {
+		return "", err
 	}
-	s3Client, err := s3.NewClient(osConfig.Endpoint, creds)
+	s3Client, err := newUploadClient(osConfig, transport)
 	if err != nil {
 		return "", err
 	}
 
-	zlog.Info().
+	zerolog.Ctx(ctx).Info().
 		Str("dst", dst).
 		Msg("MEDIA-FILE-UPLOAD-START")
+	start := time.Now()
 	n, err := s3Client.FPutObject(ctx,
 		osConfig.BucketName, dst, filePath,
-		minio.PutObjectOptions{ContentType: "application/octet-stream"},
+		minio.PutObjectOptions{ContentType: "application/octet-stream", UserMetadata: objectMD5Metadata(md5Sum), Progress: progress},
 	)
 	if err != nil {
+		observeUploadFailure(dst, err)
 		return "", err
 	}
-	zlog.Info().
+	observeUpload(dst, n.Size, time.Since(start))
+	zerolog.Ctx(ctx).Info().
 		Str("dst", dst).
 		Int64("size", n.Size).
 		Msg("UPLOAD-MEDIA-FILE-SUCCESSFULLY")
 
 	reqParams := make(url.Values)
 	filename := filepath.Base(dst)
-	zlog.Debug().
+	zerolog.Ctx(ctx).Debug().
 		Str("filename", filename).
-		Msg("create content-disposition filename")
+		Msg("CREATE-CONTENT-DISPOSITION-FILENAME")
 	reqParams.Set(
 		"response-content-disposition",
 		fmt.Sprintf("attachment; filename=\"%s\"", filename),
 	)
 
-	objectURL := fmt.Sprintf("s3://%s/%s", n.Bucket, n.Key)
-	return objectURL, nil
-}
-
-// minio のエラーをレスポンスに復元して、リトライするためファイルを残すか対象のファイルを削除するか判断する
-func isFileContinuous(err error) bool {
-	errResp := minio.ToErrorResponse(err)
-	switch errResp.Code {
-	case "NoSuchBucket":
-		return false
-	case "AccessDenied":
-		return false
-	case "InvalidRegion":
-		return false
-	}
-	return true
+	return objectURL(n.Bucket, n.Key), nil
 }
 
-func uploadMediaFileWithRateLimit(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, dst, filePath string,
-	rateLimitMpbs int) (string, error) {
-	var creds *credentials.Credentials
-	if (osConfig.AccessKeyID != "") || (osConfig.SecretAccessKey != "") {
-		creds = credentials.NewStaticV4(
-			osConfig.AccessKeyID,
-			osConfig.SecretAccessKey,
-			"",
-		)
-	} else if (len(os.Getenv("AWS_ACCESS_KEY_ID")) > 0) && (len(os.Getenv("AWS_SECRET_ACCESS_KEY")) > 0) {
-		creds = credentials.NewEnvAWS()
-	} else {
-		creds = credentials.NewIAM("")
-	}
-
-	// bit を byte にする
-	rateLimitMByteps := (bwlimit.Byte(rateLimitMpbs) * bwlimit.MiB) / 8
-
-	// 受信には制限をかけない
-	dialer := bwlimit.NewDialer(&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}, rateLimitMByteps, 0)
-
-	transport, err := s3.DefaultTransport(osConfig.Endpoint)
-	if err != nil {
-		return "", err
-	}
-	transport.DialContext = dialer.DialContext
-
-	s3Client, err := s3.NewClientWithTransport(osConfig.Endpoint, creds, transport)
+func uploadMediaFileWithRateLimit(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, dst, filePath, md5Sum string,
+	rateLimitMpbs int, progress io.Reader) (string, error) {
+	s3Client, err := newRateLimitedUploadClient(osConfig, rateLimitMpbs)
 	if err != nil {
 		return "", err
 	}
@@ -177,23 +234,159 @@ func uploadMediaFileWithRateLimit(ctx context.Context, osConfig *s3.S3Compatible
 	// Save the file size.
 	fileSize := fileStat.Size()
 
-	zlog.Info().
+	zerolog.Ctx(ctx).Info().
 		Str("dst", dst).
 		Msg("MEDIA-FILE-UPLOAD-START")
 
 	// 使用帯域の制限時は、巨大なサイズのファイルのアップロードする時に使用される multipart アップロードで
 	// 並列アップロードは行わずに 1 thread で処理されるようにオプションを設定する
+	start := time.Now()
 	n, err := s3Client.PutObject(ctx, osConfig.BucketName, dst, fileReader, fileSize,
-		minio.PutObjectOptions{ContentType: "application/octet-stream", NumThreads: 1})
+		minio.PutObjectOptions{ContentType: "application/octet-stream", UserMetadata: objectMD5Metadata(md5Sum), NumThreads: 1, Progress: progress})
 	if err != nil {
+		observeUploadFailure(dst, err)
 		return "", err
 	}
+	observeUpload(dst, n.Size, time.Since(start))
 
-	zlog.Info().
+	zerolog.Ctx(ctx).Info().
 		Str("dst", dst).
 		Int64("size", n.Size).
 		Msg("UPLOAD-MEDIA-FILE-SUCCESSFULLY")
 
-	objectURL := fmt.Sprintf("s3://%s/%s", n.Bucket, n.Key)
-	return objectURL, nil
+	return objectURL(n.Bucket, n.Key), nil
+}
+
+// メディアファイルを multipart アップロードする
+// パートの作成、送信、完了のそれぞれを retry でリトライし、失敗したパートだけを送信し直す
+// 失敗した場合は送信済みのパートが残らないように multipart アップロードを中止する
+func uploadMediaFileMultipart(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, dst, filePath, md5Sum string,
+	rateLimitMpbs int, progress *uploadProgress, retry storageRetryFunc) (string, error) {
+	threads := multipartUploadThreads
+	transport, err := s3.DefaultTransport(osConfig.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	s3Client, err := newUploadClient(osConfig, transport)
+	if rateLimitMpbs > 0 {
+		// 使用帯域の制限時は並列アップロードは行わない
+		s3Client, err = newRateLimitedUploadClient(osConfig, rateLimitMpbs)
+		threads = 1
+	}
+	if err != nil {
+		return "", err
+	}
+	core := minio.Core{Client: s3Client}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fileStat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	fileSize := fileStat.Size()
+	totalParts, partSize, lastPartSize, err := minio.OptimalPartInfo(fileSize, 0)
+	if err != nil {
+		return "", err
+	}
+
+	zerolog.Ctx(ctx).Info().
+		Str("dst", dst).
+		Int("parts", totalParts).
+		Msg("MEDIA-FILE-UPLOAD-START")
+	start := time.Now()
+
+	var uploadID string
+	err = retry(ctx, "create-multipart-upload", func(ctx context.Context) error {
+		var err error
+		uploadID, err = core.NewMultipartUpload(ctx, osConfig.BucketName, dst,
+			minio.PutObjectOptions{ContentType: "application/octet-stream", UserMetadata: objectMD5Metadata(md5Sum)})
+		return err
+	})
+	if err != nil {
+		observeUploadFailure(dst, err)
+		return "", err
+	}
+
+	parts := make([]minio.CompletePart, totalParts)
+	partCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	partNumbers := make(chan int)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var partErr error
+	for range threads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				size := partSize
+				if partNumber == totalParts {
+					size = lastPartSize
+				}
+				offset := int64(partNumber-1) * partSize
+				err := retry(partCtx, "upload-media-part", func(ctx context.Context) error {
+					reader := &partProgressReader{r: io.NewSectionReader(f, offset, size), progress: progress}
+					part, err := core.PutObjectPart(ctx, osConfig.BucketName, dst, uploadID, partNumber, reader, size, minio.PutObjectPartOptions{})
+					if err != nil {
+						reader.rewind()
+						return err
+					}
+					parts[partNumber-1] = minio.CompletePart{PartNumber: partNumber, ETag: part.ETag}
+					return nil
+				})
+				if err != nil {
+					errOnce.Do(func() {
+						partErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+sendParts:
+	for partNumber := 1; partNumber <= totalParts; partNumber++ {
+		select {
+		case <-partCtx.Done():
+			break sendParts
+		case partNumbers <- partNumber:
+		}
+	}
+	close(partNumbers)
+	wg.Wait()
+
+	err = partErr
+	if err == nil {
+		err = ctx.Err()
+	}
+	var info minio.UploadInfo
+	if err == nil {
+		err = retry(ctx, "complete-multipart-upload", func(ctx context.Context) error {
+			var err error
+			info, err = core.CompleteMultipartUpload(ctx, osConfig.BucketName, dst, uploadID, parts, minio.PutObjectOptions{})
+			return err
+		})
+	}
+	if err != nil {
+		observeUploadFailure(dst, err)
+		// 停止シグナルでキャンセルされた場合も中止する
+		if abortErr := core.AbortMultipartUpload(context.WithoutCancel(ctx), osConfig.BucketName, dst, uploadID); abortErr != nil {
+			zerolog.Ctx(ctx).Warn().
+				Err(abortErr).
+				Str("dst", dst).
+				Str("upload_id", uploadID).
+				Msg("FAILED-ABORT-MULTIPART-UPLOAD")
+		}
+		return "", err
+	}
+	observeUpload(dst, fileSize, time.Since(start))
+	zerolog.Ctx(ctx).Info().
+		Str("dst", dst).
+		Int64("size", fileSize).
+		Msg("UPLOAD-MEDIA-FILE-SUCCESSFULLY")
+
+	return objectURL(osConfig.BucketName, info.Key), nil
 }
@@ -13,6 +13,8 @@ type S3CompatibleObjectStorage struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	BucketName      string
+	// クライアントライブラリ内でリクエストをリトライする回数、0 の場合はクライアントライブラリの既定値を使う
+	MaxRetries int
 }
 
 func maybeEndpointURL(endpoint string) (string, bool) {
@@ -51,13 +53,24 @@ func NewClient(endpoint string, credentials *credentials.Credentials) (*minio.Cl
 }
 
 func NewClientWithTransport(endpoint string, credentials *credentials.Credentials, transport http.RoundTripper) (*minio.Client, error) {
+	return NewClientWithOptions(endpoint, credentials, ClientOptions{Transport: transport})
+}
+
+type ClientOptions struct {
+	Transport http.RoundTripper
+	// クライアントライブラリ内でリクエストをリトライする回数、0 の場合はクライアントライブラリの既定値を使う
+	MaxRetries int
+}
+
+func NewClientWithOptions(endpoint string, credentials *credentials.Credentials, opts ClientOptions) (*minio.Client, error) {
 	newEndpoint, secure := maybeEndpointURL(endpoint)
 	return minio.New(
 		newEndpoint,
 		&minio.Options{
-			Creds:     credentials,
-			Secure:    secure,
-			Transport: transport,
+			Creds:      credentials,
+			Secure:     secure,
+			Transport:  opts.Transport,
+			MaxRetries: opts.MaxRetries,
 		})
 }
 
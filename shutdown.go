@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"context"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+// 強制終了する前に処理結果の書き出しとトレースの送信を待つ時間
+const forcedShutdownFlushTimeout = 3 * time.Second
+
+// 停止した理由
+const (
+	// shutdown_drain_timeout_s が設定されていないため処理中のファイルを中断した
+	ShutdownReasonAborted = "aborted"
+	// 処理中のファイルが終わってから停止した
+	ShutdownReasonDrained = "drained"
+	// shutdown_drain_timeout_s を過ぎたため処理中のファイルを中断した
+	ShutdownReasonDrainTimeout = "drain-timeout"
+	// 2 回目の停止シグナルを受け取ったため、すぐに終了した
+	ShutdownReasonForced = "forced"
+)
+
+// 停止シグナルを受け取ってから停止するまでに処理が終わったものと残ったものをログに出力する
+// 残ったファイルは次回の探索で処理する
+func (m *Main) logShutdownSummary(reason string) {
+	var completedFiles, failedFiles int64
+	if gateKeeper := m.gateKeeper.Load(); gateKeeper != nil {
+		completedFiles = gateKeeper.completedFiles.Load()
+		failedFiles = gateKeeper.failedFiles.Load()
+	}
+	var finishedRecordings int
+	unfinishedRecordings := []string{}
+	for _, state := range m.recordingStates() {
+		if state.Finished {
+			finishedRecordings++
+			continue
+		}
+		unfinishedRecordings = append(unfinishedRecordings, state.Dir)
+	}
+	inFlightFiles := []string{}
+	for _, f := range uploadStatus.inFlightFiles() {
+		inFlightFiles = append(inFlightFiles, f.Path)
+	}
+	zlog.Info().
+		Str("reason", reason).
+		Int64("completed_files", completedFiles).
+		Int64("failed_files", failedFiles).
+		Int("finished_recordings", finishedRecordings).
+		Int("queued_files", len(uploadStatus.queuedFiles())).
+		Strs("interrupted_files", inFlightFiles).
+		Strs("unfinished_recordings", unfinishedRecordings).
+		Msg("SHUTDOWN-SUMMARY")
+}
+
+// 2 回目の停止シグナルで強制終了する前に、処理結果の書き出しとトレースの送信を待つ
+// ウェブフックの送信先やトレースの送信先が応答しない場合も forcedShutdownFlushTimeout で諦める
+func (m *Main) flushBeforeForcedExit(shutdownTracer func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), forcedShutdownFlushTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 常駐モードでは録画ディレクトリが見つかった場合のみ処理結果を出力する
+		if summary := runSummary.finish(); summary != nil && (summary.Mode != "resident" || summary.RecordingsFound > 0) {
+			reportRunSummary(m.currentConfig(), summary)
+		}
+		if err := shutdownTracer(ctx); err != nil {
+			zlog.Error().Err(err).Msg("FAILED-SHUTDOWN-TRACER")
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		zlog.Warn().
+			Dur("timeout", forcedShutdownFlushTimeout).
+			Msg("FORCED-SHUTDOWN-FLUSH-TIMEOUT")
+	}
+}
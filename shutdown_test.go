@@ -0,0 +1,71 @@
+package archive
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploaderManagerStopAccepting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acceptCtx, acceptCancel := context.WithCancel(ctx)
+
+	fileStream := make(chan string)
+	um := newUploaderManager()
+	_, err := um.run(ctx, acceptCtx, &Config{UploadWorkers: 2}, nil, nil, fileStream)
+	assert.NoError(t, err)
+
+	select {
+	case <-um.stopped:
+		t.Fatal("uploaders stopped before draining")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 新しいファイルの受け取りを止めると、処理中のファイルがないアップローダーはすぐに終了する
+	acceptCancel()
+	select {
+	case <-um.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("uploaders did not stop")
+	}
+}
+
+func TestUploaderManagerStopAcceptingWhilePaused(t *testing.T) {
+	uploadPause.pause()
+	defer uploadPause.resume()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	acceptCtx, acceptCancel := context.WithCancel(ctx)
+
+	um := newUploaderManager()
+	_, err := um.run(ctx, acceptCtx, &Config{UploadWorkers: 1}, nil, nil, make(chan string))
+	assert.NoError(t, err)
+
+	acceptCancel()
+	select {
+	case <-um.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("paused uploaders did not stop")
+	}
+}
+
+func TestFlushBeforeForcedExit(t *testing.T) {
+	summaryFilePath := filepath.Join(t.TempDir(), "summary.json")
+	m := newMain(&Config{RunSummaryFilePath: summaryFilePath})
+
+	// 処理中の実行結果を書き出してからトレースの送信を待つ
+	runSummary.start("timer")
+	var tracerShutdown bool
+	m.flushBeforeForcedExit(func(ctx context.Context) error {
+		tracerShutdown = true
+		return nil
+	})
+	assert.True(t, tracerShutdown)
+	assert.FileExists(t, summaryFilePath)
+	assert.Nil(t, runSummary.finish())
+}
@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 直近の失敗として保持する件数
+const recentFailuresLimit = 100
+
+// 処理待ち、処理中のファイルと直近の失敗を管理する
+type uploadStatusTracker struct {
+	mutex    sync.Mutex
+	queue    map[string]time.Time
+	inFlight map[string]*InFlightFile
+	failures []*UploadFailure
+}
+
+type QueuedFile struct {
+	Path     string    `json:"path"`
+	FileType string    `json:"file_type"`
+	FoundAt  time.Time `json:"found_at"`
+}
+
+type InFlightFile struct {
+	Path       string    `json:"path"`
+	FileType   string    `json:"file_type"`
+	UploaderID int       `json:"uploader_id"`
+	Size       int64     `json:"size"`
+	StartedAt  time.Time `json:"started_at"`
+	// メディアファイルのアップロード中のみ設定する
+	Progress *UploadProgress `json:"progress,omitempty"`
+
+	progress *uploadProgress
+}
+
+type UploadFailure struct {
+	Path       string    `json:"path,omitempty"`
+	ObjectKey  string    `json:"object_key,omitempty"`
+	UploaderID int       `json:"uploader_id"`
+	Operation  string    `json:"operation"`
+	Error      string    `json:"error"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+var uploadStatus = &uploadStatusTracker{
+	queue:    make(map[string]time.Time),
+	inFlight: make(map[string]*InFlightFile),
+}
+
+// 探索で見つかったファイルを処理待ちにする
+func (t *uploadStatusTracker) setQueue(files []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.queue = make(map[string]time.Time, len(files))
+	for _, f := range files {
+		t.queue[f] = now
+	}
+}
+
+func (t *uploadStatusTracker) clearQueue() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.queue = make(map[string]time.Time)
+}
+
+func (t *uploadStatusTracker) start(path string, uploaderID int) {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.queue, path)
+	t.inFlight[path] = &InFlightFile{
+		Path:       path,
+		FileType:   recordingFileType(filepath.Base(path)),
+		UploaderID: uploaderID,
+		Size:       size,
+		StartedAt:  time.Now(),
+	}
+}
+
+func (t *uploadStatusTracker) finish(path string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.inFlight, path)
+}
+
+// アップローダーが処理中のファイルにメディアファイルの進捗を設定する
+func (t *uploadStatusTracker) setProgress(uploaderID int, progress *uploadProgress) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, f := range t.inFlight {
+		if f.UploaderID == uploaderID {
+			f.progress = progress
+		}
+	}
+}
+
+// 処理中のメディアファイルの送信済みバイト数と合計バイト数
+func (t *uploadStatusTracker) inFlightBytes() (int64, int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var sent, total int64
+	for _, f := range t.inFlight {
+		if f.progress != nil {
+			s := f.progress.snapshot()
+			sent += s.BytesSent
+			total += s.TotalBytes
+		}
+	}
+	return sent, total
+}
+
+func (t *uploadStatusTracker) recordFailure(f *UploadFailure) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.failures = append(t.failures, f)
+	if len(t.failures) > recentFailuresLimit {
+		t.failures = t.failures[len(t.failures)-recentFailuresLimit:]
+	}
+}
+
+func (t *uploadStatusTracker) queuedFiles() []*QueuedFile {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]*QueuedFile, 0, len(t.queue))
+	for path, foundAt := range t.queue {
+		result = append(result, &QueuedFile{
+			Path:     path,
+			FileType: recordingFileType(filepath.Base(path)),
+			FoundAt:  foundAt,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+func (t *uploadStatusTracker) inFlightFiles() []*InFlightFile {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]*InFlightFile, 0, len(t.inFlight))
+	for _, f := range t.inFlight {
+		copied := *f
+		if f.progress != nil {
+			copied.Progress = f.progress.snapshot()
+		}
+		result = append(result, &copied)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+func (t *uploadStatusTracker) inFlightCount() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.inFlight)
+}
+
+// 新しいものから返す
+func (t *uploadStatusTracker) recentFailures() []*UploadFailure {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make([]*UploadFailure, 0, len(t.failures))
+	for i := len(t.failures) - 1; i >= 0; i-- {
+		result = append(result, t.failures[i])
+	}
+	return result
+}
+
+// アップロードの一時停止を管理する
+// 一時停止中はアップローダーが新しいファイルを受け取らない
+type pauseGate struct {
+	mutex sync.Mutex
+	// 一時停止中のみ nil ではなく、再開時に close する
+	resumed chan struct{}
+}
+
+var uploadPause = &pauseGate{}
+
+func (p *pauseGate) pause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+func (p *pauseGate) resume() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+func (p *pauseGate) paused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.resumed != nil
+}
+
+// 一時停止中は再開されるまで待つ
+// ctx がキャンセルされた場合は false を返す
+func (p *pauseGate) wait(ctx context.Context) bool {
+	p.mutex.Lock()
+	resumed := p.resumed
+	p.mutex.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
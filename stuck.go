@@ -0,0 +1,325 @@
+package archive
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+)
+
+const (
+	// 放置された録画ディレクトリの扱い
+	StuckRecordingActionReport     = "report"
+	StuckRecordingActionUpload     = "upload"
+	StuckRecordingActionQuarantine = "quarantine"
+
+	// archive-*.json に対応するメディアファイルがない
+	StuckReasonMediaMissing = "media-missing"
+	// メディアファイルに対応する archive-*.json がない
+	StuckReasonMetadataMissing = "metadata-missing"
+	// report-*.json がない
+	StuckReasonReportMissing = "report-missing"
+
+	DefaultWebhookTypeRecordingIncomplete = "recording.incomplete"
+)
+
+// 通常の処理では扱えないまま放置されている録画ディレクトリ
+type StuckRecording struct {
+	RecordingID  string
+	DirPath      string
+	Reasons      []string
+	Files        []string
+	LastModified time.Time
+}
+
+// 録画ディレクトリ内のファイルの組み合わせを確認して、不足しているものを Reasons に設定する
+// サブディレクトリを持つディレクトリや、録画ファイルを持たないディレクトリは録画ディレクトリとして扱わず nil を返す
+// archive_dir_max_depth が 2 以上の場合、空になった日付などの中間のディレクトリを report-missing として扱わないようにする
+func classifyRecordingDirectory(dirPath string, entries []os.DirEntry) *StuckRecording {
+	dirInfo, err := os.Stat(dirPath)
+	if err != nil {
+		return nil
+	}
+	sr := &StuckRecording{
+		RecordingID:  filepath.Base(dirPath),
+		DirPath:      dirPath,
+		LastModified: dirInfo.ModTime(),
+	}
+
+	metadataFiles := make(map[string]struct{})
+	mediaFiles := make(map[string]struct{})
+	var hasReport, hasRecordingFile bool
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(sr.LastModified) {
+			sr.LastModified = info.ModTime()
+		}
+		filename := entry.Name()
+		sr.Files = append(sr.Files, filepath.Join(dirPath, filename))
+
+		ext := filepath.Ext(filename)
+		base := strings.TrimSuffix(filename, ext)
+		switch {
+		case strings.HasPrefix(filename, "report-") && ext == ".json":
+			hasReport = true
+			hasRecordingFile = true
+		case strings.HasPrefix(filename, "split-archive-end-"):
+			hasRecordingFile = true
+		case strings.HasPrefix(filename, "archive-") || strings.HasPrefix(filename, "split-archive-"):
+			hasRecordingFile = true
+			switch ext {
+			case ".json":
+				metadataFiles[base] = struct{}{}
+			case ".webm", ".mp4":
+				mediaFiles[base] = struct{}{}
+			}
+		}
+	}
+
+	if !hasRecordingFile {
+		return nil
+	}
+
+	for base := range metadataFiles {
+		if _, ok := mediaFiles[base]; !ok {
+			sr.Reasons = appendReason(sr.Reasons, StuckReasonMediaMissing)
+		}
+	}
+	for base := range mediaFiles {
+		if _, ok := metadataFiles[base]; !ok {
+			sr.Reasons = appendReason(sr.Reasons, StuckReasonMetadataMissing)
+		}
+	}
+	if !hasReport {
+		sr.Reasons = appendReason(sr.Reasons, StuckReasonReportMissing)
+	}
+	return sr
+}
+
+func appendReason(reasons []string, reason string) []string {
+	for _, r := range reasons {
+		if r == reason {
+			return reasons
+		}
+	}
+	return append(reasons, reason)
+}
+
+// メタデータファイルとメディアファイルの組み合わせが揃っていない
+func (sr *StuckRecording) hasIncompletePair() bool {
+	for _, reason := range sr.Reasons {
+		if reason == StuckReasonMediaMissing || reason == StuckReasonMetadataMissing {
+			return true
+		}
+	}
+	return false
+}
+
+// 猶予期間を過ぎても更新されていない録画ディレクトリを探す
+// 今回の実行で処理するファイルを含む録画ディレクトリは、report ファイルを待っているだけなので対象外とする
+// ただし、report ファイルだけが処理対象になっていて、メタデータファイルとメディアファイルの組み合わせが揃っていない録画ディレクトリは対象にする
+func detectStuckRecordings(config *Config, foundFiles []string) ([]*StuckRecording, error) {
+	if config.StuckRecordingGracePeriodS <= 0 {
+		return nil, nil
+	}
+	gracePeriod := time.Duration(config.StuckRecordingGracePeriodS) * time.Second
+
+	processingDirs := make(map[string]struct{})
+	for _, f := range foundFiles {
+		processingDirs[filepath.Dir(f)] = struct{}{}
+	}
+
+	var result []*StuckRecording
+	err := walkRecordingDirectories(config, func(dirPath string, entries []os.DirEntry) {
+		sr := classifyRecordingDirectory(dirPath, entries)
+		if sr == nil || len(sr.Reasons) == 0 {
+			return
+		}
+		if _, ok := processingDirs[dirPath]; ok && !sr.hasIncompletePair() {
+			return
+		}
+		if time.Since(sr.LastModified) < gracePeriod {
+			return
+		}
+		result = append(result, sr)
+	})
+	return result, err
+}
+
+// 放置された録画ディレクトリのファイルを処理対象から外す
+func excludeStuckRecordings(files []string, stuckRecordings []*StuckRecording) []string {
+	if len(stuckRecordings) == 0 {
+		return files
+	}
+	stuckDirs := make(map[string]struct{}, len(stuckRecordings))
+	for _, sr := range stuckRecordings {
+		stuckDirs[sr.DirPath] = struct{}{}
+	}
+	var result []string
+	for _, f := range files {
+		if _, ok := stuckDirs[filepath.Dir(f)]; ok {
+			continue
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// 設定に従って放置された録画ディレクトリを処理する
+func (u Uploader) handleStuckRecording(sr *StuckRecording) bool {
+	action := u.config.stuckRecordingAction()
+	zlog.Warn().
+		Str("recording_id", sr.RecordingID).
+		Str("path", sr.DirPath).
+		Strs("reasons", sr.Reasons).
+		Strs("files", sr.Files).
+		Time("last_modified", sr.LastModified).
+		Str("action", action).
+		Msg("STUCK-RECORDING-DETECTED")
+
+	switch action {
+	case StuckRecordingActionQuarantine:
+		newDirPath := u.config.relocatedPath(sr.DirPath, u.config.StuckRecordingQuarantineDirFullPath)
+		if err := os.MkdirAll(filepath.Dir(newDirPath), 0755); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("quarantine_dir_path", filepath.Dir(newDirPath)).
+				Msg("QUARANTINE-DIRECTORY-CREATE-ERROR")
+			return false
+		}
+		if err := os.Rename(sr.DirPath, newDirPath); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("old_path", sr.DirPath).
+				Str("new_path", newDirPath).
+				Msg("STUCK-RECORDING-MOVE-ERROR")
+			return false
+		}
+		zlog.Info().
+			Str("recording_id", sr.RecordingID).
+			Str("old_path", sr.DirPath).
+			Str("new_path", newDirPath).
+			Msg("STUCK-RECORDING-QUARANTINED")
+		return true
+	case StuckRecordingActionUpload:
+		return u.uploadStuckRecording(sr)
+	}
+	return true
+}
+
+// 録画ディレクトリに残っているファイルをすべてアップロードし、recording.incomplete ウェブフックを送信する
+func (u Uploader) uploadStuckRecording(sr *StuckRecording) bool {
+	osConfig := u.objectStorageConfig()
+
+	var channelID string
+	var files []WebhookIncompleteFile
+	for _, filePath := range sr.Files {
+		filename := filepath.Base(filePath)
+		objectKey := u.config.objectKey(filePath, sr.RecordingID, filename)
+
+		var fileURL string
+		var err error
+		switch filepath.Ext(filename) {
+		case ".webm", ".mp4":
+			fileURL, err = u.uploadMediaFile(u.ctx, osConfig, objectKey, filePath)
+		default:
+			if channelID == "" && filepath.Ext(filename) == ".json" {
+				channelID = readChannelID(filePath)
+			}
+			fileURL, err = u.uploadJSONFile(u.ctx, osConfig, objectKey, filePath)
+		}
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Str("recording_id", sr.RecordingID).
+				Str("path", filePath).
+				Str("object_key", objectKey).
+				Msg("STUCK-RECORDING-FILE-UPLOAD-ERROR")
+			return false
+		}
+		files = append(files, WebhookIncompleteFile{
+			Filename: filename,
+			FileURL:  fileURL,
+		})
+	}
+
+	if u.config.WebhookEndpointURL != "" {
+		webhookID, err := u.generateWebhookID()
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Str("recording_id", sr.RecordingID).
+				Msg("WEBHOOK-ID-GENERATE-ERROR")
+			return false
+		}
+		webhookType := u.config.webhookTypeRecordingIncomplete()
+		var w = WebhookRecordingIncomplete{
+			ID:          webhookID,
+			Type:        webhookType,
+			Timestamp:   time.Now().UTC(),
+			RecordingID: sr.RecordingID,
+			ChannelID:   channelID,
+			Reasons:     sr.Reasons,
+			Files:       files,
+		}
+		buf, err := json.Marshal(w)
+		if err != nil {
+			zlog.Error().
+				Err(err).
+				Str("recording_id", sr.RecordingID).
+				Msg("RECORDING-INCOMPLETE-WEBHOOK-MARSHAL-ERROR")
+			return false
+		}
+		if err := u.postWebhook(u.ctx, webhookType, buf); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("recording_id", sr.RecordingID).
+				Str("channel_id", channelID).
+				Msg("RECORDING-INCOMPLETE-WEBHOOK-SEND-ERROR")
+			return false
+		}
+	}
+
+	// アップロードし終わったファイルを削除して、録画ディレクトリを退避先に移動する
+	for _, filePath := range sr.Files {
+		if err := os.Remove(filePath); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", filePath).
+				Msg("FAILED-REMOVE-STUCK-RECORDING-FILE")
+		}
+	}
+	if err := evacuateRecordingDirectory(u.config, sr.DirPath); err != nil {
+		return false
+	}
+	zlog.Info().
+		Str("recording_id", sr.RecordingID).
+		Str("path", sr.DirPath).
+		Int("files", len(files)).
+		Msg("STUCK-RECORDING-UPLOADED")
+	return true
+}
+
+// JSON ファイルから channel_id を取り出す、取り出せない場合は空文字を返す
+func readChannelID(jsonFilePath string) string {
+	raw, err := os.ReadFile(jsonFilePath)
+	if err != nil {
+		return ""
+	}
+	var v struct {
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return ""
+	}
+	return v.ChannelID
+}
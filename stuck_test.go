@@ -0,0 +1,66 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectStuckRecordings(t *testing.T) {
+	root := t.TempDir()
+
+	// report ファイルを待っている処理中の録画ディレクトリ
+	writeTestFile(t, filepath.Join(root, "REC1", "archive-A.json"))
+	writeTestFile(t, filepath.Join(root, "REC1", "archive-A.webm"))
+	// メディアファイルがない、report ファイルは処理対象になる
+	writeTestFile(t, filepath.Join(root, "REC2", "archive-B.json"))
+	writeTestFile(t, filepath.Join(root, "REC2", "report-REC2.json"))
+	// メタデータファイルと report ファイルがない
+	writeTestFile(t, filepath.Join(root, "REC3", "archive-C.mp4"))
+	// 猶予期間内
+	writeTestFile(t, filepath.Join(root, "REC4", "archive-D.json"))
+	// 録画ファイルを持たない中間のディレクトリ
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "2025-01-01"), 0755))
+	writeTestFile(t, filepath.Join(root, "2025-01-02", "notes.txt"))
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, dir := range []string{"REC1", "REC2", "REC3", "2025-01-01", "2025-01-02"} {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		require.NoError(t, err)
+		for _, e := range entries {
+			require.NoError(t, os.Chtimes(filepath.Join(root, dir, e.Name()), old, old))
+		}
+		require.NoError(t, os.Chtimes(filepath.Join(root, dir), old, old))
+	}
+
+	config := &Config{
+		ArchiveRoots: []*ArchiveRoot{
+			{ArchiveDirFullPath: root, EvacuateDirFullPath: filepath.Join(root, "evacuate")},
+		},
+		ArchiveDirMaxDepth:         2,
+		StuckRecordingGracePeriodS: 3600,
+	}
+	found, err := runFileFinder(config)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(root, "REC1", "archive-A.json"),
+		filepath.Join(root, "REC2", "report-REC2.json"),
+	}, found)
+
+	stuck, err := detectStuckRecordings(config, found)
+	require.NoError(t, err)
+	require.Len(t, stuck, 2)
+
+	assert.Equal(t, "REC2", stuck[0].RecordingID)
+	assert.Equal(t, []string{StuckReasonMediaMissing}, stuck[0].Reasons)
+
+	assert.Equal(t, "REC3", stuck[1].RecordingID)
+	assert.Equal(t, []string{StuckReasonMetadataMissing, StuckReasonReportMissing}, stuck[1].Reasons)
+
+	// 放置された録画ディレクトリの report ファイルは通常の処理から外す
+	assert.Equal(t, []string{filepath.Join(root, "REC1", "archive-A.json")}, excludeStuckRecordings(found, stuck))
+}
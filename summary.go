@@ -0,0 +1,230 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	zlog "github.com/rs/zerolog/log"
+	base32 "github.com/shogo82148/go-clockwork-base32"
+)
+
+const DefaultWebhookTypeRunSummary = "run.summary"
+
+// 1 回の探索とアップロードの処理結果
+type RunSummary struct {
+	// timer、resident または upload
+	Mode       string    `json:"mode"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	WallTimeS  float64   `json:"wall_time_s"`
+	// 処理対象として見つかった録画ディレクトリ数
+	RecordingsFound int `json:"recordings_found"`
+	// ファイルの種類ごとのアップロードしたファイル数とバイト数
+	UploadedFiles map[string]int64 `json:"uploaded_files"`
+	UploadedBytes map[string]int64 `json:"uploaded_bytes"`
+	// 処理に失敗したファイル数
+	FailedFiles int64 `json:"failed_files"`
+	// そのうちリトライしないエラーで失敗したファイル数
+	NonRetryableFailures int64 `json:"non_retryable_failures"`
+	// エラーコードごとのアップロードに失敗した回数
+	UploadFailures map[string]int64 `json:"upload_failures"`
+	// 同じ実行中にリトライしたオブジェクトストレージの操作の回数
+	StorageRetries int64 `json:"storage_retries"`
+	WebhooksSent   int64 `json:"webhooks_sent"`
+	WebhooksFailed int64 `json:"webhooks_failed"`
+	// 失敗した回数が upload_max_attempts に達して upload_failed_dir_full_path に移動した録画ディレクトリ数
+	FailedRecordings int64 `json:"failed_recordings"`
+	// 退避ディレクトリに移動した録画ディレクトリ数
+	EvacuatedRecordings int64 `json:"evacuated_recordings"`
+	// remove_empty_recording_directory で削除した録画ディレクトリ数
+	RemovedRecordings int64 `json:"removed_recordings"`
+}
+
+// 実行中の処理結果を集計する
+// start を呼び出す前の記録は無視する
+type runSummaryCollector struct {
+	mutex   sync.Mutex
+	summary *RunSummary
+}
+
+var runSummary = &runSummaryCollector{}
+
+func (c *runSummaryCollector) start(mode string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.summary = &RunSummary{
+		Mode:           mode,
+		StartedAt:      time.Now().UTC(),
+		UploadedFiles:  make(map[string]int64),
+		UploadedBytes:  make(map[string]int64),
+		UploadFailures: make(map[string]int64),
+	}
+}
+
+// 集計を終了して結果を返す
+func (c *runSummaryCollector) finish() *RunSummary {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	summary := c.summary
+	c.summary = nil
+	if summary == nil {
+		return nil
+	}
+	summary.FinishedAt = time.Now().UTC()
+	summary.WallTimeS = summary.FinishedAt.Sub(summary.StartedAt).Seconds()
+	return summary
+}
+
+func (c *runSummaryCollector) update(f func(s *RunSummary)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.summary != nil {
+		f(c.summary)
+	}
+}
+
+func (c *runSummaryCollector) recordingsFound(files []string) {
+	dirs := make(map[string]struct{})
+	for _, f := range files {
+		dirs[filepath.Dir(f)] = struct{}{}
+	}
+	c.update(func(s *RunSummary) { s.RecordingsFound = len(dirs) })
+}
+
+func (c *runSummaryCollector) uploaded(fileType string, size int64) {
+	c.update(func(s *RunSummary) {
+		s.UploadedFiles[fileType]++
+		s.UploadedBytes[fileType] += size
+	})
+}
+
+func (c *runSummaryCollector) uploadFailed(code string) {
+	c.update(func(s *RunSummary) { s.UploadFailures[code]++ })
+}
+
+func (c *runSummaryCollector) storageRetry() {
+	c.update(func(s *RunSummary) { s.StorageRetries++ })
+}
+
+func (c *runSummaryCollector) fileFailed() {
+	c.update(func(s *RunSummary) { s.FailedFiles++ })
+}
+
+func (c *runSummaryCollector) nonRetryableFailure() {
+	c.update(func(s *RunSummary) { s.NonRetryableFailures++ })
+}
+
+func (c *runSummaryCollector) recordingFailed() {
+	c.update(func(s *RunSummary) { s.FailedRecordings++ })
+}
+
+func (c *runSummaryCollector) webhook(success bool) {
+	c.update(func(s *RunSummary) {
+		if success {
+			s.WebhooksSent++
+		} else {
+			s.WebhooksFailed++
+		}
+	})
+}
+
+func (c *runSummaryCollector) recordingEvacuated() {
+	c.update(func(s *RunSummary) { s.EvacuatedRecordings++ })
+}
+
+func (c *runSummaryCollector) recordingRemoved() {
+	c.update(func(s *RunSummary) { s.RemovedRecordings++ })
+}
+
+func (c Config) webhookTypeRunSummary() string {
+	if c.WebhookTypeRunSummary == "" {
+		return DefaultWebhookTypeRunSummary
+	}
+	return c.WebhookTypeRunSummary
+}
+
+// 処理結果をログに出力し、設定されていればファイルへの書き出しとウェブフックの送信を行う
+func reportRunSummary(config *Config, summary *RunSummary) {
+	if summary == nil {
+		return
+	}
+	zlog.Info().
+		Str("mode", summary.Mode).
+		Float64("wall_time_s", summary.WallTimeS).
+		Int("recordings_found", summary.RecordingsFound).
+		Interface("uploaded_files", summary.UploadedFiles).
+		Interface("uploaded_bytes", summary.UploadedBytes).
+		Int64("failed_files", summary.FailedFiles).
+		Int64("non_retryable_failures", summary.NonRetryableFailures).
+		Interface("upload_failures", summary.UploadFailures).
+		Int64("storage_retries", summary.StorageRetries).
+		Int64("failed_recordings", summary.FailedRecordings).
+		Int64("webhooks_sent", summary.WebhooksSent).
+		Int64("webhooks_failed", summary.WebhooksFailed).
+		Int64("evacuated_recordings", summary.EvacuatedRecordings).
+		Int64("removed_recordings", summary.RemovedRecordings).
+		Msg("RUN-SUMMARY")
+
+	if config.RunSummaryFilePath != "" {
+		if err := writeJSONFileAtomic(config.RunSummaryFilePath, summary); err != nil {
+			zlog.Error().
+				Err(err).
+				Str("path", config.RunSummaryFilePath).
+				Msg("FAILED-WRITE-RUN-SUMMARY-FILE")
+		}
+	}
+	if config.RunSummaryWebhook && config.WebhookEndpointURL != "" {
+		if err := postRunSummaryWebhook(config, summary); err != nil {
+			zlog.Error().
+				Err(err).
+				Msg("FAILED-POST-RUN-SUMMARY-WEBHOOK")
+		}
+	}
+}
+
+// 書き込み途中のファイルを読まないように、一時ファイルに書き込んでから置き換える
+func writeJSONFileAtomic(path string, v any) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func postRunSummaryWebhook(config *Config, summary *RunSummary) error {
+	webhookID, err := generateWebhookID(base32.NewEncoding())
+	if err != nil {
+		return err
+	}
+	webhookType := config.webhookTypeRunSummary()
+	w := WebhookRunSummary{
+		ID:         webhookID,
+		Type:       webhookType,
+		Timestamp:  time.Now().UTC(),
+		RunSummary: summary,
+	}
+	buf, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return postWebhook(context.Background(), config, webhookType, buf)
+}
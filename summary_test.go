@@ -0,0 +1,95 @@
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSummaryCollector(t *testing.T) {
+	// start の前の記録は無視する
+	observeUpload("REC1/archive-A.webm", 100, time.Second)
+	assert.Nil(t, runSummary.finish())
+
+	runSummary.start("timer")
+	runSummary.recordingsFound([]string{
+		"/archive/REC1/archive-A.json",
+		"/archive/REC1/archive-A.webm",
+		"/archive/REC2/report-B.json",
+	})
+	observeUpload("REC1/archive-A.webm", 100, time.Second)
+	observeUpload("REC1/archive-A.json", 10, time.Second)
+	observeUpload("REC1/archive-B.webm", 200, time.Second)
+	observeUpload("REC2/split-archive-C_0001.webm", 50, time.Second)
+	observeUploadFailure("REC2/report-B.json", errors.New("connection reset"))
+	observeWebhook("archive.uploaded", http.StatusOK, time.Second)
+	observeWebhook("report.uploaded", 0, time.Second)
+	runSummary.fileFailed()
+	runSummary.recordingEvacuated()
+	summary := runSummary.finish()
+	require.NotNil(t, summary)
+
+	assert.Equal(t, "timer", summary.Mode)
+	assert.Equal(t, 2, summary.RecordingsFound)
+	assert.Equal(t, map[string]int64{RecordingFileTypeArchive: 3, RecordingFileTypeSplitArchive: 1}, summary.UploadedFiles)
+	assert.Equal(t, map[string]int64{RecordingFileTypeArchive: 310, RecordingFileTypeSplitArchive: 50}, summary.UploadedBytes)
+	assert.Equal(t, map[string]int64{"unknown": 1}, summary.UploadFailures)
+	assert.Equal(t, int64(1), summary.FailedFiles)
+	assert.Equal(t, int64(1), summary.WebhooksSent)
+	assert.Equal(t, int64(1), summary.WebhooksFailed)
+	assert.Equal(t, int64(1), summary.EvacuatedRecordings)
+	assert.False(t, summary.FinishedAt.Before(summary.StartedAt))
+}
+
+func TestReportRunSummary(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+
+	summaryFilePath := filepath.Join(t.TempDir(), "summary.json")
+	config := &Config{
+		RunSummaryFilePath:    summaryFilePath,
+		RunSummaryWebhook:     true,
+		WebhookEndpointURL:    server.URL,
+		WebhookTypeHeaderName: "sora-archive-uploader-webhook-type",
+	}
+	summary := &RunSummary{
+		Mode:            "timer",
+		RecordingsFound: 1,
+		FailedFiles:     2,
+		UploadedFiles:   map[string]int64{RecordingFileTypeArchive: 1},
+	}
+	reportRunSummary(config, summary)
+
+	raw, err := os.ReadFile(summaryFilePath)
+	require.NoError(t, err)
+	var written RunSummary
+	require.NoError(t, json.Unmarshal(raw, &written))
+	assert.Equal(t, *summary, written)
+	// 一時ファイルは残らない
+	entries, err := os.ReadDir(filepath.Dir(summaryFilePath))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	r := <-received
+	assert.Equal(t, DefaultWebhookTypeRunSummary, r.Header.Get("sora-archive-uploader-webhook-type"))
+	var w map[string]any
+	require.NoError(t, json.Unmarshal(body, &w))
+	assert.Equal(t, DefaultWebhookTypeRunSummary, w["type"])
+	assert.NotEmpty(t, w["id"])
+	assert.Equal(t, float64(2), w["failed_files"])
+	assert.Equal(t, float64(1), w["recordings_found"])
+}
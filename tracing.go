@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"context"
+
+	zlog "github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/shiguredo/sora-archive-uploader"
+	tracingServiceName = "sora-archive-uploader"
+)
+
+// トレーサープロバイダーを設定していない場合は何も出力しない
+var tracer = otel.Tracer(tracerName)
+
+// OTLP でスパンを送信するトレーサープロバイダーを設定する
+// 戻り値の関数で未送信のスパンを送信して終了する
+func initTracer(ctx context.Context, config *Config) (func(context.Context) error, error) {
+	// ウェブフックの送信先にトレースコンテキストを traceparent ヘッダーで伝搬する
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if config.TracingOTLPEndpointURL == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// スキームが http の場合は TLS を使わずに送信する
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(config.TracingOTLPEndpointURL),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(tracingServiceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	zlog.Debug().
+		Str("endpoint_url", config.TracingOTLPEndpointURL).
+		Msg("STARTED-TRACING")
+	return tp.Shutdown, nil
+}
+
+// スパンにエラーを記録する
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// ファイルを削除するスパンを作成する
+func startRemoveFileSpan(ctx context.Context, path string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "remove-file", trace.WithAttributes(
+		attribute.String("file.path", path),
+	))
+}
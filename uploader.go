@@ -3,16 +3,20 @@ package archive
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/shiguredo/sora-archive-uploader/s3"
 	base32 "github.com/shogo82148/go-clockwork-base32"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
 )
 
@@ -31,6 +35,8 @@ type UploaderManager struct {
 	ArchiveEndStream chan UploaderResult
 	ReportStream     chan UploaderResult
 	uploaders        []Uploader
+	// すべてのアップローダーが終了したら閉じる
+	stopped chan struct{}
 }
 
 type ArchiveMetadata struct {
@@ -65,18 +71,30 @@ func newUploaderManager() *UploaderManager {
 		ArchiveEndStream: archiveEndStream,
 		ReportStream:     reportStream,
 		uploaders:        uploaders,
+		stopped:          make(chan struct{}),
 	}
 }
 
-func (um *UploaderManager) run(ctx context.Context, config *Config, fileStream <-chan string) (*UploaderManager, error) {
+// acceptCtx が終了するとアップローダーは新しいファイルを受け取らずに、処理中のファイルを終わらせてから終了する
+// ctx が終了すると処理中のファイルも中断する
+func (um *UploaderManager) run(ctx, acceptCtx context.Context, config *Config, traceContext func(string) context.Context, recordingFilter func(context.Context, string) (*filterDecision, error), fileStream <-chan string) (*UploaderManager, error) {
+	var wg sync.WaitGroup
 	for i := 0; i < config.UploadWorkers; i++ {
 		uploader, err := newUploader(i+1, config)
 		if err != nil {
 			return nil, err
 		}
-		uploader.run(fileStream, um.ArchiveStream, um.ArchiveEndStream, um.ReportStream)
+		uploader.traceContext = traceContext
+		uploader.recordingFilter = recordingFilter
+		uploader.acceptCtx = acceptCtx
+		wg.Add(1)
+		uploader.run(&wg, fileStream, um.ArchiveStream, um.ArchiveEndStream, um.ReportStream)
 		um.uploaders = append(um.uploaders, *uploader)
 	}
+	go func() {
+		wg.Wait()
+		close(um.stopped)
+	}()
 	go func() {
 		defer func() {
 			close(um.ArchiveStream)
@@ -95,8 +113,16 @@ func (um *UploaderManager) run(ctx context.Context, config *Config, fileStream <
 }
 
 type UploaderResult struct {
-	Success  bool
+	Success bool
+	// フィルタで除外された
+	Excluded bool
 	Filepath string
+	// ログと突き合わせるための処理ごとの ID
+	AttemptID string
+	// 失敗した原因と、その理由と扱い
+	Err         error
+	ErrorReason string
+	ErrorClass  string
 }
 
 type Uploader struct {
@@ -105,6 +131,13 @@ type Uploader struct {
 	ctx           context.Context
 	cancel        context.CancelFunc
 	base32Encoder *base32.Encoding
+	// ファイルが属する録画のトレースコンテキストを返す
+	traceContext func(string) context.Context
+	// ファイルが属する録画のフィルタの判定結果を返す
+	recordingFilter func(context.Context, string) (*filterDecision, error)
+	// 新しいファイルを受け取る間のコンテキスト
+	// 停止処理で終了した後は処理中のファイルだけを終わらせる
+	acceptCtx context.Context
 }
 
 func newUploader(id int, config *Config) (*Uploader, error) {
@@ -114,19 +147,29 @@ func newUploader(id int, config *Config) (*Uploader, error) {
 		base32Encoder: base32.NewEncoding(),
 	}
 	u.ctx, u.cancel = context.WithCancel(context.Background())
+	u.acceptCtx = u.ctx
 	return u, nil
 }
 
 func (u Uploader) run(
+	wg *sync.WaitGroup,
 	fileStream <-chan string,
 	outArchive chan UploaderResult,
 	outArchiveEnd chan UploaderResult,
 	outReport chan UploaderResult,
 ) {
 	go func() {
+		defer wg.Done()
 		for {
+			// 一時停止中は新しいファイルを受け取らない
+			if !uploadPause.wait(u.acceptCtx) {
+				zlog.Debug().
+					Int("uploader_id", u.id).
+					Msg("STOPPED-UPLOADER")
+				return
+			}
 			select {
-			case <-u.ctx.Done():
+			case <-u.acceptCtx.Done():
 				zlog.Debug().
 					Int("uploader_id", u.id).
 					Msg("STOPPED-UPLOADER")
@@ -135,62 +178,62 @@ func (u Uploader) run(
 				if !ok {
 					continue
 				}
+				// 停止処理を始めた後に受け取ったファイルは処理せず、次回の探索で処理する
+				if u.acceptCtx.Err() != nil {
+					zlog.Debug().
+						Int("uploader_id", u.id).
+						Str("file_path", inputFilepath).
+						Msg("SKIPPED-FILE-WHILE-DRAINING")
+					return
+				}
 				filename := filepath.Base(inputFilepath)
 				if strings.HasPrefix(filename, "report-") {
 					zlog.Debug().
 						Int("uploader_id", u.id).
 						Str("json_file_path", inputFilepath).
 						Msg("FOUND-AT-STARTUP")
-					ok := u.handleReport(inputFilepath)
+					result := u.handleFile(inputFilepath, "handle-report", u.handleReport)
 					select {
 					case <-u.ctx.Done():
 						return
-					case outReport <- UploaderResult{
-						Success:  ok,
-						Filepath: inputFilepath,
-					}:
+					case outReport <- result:
 					}
 				} else if strings.HasPrefix(filename, "split-archive-end-") {
 					zlog.Debug().
 						Int("uploader_id", u.id).
 						Str("json_file_path", inputFilepath).
 						Msg("FOUND-AT-STARTUP")
-					ok := u.handleArchiveEnd(inputFilepath)
+					result := u.handleFile(inputFilepath, "handle-archive-end", u.handleArchiveEnd)
 					select {
 					case <-u.ctx.Done():
 						return
-					case outArchiveEnd <- UploaderResult{
-						Success:  ok,
-						Filepath: inputFilepath,
-					}:
+					case outArchiveEnd <- result:
 					}
 				} else if strings.HasPrefix(filename, "archive-") {
 					zlog.Debug().
 						Int("uploader_id", u.id).
 						Str("file_path", inputFilepath).
 						Msg("FOUND-AT-STARTUP")
-					ok := u.handleArchive(inputFilepath, false)
+					result := u.handleFile(inputFilepath, "handle-archive", func(ctx context.Context, path string) error {
+						return u.handleArchive(ctx, path, false)
+					})
 					select {
 					case <-u.ctx.Done():
 						return
-					case outArchive <- UploaderResult{
-						Success:  ok,
-						Filepath: inputFilepath,
-					}:
+					case outArchive <- result:
 					}
 				} else if strings.HasPrefix(filename, "split-archive-") {
 					zlog.Debug().
 						Int("uploader_id", u.id).
 						Str("file_path", inputFilepath).
 						Msg("FOUND-AT-STARTUP")
-					ok := u.handleArchive(inputFilepath, true)
+					result := u.handleFile(inputFilepath, "handle-split-archive", func(ctx context.Context, path string) error {
+						return u.handleArchive(ctx, path, true)
+					})
 					select {
 					case <-u.ctx.Done():
 						return
-					case outArchive <- UploaderResult{
-						Success:  ok,
-						Filepath: inputFilepath,
-					}:
+					case outArchive <- result:
 					}
 				}
 			}
@@ -198,47 +241,107 @@ func (u Uploader) run(
 	}()
 }
 
+// フィルタで除外されなかった場合のみ handle を実行する
+func (u Uploader) handleFile(inputFilepath string, spanName string, handle func(context.Context, string) error) UploaderResult {
+	activeUploaders.Inc()
+	defer activeUploaders.Dec()
+	uploadStatus.start(inputFilepath, u.id)
+	defer uploadStatus.finish(inputFilepath)
+
+	ctx, span := u.startFileSpan(inputFilepath, spanName)
+	defer span.End()
+
+	// 同じファイルの処理を区別できるように処理ごとに ID を割り当て、処理中のログに出力する
+	// uuid のバイナリへの変換は失敗しない
+	attemptID, _ := u.generateWebhookID()
+	span.SetAttributes(attribute.String("attempt.id", attemptID))
+	ctx = u.contextWithFileLogger(ctx, inputFilepath, attemptID)
+
+	if u.excludeFile(ctx, inputFilepath) {
+		span.SetAttributes(attribute.Bool("file.excluded", true))
+		return UploaderResult{
+			Success:   true,
+			Excluded:  true,
+			Filepath:  inputFilepath,
+			AttemptID: attemptID,
+		}
+	}
+	ctx = contextWithStorageRetryBudget(ctx, u.config.StorageRetryBudget)
+	err := handle(ctx, inputFilepath)
+	if err != nil {
+		classification := u.config.classifyError(err)
+		span.SetAttributes(
+			attribute.String("error.reason", classification.Reason),
+			attribute.String("error.class", classification.Class),
+		)
+		span.SetStatus(codes.Error, "failed to handle file")
+		observeFileFailure(inputFilepath, classification)
+		return UploaderResult{
+			Err:         err,
+			ErrorReason: classification.Reason,
+			ErrorClass:  classification.Class,
+			Filepath:    inputFilepath,
+			AttemptID:   attemptID,
+		}
+	}
+	return UploaderResult{
+		Success:   true,
+		Filepath:  inputFilepath,
+		AttemptID: attemptID,
+	}
+}
+
+// 録画のスパンの子としてファイルのスパンを作成する
+// キャンセルはアップローダーのコンテキストに従う
+func (u Uploader) startFileSpan(inputFilepath string, spanName string) (context.Context, trace.Span) {
+	parent := context.Background()
+	if u.traceContext != nil {
+		parent = u.traceContext(inputFilepath)
+	}
+	ctx := trace.ContextWithSpan(u.ctx, trace.SpanFromContext(parent))
+	return tracer.Start(ctx, spanName, trace.WithAttributes(
+		attribute.Int("uploader.id", u.id),
+		attribute.String("file.path", inputFilepath),
+	))
+}
+
 func (u Uploader) Stop() {
 	u.cancel()
 }
 
-func (u Uploader) handleArchive(archiveJSONFilePath string, split bool) bool {
+func (u Uploader) handleArchive(ctx context.Context, archiveJSONFilePath string, split bool) error {
 	fileInfo, err := os.Stat(archiveJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
 			Msg("JSON-NOT-ACCESSIBLE")
-		return false
+		return err
 	}
 
 	// json をパースする
 	raw, err := os.ReadFile(archiveJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveJSONFilePath).
 			Msg("ARCHIVE-JSON-FILE-READ-ERROR")
-		return false
+		return err
 	}
 
 	var am ArchiveMetadata
 	if err := json.Unmarshal(raw, &am); err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveJSONFilePath).
 			Msg("ARCHIVE-JSON-PARSE-ERROR")
-		return false
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveJSONFilePath, archiveFilePaths(archiveJSONFilePath), "", err)
+		}
+		return err
 	}
 
 	// ここで s3 ファイルをアップロード
 	// json がくればファイルパスもわかる
-	zlog.Debug().
-		Int("uploader_id", u.id).
-		Str("recording_id", am.RecordingID).
-		Str("channel_id", am.ChannelID).
-		Str("connection_id", am.ConnectionID).
+	ctx = contextWithRecordingLogger(ctx, am.ChannelID, am.ConnectionID)
+	zerolog.Ctx(ctx).Debug().
 		Msg("ARCHIVE-METADATA-INFO")
 
 	// メディアファイルのパスを作っておく
@@ -247,349 +350,257 @@ func (u Uploader) handleArchive(archiveJSONFilePath string, split bool) bool {
 
 	// metadata ファイル (json) をアップロード
 	metadataFilename := fileInfo.Name()
-	metadataObjectKey := fmt.Sprintf("%s/%s", am.RecordingID, metadataFilename)
-	osConfig := &s3.S3CompatibleObjectStorage{
-		Endpoint:        u.config.ObjectStorageEndpoint,
-		BucketName:      u.config.ObjectStorageBucketName,
-		AccessKeyID:     u.config.ObjectStorageAccessKeyID,
-		SecretAccessKey: u.config.ObjectStorageSecretAccessKey,
-	}
+	metadataObjectKey := u.config.objectKey(archiveJSONFilePath, am.RecordingID, metadataFilename)
+	osConfig := u.objectStorageConfig()
 
 	// メディアファイルを開いておく
 	f, err := os.Open(mediaFilepath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveJSONFilePath).
 			Str("media_filename", am.FilePath).
 			Msg("MEDIA-FILE-OPEN-ERROR")
-		return false
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveJSONFilePath, []string{archiveJSONFilePath, mediaFilepath}, "", err)
+		}
+		return err
 	}
 	defer f.Close()
 
-	zlog.Info().
+	zerolog.Ctx(ctx).Info().
 		Str("path", mediaFilepath).
 		Msg("MEDIA-FILE-PATH")
 
-	metadataFileURL, err := uploadJSONFile(
-		u.ctx,
+	metadataFileURL, err := u.uploadJSONFile(
+		ctx,
 		osConfig,
 		metadataObjectKey,
 		archiveJSONFilePath,
 	)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveJSONFilePath).
 			Str("metadata_filename", metadataFilename).
 			Str("metadata_object_key", metadataObjectKey).
 			Msg("METADATA-FILE-UPLOAD-ERROR")
-		if !isFileContinuous(err) {
-			// リトライしないエラーの場合は、ファイルを削除
-			u.removeArchiveJSONFile(archiveJSONFilePath, mediaFilepath)
-			u.removeArchiveMediaFile(archiveJSONFilePath, mediaFilepath)
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveJSONFilePath, []string{archiveJSONFilePath, mediaFilepath}, metadataObjectKey, err)
 		}
-		return false
+		return err
 	}
-	zlog.Debug().
-		Int("uploader_id", u.id).
-		Str("uploaded_matadata", am.MetadataFilename).
+	zerolog.Ctx(ctx).Debug().
+		Str("uploaded_metadata", am.MetadataFilename).
 		Msg("UPLOAD-METADATA-FILE-SUCCESSFULLY")
 
-	mediaObjectKey := fmt.Sprintf("%s/%s", am.RecordingID, mediaFilename)
+	mediaObjectKey := u.config.objectKey(archiveJSONFilePath, am.RecordingID, mediaFilename)
 
-	var fileURL string
-	if u.config.UploadFileRateLimitMbps == 0 {
-		fileURL, err = uploadMediaFile(u.ctx, osConfig, mediaObjectKey, mediaFilepath)
-	} else {
-		fileURL, err = uploadMediaFileWithRateLimit(u.ctx, osConfig, mediaObjectKey, mediaFilepath, u.config.UploadFileRateLimitMbps)
-	}
+	fileURL, err := u.uploadMediaFile(ctx, osConfig, mediaObjectKey, mediaFilepath)
 
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveJSONFilePath).
 			Str("media_filename", mediaFilename).
 			Str("media_object_key", mediaObjectKey).
 			Msg("MEDIA-FILE-UPLOAD-ERROR")
-		if !isFileContinuous(err) {
-			// リトライしないエラーの場合は、ファイルを削除
-			u.removeArchiveJSONFile(archiveJSONFilePath, mediaFilepath)
-			u.removeArchiveMediaFile(archiveJSONFilePath, mediaFilepath)
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveJSONFilePath, []string{archiveJSONFilePath, mediaFilepath}, mediaObjectKey, err)
 		}
-		return false
+		return err
 	}
-	zlog.Debug().
-		Int("uploader_id", u.id).
-		Str("uploaded_media_file", am.Filename).
-		Msg("UPLOAD-MEDIA-FILE-SUCCESSFULLY")
-
 	if u.config.WebhookEndpointURL != "" {
-		var archiveUploadedType string
-		if split {
-			archiveUploadedType = u.config.WebhookTypeSplitArchiveUploaded
-		} else {
-			archiveUploadedType = u.config.WebhookTypeArchiveUploaded
-		}
+		archiveUploadedType := u.config.webhookTypeArchiveUploaded(split)
 		webhookID, err := u.generateWebhookID()
 		if err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
 				Str("uploaded_media_file", am.Filename).
 				Msg("WEBHOOK-ID-GENERATE-ERROR")
-			return false
-		}
-		var w = WebhookArchiveUploaded{
-			ID:               webhookID,
-			Type:             archiveUploadedType,
-			Timestamp:        time.Now().UTC(),
-			SessionID:        am.SessionID,
-			ClientID:         am.ClientID,
-			RecordingID:      am.RecordingID,
-			ChannelID:        am.ChannelID,
-			ConnectionID:     am.ConnectionID,
-			Filename:         mediaFilename,
-			FileURL:          fileURL,
-			MetadataFilename: metadataFilename,
-			MetadataFileURL:  metadataFileURL,
+			return err
 		}
+		w := newWebhookArchiveUploaded(archiveUploadedType, am, mediaFilename, fileURL, metadataFilename, metadataFileURL)
+		w.ID = webhookID
 		buf, err := json.Marshal(w)
 		if err != nil {
-			zlog.Error().
-				Int("uploader_id", u.id).
+			zerolog.Ctx(ctx).Error().
 				Err(err).
 				Msg("ARCHIVE-UPLOADED-WEBHOOK-MARSHAL-ERROR")
-			return false
+			return err
 		}
 		if err := u.postWebhook(
+			ctx,
 			archiveUploadedType,
 			buf,
 		); err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
-				Str("recording_id", w.RecordingID).
-				Str("channel_id", w.ChannelID).
 				Str("filename", w.Filename).
 				Str("metadata_filename", w.MetadataFilename).
 				Msg("ARCHIVE-UPLOADED-WEBHOOK-SEND-ERROR")
-			return false
+			return err
 		}
 	}
 
 	// 処理し終わったファイルを削除
-	jsonError := u.removeArchiveJSONFile(archiveJSONFilePath, mediaFilepath)
-	mediaFileError := u.removeArchiveMediaFile(archiveJSONFilePath, mediaFilepath)
-	return jsonError == nil && mediaFileError == nil
+	jsonError := u.removeArchiveJSONFile(ctx, archiveJSONFilePath, mediaFilepath)
+	mediaFileError := u.removeArchiveMediaFile(ctx, archiveJSONFilePath, mediaFilepath)
+	return errors.Join(jsonError, mediaFileError)
 }
 
-func (u Uploader) handleReport(reportJSONFilePath string) bool {
+func (u Uploader) handleReport(ctx context.Context, reportJSONFilePath string) error {
 	fileInfo, err := os.Stat(reportJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Msg("JSON-NOT-ACCESSABLE")
-		return false
+			Msg("JSON-NOT-ACCESSIBLE")
+		return err
 	}
 
 	// report- ファイルのアップロード
 	// json をパースする
 	raw, err := os.ReadFile(reportJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", reportJSONFilePath).
 			Msg("REPORT-JSON-FILE-READ-ERROR")
-		return false
+		return err
 	}
 	var rr RecordingReport
 	if err := json.Unmarshal(raw, &rr); err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", reportJSONFilePath).
 			Msg("REPORT-JSON-FILE-UNMARSHAL-ERROR")
-		return false
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, reportJSONFilePath, []string{reportJSONFilePath}, "", err)
+		}
+		return err
 	}
+	ctx = contextWithRecordingLogger(ctx, rr.ChannelID, "")
 
 	// report ファイル (json) をアップロード
 	filename := fileInfo.Name()
-	reportObjectKey := fmt.Sprintf("%s/%s", rr.RecordingID, filename)
-	osConfig := &s3.S3CompatibleObjectStorage{
-		Endpoint:        u.config.ObjectStorageEndpoint,
-		BucketName:      u.config.ObjectStorageBucketName,
-		AccessKeyID:     u.config.ObjectStorageAccessKeyID,
-		SecretAccessKey: u.config.ObjectStorageSecretAccessKey,
-	}
+	reportObjectKey := u.config.objectKey(reportJSONFilePath, rr.RecordingID, filename)
+	osConfig := u.objectStorageConfig()
 
-	fileURL, err := uploadJSONFile(
-		u.ctx,
+	fileURL, err := u.uploadJSONFile(
+		ctx,
 		osConfig,
 		reportObjectKey,
 		reportJSONFilePath,
 	)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
 			Str("filename", filename).
 			Str("report_object_key", reportObjectKey).
 			Msg("REPORT-FILE-UPLOAD-ERROR")
-		if !isFileContinuous(err) {
-			// リトライしないエラーの場合は、ファイルを削除
-			u.removeReportFile(reportJSONFilePath)
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, reportJSONFilePath, []string{reportJSONFilePath}, reportObjectKey, err)
 		}
-		return false
+		return err
 	}
-	zlog.Debug().
-		Int("uploader_id", u.id).
-		Str("uplaoded_report", filename).
+	zerolog.Ctx(ctx).Debug().
+		Str("uploaded_report", filename).
 		Msg("UPLOAD-REPORT-JSON-SUCCESSFULLY")
 
 	if u.config.WebhookEndpointURL != "" {
 		webhookID, err := u.generateWebhookID()
 		if err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
 				Str("uploaded_report", filename).
 				Msg("WEBHOOK-ID-GENERATE-ERROR")
-			return false
-		}
-		var w = WebhookReportUploaded{
-			ID:          webhookID,
-			Type:        u.config.WebhookTypeReportUploaded,
-			Timestamp:   time.Now().UTC(),
-			RecordingID: rr.RecordingID,
-			ChannelID:   rr.ChannelID,
-			Filename:    filename,
-			FileURL:     fileURL,
-		}
-
-		// recording_metadata の除外設定が *無効* の時は recording_metadata をウェブフックに含める
-		// 関数は !config.ExcludeWebhookRecordingMetadata の値を返しています
-		if u.config.IncludeWebhookRecordingMetadata() {
-			// セッション録画とレガシー録画では、録画の metadata のキーが異なるための分岐
-			// SessionID が空でなければセッション録画とみなす
-			if rr.SessionID != "" {
-				w.RecordingMetadata = rr.RecordingMetadata
-			} else {
-				w.RecordingMetadata = rr.Metadata
-			}
+			return err
 		}
+		w := newWebhookReportUploaded(u.config, rr, filename, fileURL)
+		w.ID = webhookID
 
 		buf, err := json.Marshal(w)
 		if err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
-				Str("recording_id", w.RecordingID).
-				Str("channel_id", w.ChannelID).
 				Str("filename", w.Filename).
-				Msg("REPORT-UPLOAD-WEBHOOK-MARSHAL-ERROR")
-			return false
+				Msg("REPORT-UPLOADED-WEBHOOK-MARSHAL-ERROR")
+			return err
 		}
 		if err := u.postWebhook(
+			ctx,
 			u.config.WebhookTypeReportUploaded,
 			buf,
 		); err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
-				Str("recording_id", w.RecordingID).
-				Str("channel_id", w.ChannelID).
 				Str("filename", w.Filename).
 				Msg("REPORT-UPLOADED-WEBHOOK-SEND-ERROR")
-			return false
+			return err
 		}
-		zlog.Debug().
-			Int("uploader_id", u.id).
-			Str("recording_id", w.RecordingID).
-			Str("channel_id", w.ChannelID).
+		zerolog.Ctx(ctx).Debug().
 			Str("filename", w.Filename).
 			Msg("REPORT-UPLOADED-WEBHOOK-SEND-SUCCESSFULLY")
 	}
 
 	// 処理し終わったファイルを削除
-	if err = u.removeReportFile(reportJSONFilePath); err != nil {
-		return false
+	if err = u.removeReportFile(ctx, reportJSONFilePath); err != nil {
+		return err
 	}
-	return true
+	return nil
 }
 
-func (u Uploader) handleArchiveEnd(archiveEndJSONFilePath string) bool {
+func (u Uploader) handleArchiveEnd(ctx context.Context, archiveEndJSONFilePath string) error {
 	fileInfo, err := os.Stat(archiveEndJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
 			Msg("JSON-NOT-ACCESSIBLE")
-		return false
+		return err
 	}
 
 	// json をパースする
 	raw, err := os.ReadFile(archiveEndJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveEndJSONFilePath).
-			Msg("archive json file read error")
-		return false
+			Msg("ARCHIVE-END-JSON-FILE-READ-ERROR")
+		return err
 	}
 
 	var aem ArchiveEndMetadata
 	if err := json.Unmarshal(raw, &aem); err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveEndJSONFilePath).
 			Msg("ARCHIVE-END-JSON-FILE-PARSE-ERROR")
-		return false
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveEndJSONFilePath, []string{archiveEndJSONFilePath}, "", err)
+		}
+		return err
 	}
 
-	zlog.Debug().
-		Int("uploader_id", u.id).
-		Str("recording_id", aem.RecordingID).
-		Str("channel_id", aem.ChannelID).
-		Str("connection_id", aem.ConnectionID).
+	ctx = contextWithRecordingLogger(ctx, aem.ChannelID, aem.ConnectionID)
+	zerolog.Ctx(ctx).Debug().
 		Msg("ARCHIVE-END-METADATA-INFO")
 
 	// metadata ファイル (json) をアップロード
 	filename := fileInfo.Name()
-	objectKey := fmt.Sprintf("%s/%s", aem.RecordingID, filename)
-	osConfig := &s3.S3CompatibleObjectStorage{
-		Endpoint:        u.config.ObjectStorageEndpoint,
-		BucketName:      u.config.ObjectStorageBucketName,
-		AccessKeyID:     u.config.ObjectStorageAccessKeyID,
-		SecretAccessKey: u.config.ObjectStorageSecretAccessKey,
-	}
+	objectKey := u.config.objectKey(archiveEndJSONFilePath, aem.RecordingID, filename)
+	osConfig := u.objectStorageConfig()
 
-	archiveEndURL, err := uploadJSONFile(
-		u.ctx,
+	archiveEndURL, err := u.uploadJSONFile(
+		ctx,
 		osConfig,
 		objectKey,
 		archiveEndJSONFilePath,
 	)
 	if err != nil {
-		zlog.Error().
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
-			Str("path", archiveEndJSONFilePath).
 			Str("filename", filename).
 			Str("object_key", objectKey).
-			Msg("METADATA-FILE-UPLOAD-ERROR")
-		if !isFileContinuous(err) {
-			u.removeArchiveEndFile(archiveEndJSONFilePath)
+			Msg("ARCHIVE-END-FILE-UPLOAD-ERROR")
+		if u.shouldQuarantine(err) {
+			u.quarantineFiles(ctx, archiveEndJSONFilePath, []string{archiveEndJSONFilePath}, objectKey, err)
 		}
-		return false
+		return err
 	}
-	zlog.Debug().
-		Int("uploader_id", u.id).
+	zerolog.Ctx(ctx).Debug().
 		Str("uploaded_archive_end", aem.Filename).
 		Str("archive_end_presigned_url", archiveEndURL).
 		Msg("UPLOAD-ARCHIVE-END-FILE-SUCCESSFULLY")
@@ -597,67 +608,54 @@ func (u Uploader) handleArchiveEnd(archiveEndJSONFilePath string) bool {
 	if u.config.WebhookEndpointURL != "" {
 		webhookID, err := u.generateWebhookID()
 		if err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
 				Str("uploaded_archive_end", aem.Filename).
 				Str("archive_end_presigned_url", archiveEndURL).
 				Msg("WEBHOOK-ID-GENERATE-ERROR")
-			return false
-		}
-		var w = WebhookArchiveEndUploaded{
-			ID:           webhookID,
-			Type:         u.config.WebhookTypeSplitArchiveEndUploaded,
-			Timestamp:    time.Now().UTC(),
-			RecordingID:  aem.RecordingID,
-			SessionID:    aem.SessionID,
-			ClientID:     aem.ClientID,
-			ChannelID:    aem.ChannelID,
-			ConnectionID: aem.ConnectionID,
-			Filename:     filename,
-			FileURL:      archiveEndURL,
+			return err
 		}
+		w := newWebhookArchiveEndUploaded(u.config.WebhookTypeSplitArchiveEndUploaded, aem, filename, archiveEndURL)
+		w.ID = webhookID
 		buf, err := json.Marshal(w)
 		if err != nil {
-			zlog.Error().
-				Int("uploader_id", u.id).
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Msg("ARCHIVE-UPLOADED-WEBHOOK-MARSHAL-ERROR")
-			return false
+				Msg("ARCHIVE-END-UPLOADED-WEBHOOK-MARSHAL-ERROR")
+			return err
 		}
 		if err := u.postWebhook(
+			ctx,
 			u.config.WebhookTypeSplitArchiveEndUploaded,
 			buf,
 		); err != nil {
-			zlog.Error().
+			zerolog.Ctx(ctx).Error().
 				Err(err).
-				Int("uploader_id", u.id).
-				Str("recording_id", w.RecordingID).
-				Str("channel_id", w.ChannelID).
 				Str("filename", w.Filename).
 				Msg("ARCHIVE-END-UPLOADED-WEBHOOK-SEND-ERROR")
-			return false
+			return err
 		}
 	}
 
-	if err = u.removeArchiveEndFile(archiveEndJSONFilePath); err != nil {
-		return false
+	if err = u.removeArchiveEndFile(ctx, archiveEndJSONFilePath); err != nil {
+		return err
 	}
-	return true
+	return nil
 }
 
-func (u Uploader) removeArchiveJSONFile(metadataFilePath, mediaFilepath string) error {
+func (u Uploader) removeArchiveJSONFile(ctx context.Context, metadataFilePath, mediaFilepath string) error {
+	_, span := startRemoveFileSpan(ctx, metadataFilePath)
+	defer span.End()
 	err := os.Remove(metadataFilePath)
 	if err != nil {
-		zlog.Error().
+		recordSpanError(span, err)
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
 			Str("metadata_filepath", metadataFilePath).
 			Str("media_filepath", mediaFilepath).
 			Msg("FAILED-REMOVE-METADATA-JSON-FILE")
 	} else {
-		zlog.Debug().
-			Int("uploader_id", u.id).
+		zerolog.Ctx(ctx).Debug().
 			Str("metadata_filepath", metadataFilePath).
 			Str("media_filepath", mediaFilepath).
 			Msg("REMOVED-METADATA-JSON-FILE")
@@ -665,34 +663,36 @@ func (u Uploader) removeArchiveJSONFile(metadataFilePath, mediaFilepath string)
 	return err
 }
 
-func (u Uploader) removeArchiveMediaFile(metadataFilePath, mediaFilepath string) error {
+func (u Uploader) removeArchiveMediaFile(ctx context.Context, metadataFilePath, mediaFilepath string) error {
+	_, span := startRemoveFileSpan(ctx, mediaFilepath)
+	defer span.End()
 	err := os.Remove(mediaFilepath)
 	if err != nil {
-		zlog.Error().
+		recordSpanError(span, err)
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
 			Str("media_filepath", mediaFilepath).
 			Msg("FAILED-REMOVE-ARCHIVE-MEDIA-FILE")
 	} else {
-		zlog.Debug().
-			Int("uploader_id", u.id).
+		zerolog.Ctx(ctx).Debug().
 			Str("media_filepath", mediaFilepath).
 			Msg("REMOVED-ARCHIVE-MEDIA-FILE-SUCCESSFULLY")
 	}
 	return err
 }
 
-func (u Uploader) removeReportFile(reportJSONFilePath string) error {
+func (u Uploader) removeReportFile(ctx context.Context, reportJSONFilePath string) error {
+	_, span := startRemoveFileSpan(ctx, reportJSONFilePath)
+	defer span.End()
 	err := os.Remove(reportJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		recordSpanError(span, err)
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
 			Str("filepath", reportJSONFilePath).
 			Msg("FAILED-REMOVE-REPORT-JSON-FILE")
 	} else {
-		zlog.Debug().
-			Int("uploader_id", u.id).
+		zerolog.Ctx(ctx).Debug().
 			Str("filepath", reportJSONFilePath).
 			Msg("REMOVED-REPORT-JSON-FILE")
 
@@ -700,28 +700,144 @@ func (u Uploader) removeReportFile(reportJSONFilePath string) error {
 	return err
 }
 
-func (u Uploader) removeArchiveEndFile(archiveEndJSONFilePath string) error {
+func (u Uploader) removeArchiveEndFile(ctx context.Context, archiveEndJSONFilePath string) error {
+	_, span := startRemoveFileSpan(ctx, archiveEndJSONFilePath)
+	defer span.End()
 	err := os.Remove(archiveEndJSONFilePath)
 	if err != nil {
-		zlog.Error().
+		recordSpanError(span, err)
+		zerolog.Ctx(ctx).Error().
 			Err(err).
-			Int("uploader_id", u.id).
 			Str("filepath", archiveEndJSONFilePath).
 			Msg("FAILED-REMOVE-ARCHIVE-END-FILE")
 	} else {
-		zlog.Debug().
-			Int("uploader_id", u.id).
+		zerolog.Ctx(ctx).Debug().
 			Str("filepath", archiveEndJSONFilePath).
 			Msg("REMOVED-ARCHIVE-END-FILE")
 	}
 	return err
 }
 
-func (u Uploader) generateWebhookID() (string, error) {
-	id := uuid.New()
-	binaryUUID, err := id.MarshalBinary()
+func (u Uploader) objectStorageConfig() *s3.S3CompatibleObjectStorage {
+	return u.config.objectStorageConfig()
+}
+
+func (u Uploader) uploadJSONFile(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, objectKey, filePath string) (string, error) {
+	ctx, span := tracer.Start(ctx, "upload-json-file", trace.WithAttributes(
+		attribute.String("file.path", filePath),
+		attribute.String("object.key", objectKey),
+	))
+	defer span.End()
+	var fileURL string
+	// リトライしてもファイルを読み直さないように、MD5 はファイルごとに 1 回だけ計算する
+	md5Sum, err := fileMD5(filePath)
+	if err == nil {
+		err = u.retryStorageOperation(ctx, "upload-json-file", objectKey, func(ctx context.Context) error {
+			var err error
+			fileURL, err = uploadJSONFile(ctx, osConfig, objectKey, filePath, md5Sum)
+			return err
+		})
+	}
+	if err == nil && u.config.RemoveEmptyRecordingDirectory {
+		err = u.verifyUploadedObject(ctx, osConfig, objectKey, filePath, md5Sum)
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		u.recordFailure("upload-json-file", filePath, objectKey, err)
+	}
+	return fileURL, err
+}
+
+// メディアファイルは帯域制限の設定に従ってアップロードする
+func (u Uploader) uploadMediaFile(ctx context.Context, osConfig *s3.S3CompatibleObjectStorage, objectKey, filePath string) (string, error) {
+	ctx, span := tracer.Start(ctx, "upload-media-file", trace.WithAttributes(
+		attribute.String("file.path", filePath),
+		attribute.String("object.key", objectKey),
+		attribute.Int("rate_limit_mbps", u.config.UploadFileRateLimitMbps),
+	))
+	defer span.End()
+
+	// 進捗をログと管理用 API、メトリクスで確認できるようにする
+	var size int64
+	if info, err := os.Stat(filePath); err == nil {
+		size = info.Size()
+	}
+	defer uploadStatus.setProgress(u.id, nil)
+
+	var fileURL string
+	// リトライしてもファイルを読み直さないように、MD5 はファイルごとに 1 回だけ計算する
+	md5Sum, err := fileMD5(filePath)
 	if err != nil {
+		recordSpanError(span, err)
+		u.recordFailure("upload-media-file", filePath, objectKey, err)
 		return "", err
 	}
-	return u.base32Encoder.EncodeToString(binaryUUID), nil
+	if size > multipartUploadThreshold {
+		// パートごとにリトライするため、進捗は失敗したパートの分だけ戻す
+		progress := newUploadProgress(objectKey, size)
+		uploadStatus.setProgress(u.id, progress)
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		go progress.watch(watchCtx, time.Duration(u.config.UploadProgressLogIntervalS)*time.Second)
+		retry := func(ctx context.Context, operation string, op func(context.Context) error) error {
+			return u.retryStorageOperation(ctx, operation, objectKey, op)
+		}
+		fileURL, err = uploadMediaFileMultipart(ctx, osConfig, objectKey, filePath, md5Sum, u.config.UploadFileRateLimitMbps, progress, retry)
+	} else {
+		err = u.retryStorageOperation(ctx, "upload-media-file", objectKey, func(ctx context.Context) error {
+			// リトライした場合は最初から数え直す
+			progress := newUploadProgress(objectKey, size)
+			uploadStatus.setProgress(u.id, progress)
+			watchCtx, stopWatch := context.WithCancel(ctx)
+			defer stopWatch()
+			go progress.watch(watchCtx, time.Duration(u.config.UploadProgressLogIntervalS)*time.Second)
+
+			var err error
+			if u.config.UploadFileRateLimitMbps == 0 {
+				fileURL, err = uploadMediaFile(ctx, osConfig, objectKey, filePath, md5Sum, progress)
+			} else {
+				fileURL, err = uploadMediaFileWithRateLimit(ctx, osConfig, objectKey, filePath, md5Sum, u.config.UploadFileRateLimitMbps, progress)
+			}
+			return err
+		})
+	}
+	if err == nil && u.config.RemoveEmptyRecordingDirectory {
+		err = u.verifyUploadedObject(ctx, osConfig, objectKey, filePath, md5Sum)
+	}
+	if err != nil {
+		recordSpanError(span, err)
+		u.recordFailure("upload-media-file", filePath, objectKey, err)
+	}
+	return fileURL, err
+}
+
+// 分類したエラーの扱いが quarantine であれば、ファイルを隔離ディレクトリに移動する
+func (u Uploader) shouldQuarantine(err error) bool {
+	return u.config.classifyError(err).Class == ErrorClassQuarantine
+}
+
+// archive json ファイルと、同じ名前のメディアファイルのパスを返す
+// json ファイルをパースできない場合にメディアファイルと一緒に隔離するために使う
+func archiveFilePaths(archiveJSONFilePath string) []string {
+	return []string{
+		archiveJSONFilePath,
+		replaceFilenamePattern.ReplaceAllString(archiveJSONFilePath, ".webm"),
+		replaceFilenamePattern.ReplaceAllString(archiveJSONFilePath, ".mp4"),
+	}
+}
+
+func (u Uploader) generateWebhookID() (string, error) {
+	return generateWebhookID(u.base32Encoder)
+}
+
+// 管理用 API で確認できるように失敗を記録する
+func (u Uploader) recordFailure(operation, filePath, objectKey string, err error) {
+	uploadStatus.recordFailure(&UploadFailure{
+		Path:       filePath,
+		ObjectKey:  objectKey,
+		UploaderID: u.id,
+		Operation:  operation,
+		Error:      err.Error(),
+		Timestamp:  time.Now().UTC(),
+	})
 }
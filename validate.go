@@ -0,0 +1,405 @@
+package archive
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 設定項目の値の誤り
+type configError struct {
+	// [archive_root.<name>] などのセクション名、トップレベルの場合は空文字
+	Section string
+	Key     string
+	Message string
+}
+
+func (e *configError) Error() string {
+	// セクション自体の誤り
+	if e.Key == "" {
+		return fmt.Sprintf("%s: %s", e.Section, e.Message)
+	}
+	if e.Section != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Section, e.Key, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+type configErrors []error
+
+func (errs *configErrors) add(section, key, format string, args ...any) {
+	*errs = append(*errs, &configError{
+		Section: section,
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// 設定値の必須項目、範囲、URL の形式、TLS のファイルを確認し、すべての誤りをまとめて返す
+// ファイルシステムの状態に依存する確認は validateDirectories で行う
+func (c *Config) validate() error {
+	var errs configErrors
+
+	if len(c.ArchiveRoots) == 0 {
+		errs.add("", "archive_dir_full_path", "is required")
+	}
+	for _, root := range c.ArchiveRoots {
+		section := c.archiveRootSection(root)
+		if root.ArchiveDirFullPath == "" {
+			errs.add(section, "archive_dir_full_path", "is required")
+		} else if !filepath.IsAbs(root.ArchiveDirFullPath) {
+			errs.add(section, "archive_dir_full_path", "must be an absolute path: %q", root.ArchiveDirFullPath)
+		}
+		if root.EvacuateDirFullPath == "" {
+			errs.add(section, "evacuate_dir_full_path", "is required")
+		} else if !filepath.IsAbs(root.EvacuateDirFullPath) {
+			errs.add(section, "evacuate_dir_full_path", "must be an absolute path: %q", root.EvacuateDirFullPath)
+		}
+	}
+	c.validateArchiveRootConflicts(&errs)
+
+	if c.ObjectStorageEndpoint == "" {
+		errs.add("", "object_storage_endpoint", "is required")
+	} else if strings.Contains(c.ObjectStorageEndpoint, "://") {
+		validateURL(&errs, "object_storage_endpoint", c.ObjectStorageEndpoint)
+	}
+	if c.ObjectStorageBucketName == "" {
+		errs.add("", "object_storage_bucket_name", "is required")
+	}
+	if (c.ObjectStorageAccessKeyID == "") != (c.ObjectStorageSecretAccessKey == "") {
+		errs.add("", "object_storage_access_key_id", "must be set together with object_storage_secret_access_key")
+	}
+
+	if c.UploadWorkers <= 0 {
+		errs.add("", "upload_workers", "must be greater than 0: %d", c.UploadWorkers)
+	}
+	for _, v := range []struct {
+		key   string
+		value int64
+	}{
+		{"archive_dir_max_depth", int64(c.ArchiveDirMaxDepth)},
+		{"log_rotate_max_size", int64(c.LogRotateMaxSize)},
+		{"log_rotate_max_backups", int64(c.LogRotateMaxBackups)},
+		{"log_rotate_max_age", int64(c.LogRotateMaxAge)},
+		{"evacuate_retention_max_age_h", c.EvacuateRetentionMaxAgeH},
+		{"evacuate_retention_max_total_size_mb", c.EvacuateRetentionMaxTotalSizeMB},
+		{"disk_pressure_min_free_mb", c.DiskPressureMinFreeMB},
+		{"disk_pressure_upload_workers", int64(c.DiskPressureUploadWorkers)},
+		{"stuck_recording_grace_period_s", c.StuckRecordingGracePeriodS},
+		{"scan_interval_s", int64(c.ScanIntervalS)},
+		{"shutdown_drain_timeout_s", int64(c.ShutdownDrainTimeoutS)},
+		{"upload_max_attempts", int64(c.UploadMaxAttempts)},
+		{"upload_retry_backoff_initial_s", int64(c.UploadRetryBackoffInitialS)},
+		{"upload_retry_backoff_max_s", int64(c.UploadRetryBackoffMaxS)},
+		{"storage_retry_budget", int64(c.StorageRetryBudget)},
+		{"storage_retry_interval_initial_ms", int64(c.StorageRetryIntervalInitialMS)},
+		{"storage_retry_interval_max_ms", int64(c.StorageRetryIntervalMaxMS)},
+		{"storage_client_max_retries", int64(c.StorageClientMaxRetries)},
+		{"upload_file_rate_limit_mbps", int64(c.UploadFileRateLimitMbps)},
+		{"upload_progress_log_interval_s", int64(c.UploadProgressLogIntervalS)},
+		{"webhook_request_timeout_s", int64(c.WebhookRequestTimeoutS)},
+	} {
+		if v.value < 0 {
+			errs.add("", v.key, "must not be negative: %d", v.value)
+		}
+	}
+	if c.DiskPressureThresholdPercent < 0 || c.DiskPressureThresholdPercent > 100 {
+		errs.add("", "disk_pressure_threshold_percent", "must be between 0 and 100: %d", c.DiskPressureThresholdPercent)
+	}
+
+	switch c.filterExcludedAction() {
+	case FilterExcludedActionKeep, FilterExcludedActionDelete:
+	case FilterExcludedActionMove:
+		if c.FilterExcludedDirFullPath == "" {
+			errs.add("", "filter_excluded_dir_full_path", "is required when filter_excluded_action is %q", FilterExcludedActionMove)
+		}
+	default:
+		errs.add("", "filter_excluded_action", "unsupported value: %q", c.FilterExcludedAction)
+	}
+	for _, key := range slices.Sorted(maps.Keys(c.ErrorClassOverrides)) {
+		if class := c.ErrorClassOverrides[key]; !isErrorClass(class) {
+			errs.add(ErrorClassSectionName, key, "unsupported value: %q", class)
+		}
+	}
+	if c.UploadMaxAttempts > 0 {
+		if c.UploadAttemptsDirFullPath == "" {
+			errs.add("", "upload_attempts_dir_full_path", "is required when upload_max_attempts is set")
+		}
+		if c.UploadFailedDirFullPath == "" {
+			errs.add("", "upload_failed_dir_full_path", "is required when upload_max_attempts is set")
+		}
+	}
+	switch c.stuckRecordingAction() {
+	case StuckRecordingActionReport, StuckRecordingActionUpload:
+	case StuckRecordingActionQuarantine:
+		if c.StuckRecordingQuarantineDirFullPath == "" {
+			errs.add("", "stuck_recording_quarantine_dir_full_path", "is required when stuck_recording_action is %q", StuckRecordingActionQuarantine)
+		}
+	default:
+		errs.add("", "stuck_recording_action", "unsupported value: %q", c.StuckRecordingAction)
+	}
+
+	switch c.lockMode() {
+	case LockModeExit, LockModeWait:
+	default:
+		errs.add("", "lock_mode", "unsupported value: %q", c.LockMode)
+	}
+
+	for _, v := range []struct {
+		key   string
+		value string
+	}{
+		{"filter_excluded_dir_full_path", c.FilterExcludedDirFullPath},
+		{"quarantine_dir_full_path", c.QuarantineDirFullPath},
+		{"stuck_recording_quarantine_dir_full_path", c.StuckRecordingQuarantineDirFullPath},
+		{"webhook_payload_store_dir_full_path", c.WebhookPayloadStoreDirFullPath},
+		{"recording_lock_dir_full_path", c.RecordingLockDirFullPath},
+		{"upload_attempts_dir_full_path", c.UploadAttemptsDirFullPath},
+		{"upload_failed_dir_full_path", c.UploadFailedDirFullPath},
+	} {
+		if v.value != "" && !filepath.IsAbs(v.value) {
+			errs.add("", v.key, "must be an absolute path: %q", v.value)
+		}
+	}
+
+	if c.MetricsListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsListenAddr); err != nil {
+			errs.add("", "metrics_listen_addr", "invalid address: %s", err)
+		}
+	}
+	if c.AdminListenAddr != "" && !strings.HasPrefix(c.AdminListenAddr, "unix:") {
+		// 管理用 HTTP API には認証がないため、ループバックアドレス以外では待ち受けない
+		if host, _, err := net.SplitHostPort(c.AdminListenAddr); err != nil {
+			errs.add("", "admin_listen_addr", "invalid address: %s", err)
+		} else if !isLoopbackHost(host) {
+			errs.add("", "admin_listen_addr", "must be a loopback address or a unix socket: %q", c.AdminListenAddr)
+		}
+	}
+	if c.TracingOTLPEndpointURL != "" {
+		validateURL(&errs, "tracing_otlp_endpoint_url", c.TracingOTLPEndpointURL)
+	}
+
+	if c.WebhookEndpointURL != "" {
+		validateURL(&errs, "webhook_endpoint_url", c.WebhookEndpointURL)
+		if c.WebhookTypeHeaderName == "" {
+			errs.add("", "webhook_type_header_name", "is required when webhook_endpoint_url is set")
+		}
+	}
+	if c.RunSummaryWebhook && c.WebhookEndpointURL == "" {
+		errs.add("", "webhook_endpoint_url", "is required when run_summary_webhook is true")
+	}
+	if c.WebhookEndpointHealthCheckURL != "" {
+		validateURL(&errs, "webhook_endpoint_health_check_url", c.WebhookEndpointHealthCheckURL)
+	}
+	if c.WebhookBasicAuthUsername != "" && c.WebhookBasicAuthPassword == "" {
+		errs.add("", "webhook_basic_auth_password", "is required when webhook_basic_auth_username is set")
+	}
+	c.validateWebhookTLS(&errs)
+
+	return errors.Join(errs...)
+}
+
+// アーカイブディレクトリの名前の重複と、アーカイブディレクトリのパスの重複や入れ子を確認する
+// 入れ子になっていると、同じ録画ディレクトリを複数のアーカイブディレクトリで処理してしまう
+func (c *Config) validateArchiveRootConflicts(errs *configErrors) {
+	for i, root := range c.ArchiveRoots {
+		section := c.archiveRootSection(root)
+		for _, other := range c.ArchiveRoots[:i] {
+			if root.Name != other.Name {
+				continue
+			}
+			if other.topLevel {
+				errs.add(section, "", "name %q is reserved for archive_dir_full_path", root.Name)
+			} else {
+				errs.add(section, "", "duplicate archive root name: %q", root.Name)
+			}
+			break
+		}
+		if !filepath.IsAbs(root.ArchiveDirFullPath) {
+			continue
+		}
+		for _, other := range c.ArchiveRoots[:i] {
+			if !filepath.IsAbs(other.ArchiveDirFullPath) || !isSameOrNestedPath(root.ArchiveDirFullPath, other.ArchiveDirFullPath) {
+				continue
+			}
+			otherKey := "archive_dir_full_path"
+			if otherSection := c.archiveRootSection(other); otherSection != "" {
+				otherKey = otherSection + "." + otherKey
+			}
+			errs.add(section, "archive_dir_full_path", "overlaps with %s: %q and %q", otherKey, root.ArchiveDirFullPath, other.ArchiveDirFullPath)
+		}
+	}
+}
+
+// 2 つのパスが同じか、一方がもう一方の中にある
+func isSameOrNestedPath(a, b string) bool {
+	within := func(child, parent string) bool {
+		rel, err := filepath.Rel(parent, child)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(a, b) || within(b, a)
+}
+
+func (c *Config) archiveRootSection(root *ArchiveRoot) string {
+	// 従来の archive_dir_full_path から作ったアーカイブディレクトリはトップレベルの設定
+	if root.topLevel {
+		return ""
+	}
+	return ArchiveRootSectionPrefix + root.Name
+}
+
+func validateURL(errs *configErrors, key, value string) {
+	u, err := url.Parse(value)
+	if err != nil {
+		errs.add("", key, "invalid URL: %s", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		errs.add("", key, "scheme must be http or https: %q", value)
+		return
+	}
+	if u.Host == "" {
+		errs.add("", key, "host is required: %q", value)
+	}
+}
+
+// createHTTPClient が mTLS の設定を読み込めるか確認する
+func (c *Config) validateWebhookTLS(errs *configErrors) {
+	if c.WebhookTLSVerifyCacertPath != "" {
+		pem, err := os.ReadFile(c.WebhookTLSVerifyCacertPath)
+		if err != nil {
+			errs.add("", "webhook_tls_verify_cacert_path", "cannot read: %s", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			errs.add("", "webhook_tls_verify_cacert_path", "no PEM certificate found: %q", c.WebhookTLSVerifyCacertPath)
+		}
+	}
+	if (c.WebhookTLSFullchainPath == "") != (c.WebhookTLSPrivkeyPath == "") {
+		errs.add("", "webhook_tls_fullchain_path", "must be set together with webhook_tls_privkey_path")
+		return
+	}
+	if c.WebhookTLSFullchainPath == "" {
+		return
+	}
+	if c.WebhookTLSVerifyCacertPath == "" {
+		// webhook_tls_verify_cacert_path がない場合はクライアント証明書を使わない
+		errs.add("", "webhook_tls_verify_cacert_path", "is required when webhook_tls_fullchain_path is set")
+	}
+	if _, err := tls.LoadX509KeyPair(c.WebhookTLSFullchainPath, c.WebhookTLSPrivkeyPath); err != nil {
+		errs.add("", "webhook_tls_fullchain_path", "cannot load key pair with webhook_tls_privkey_path: %s", err)
+	}
+}
+
+// ディレクトリの存在とパーミッションを確認し、すべての誤りをまとめて返す
+func (c *Config) validateDirectories() error {
+	var errs configErrors
+
+	for _, root := range c.ArchiveRoots {
+		section := c.archiveRootSection(root)
+		// アップロードしたファイルを削除し、録画ディレクトリを移動する
+		if err := checkDirectory(root.ArchiveDirFullPath, unix.R_OK|unix.W_OK|unix.X_OK); err != nil {
+			errs.add(section, "archive_dir_full_path", "%s", err)
+		}
+		if err := checkCreatableDirectory(root.EvacuateDirFullPath); err != nil {
+			errs.add(section, "evacuate_dir_full_path", "%s", err)
+		}
+	}
+	for _, v := range []struct {
+		key   string
+		value string
+	}{
+		{"filter_excluded_dir_full_path", c.FilterExcludedDirFullPath},
+		{"quarantine_dir_full_path", c.QuarantineDirFullPath},
+		{"stuck_recording_quarantine_dir_full_path", c.StuckRecordingQuarantineDirFullPath},
+		{"webhook_payload_store_dir_full_path", c.WebhookPayloadStoreDirFullPath},
+		{"recording_lock_dir_full_path", c.RecordingLockDirFullPath},
+		{"upload_attempts_dir_full_path", c.UploadAttemptsDirFullPath},
+		{"upload_failed_dir_full_path", c.UploadFailedDirFullPath},
+	} {
+		if v.value == "" {
+			continue
+		}
+		if err := checkCreatableDirectory(v.value); err != nil {
+			errs.add("", v.key, "%s", err)
+		}
+	}
+	if c.LockFilePath != "" {
+		if err := checkDirectory(filepath.Dir(c.LockFilePath), unix.W_OK|unix.X_OK); err != nil {
+			errs.add("", "lock_file_path", "%s", err)
+		}
+	}
+	if c.RunSummaryFilePath != "" {
+		if err := checkDirectory(filepath.Dir(c.RunSummaryFilePath), unix.W_OK|unix.X_OK); err != nil {
+			errs.add("", "run_summary_file_path", "%s", err)
+		}
+	}
+	if c.MetricsTextfilePath != "" {
+		if err := checkDirectory(filepath.Dir(c.MetricsTextfilePath), unix.W_OK|unix.X_OK); err != nil {
+			errs.add("", "metrics_textfile_path", "%s", err)
+		}
+	}
+	mode := uint32(unix.X_OK)
+	if !c.LogStdout {
+		mode |= unix.W_OK
+	}
+	if err := checkDirectory(c.LogDir, mode); err != nil {
+		errs.add("", "log_dir", "%s", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkDirectory(dirPath string, mode uint32) error {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: %s", dirPath)
+	}
+	if err := unix.Access(dirPath, mode); err != nil {
+		return fmt.Errorf("permission denied: %s", dirPath)
+	}
+	return nil
+}
+
+// ディレクトリが存在しない場合は、存在する最も近い親ディレクトリに作成できるか確認する
+func checkCreatableDirectory(dirPath string) error {
+	for p := filepath.Clean(dirPath); ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			return checkDirectory(p, unix.W_OK|unix.X_OK)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if p == filepath.Dir(p) {
+			return fmt.Errorf("no existing parent directory: %s", dirPath)
+		}
+	}
+}
+
+// errors.Join でまとめた誤りを 1 件ずつ返す
+func configErrorList(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// localhost かループバックアドレスか
+// 空のホストはすべてのインターフェースで待ち受けるため false を返す
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,160 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	configFilePath := filepath.Join(t.TempDir(), "config.ini")
+	require.NoError(t, os.WriteFile(configFilePath, []byte(content), 0644))
+	return configFilePath
+}
+
+func configErrorMessages(err error) []string {
+	var result []string
+	for _, e := range configErrorList(err) {
+		result = append(result, e.Error())
+	}
+	return result
+}
+
+func TestNewConfigValidate(t *testing.T) {
+	root := t.TempDir()
+	config, err := newConfig(writeTestConfig(t, `
+archive_dir_full_path = `+root+`/archive
+evacuate_dir_full_path = `+root+`/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+upload_workers = 4
+admin_listen_addr = 127.0.0.1:9732
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 4, config.UploadWorkers)
+
+	// すべての誤りをまとめて返す
+	_, err = newConfig(writeTestConfig(t, `
+object_storage_endpoint = ftp://s3.example.com
+object_storage_access_key_id = access-key-id
+upload_workers = 0
+disk_pressure_threshold_percent = 101
+webhook_endpoint_url = example.com/webhook
+webhook_tls_fullchain_path = /path/to/fullchain.pem
+admin_listen_addr = 0.0.0.0:9732
+
+[archive_root.sora2]
+archive_dir_full_path = relative/archive
+`))
+	require.Error(t, err)
+	assert.ElementsMatch(t, []string{
+		`archive_root.sora2: archive_dir_full_path: must be an absolute path: "relative/archive"`,
+		`archive_root.sora2: evacuate_dir_full_path: is required`,
+		`object_storage_endpoint: scheme must be http or https: "ftp://s3.example.com"`,
+		`object_storage_bucket_name: is required`,
+		`object_storage_access_key_id: must be set together with object_storage_secret_access_key`,
+		`upload_workers: must be greater than 0: 0`,
+		`disk_pressure_threshold_percent: must be between 0 and 100: 101`,
+		`webhook_endpoint_url: scheme must be http or https: "example.com/webhook"`,
+		`webhook_type_header_name: is required when webhook_endpoint_url is set`,
+		`webhook_tls_fullchain_path: must be set together with webhook_tls_privkey_path`,
+		`admin_listen_addr: must be a loopback address or a unix socket: "0.0.0.0:9732"`,
+	}, configErrorMessages(err))
+}
+
+func TestValidateArchiveRootConflicts(t *testing.T) {
+	root := t.TempDir()
+	_, err := newConfig(writeTestConfig(t, `
+archive_dir_full_path = `+root+`/archive
+evacuate_dir_full_path = `+root+`/evacuate
+object_storage_endpoint = https://s3.example.com
+object_storage_bucket_name = bucket
+upload_workers = 1
+
+[archive_root.default]
+archive_dir_full_path = `+root+`/default
+evacuate_dir_full_path = `+root+`/default-evacuate
+
+[archive_root.nested]
+archive_dir_full_path = `+root+`/archive/nested
+evacuate_dir_full_path = `+root+`/nested-evacuate
+
+[archive_root.same]
+archive_dir_full_path = `+root+`/default/
+evacuate_dir_full_path = `+root+`/same-evacuate
+
+[archive_root.sibling]
+archive_dir_full_path = `+root+`/archive2
+evacuate_dir_full_path = `+root+`/sibling-evacuate
+`))
+	require.Error(t, err)
+	assert.ElementsMatch(t, []string{
+		`archive_root.default: name "default" is reserved for archive_dir_full_path`,
+		`archive_root.nested: archive_dir_full_path: overlaps with archive_dir_full_path: "` + root + `/archive/nested" and "` + root + `/archive"`,
+		`archive_root.same: archive_dir_full_path: overlaps with archive_root.default.archive_dir_full_path: "` + root + `/default/" and "` + root + `/default"`,
+	}, configErrorMessages(err))
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	assert.True(t, isLoopbackHost("localhost"))
+	assert.True(t, isLoopbackHost("127.0.0.1"))
+	assert.True(t, isLoopbackHost("::1"))
+	// すべてのインターフェースで待ち受けるアドレスは許可しない
+	assert.False(t, isLoopbackHost(""))
+	assert.False(t, isLoopbackHost("0.0.0.0"))
+	assert.False(t, isLoopbackHost("192.0.2.1"))
+	assert.False(t, isLoopbackHost("example.com"))
+}
+
+func TestValidateWebhookTLS(t *testing.T) {
+	dir := t.TempDir()
+	invalidPEM := filepath.Join(dir, "invalid.pem")
+	require.NoError(t, os.WriteFile(invalidPEM, []byte("invalid"), 0644))
+
+	config := &Config{
+		WebhookTLSVerifyCacertPath: invalidPEM,
+		WebhookTLSFullchainPath:    invalidPEM,
+		WebhookTLSPrivkeyPath:      filepath.Join(dir, "missing.pem"),
+	}
+	var errs configErrors
+	config.validateWebhookTLS(&errs)
+	require.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "webhook_tls_verify_cacert_path: no PEM certificate found")
+	assert.Contains(t, errs[1].Error(), "webhook_tls_fullchain_path: cannot load key pair")
+}
+
+func TestValidateDirectories(t *testing.T) {
+	root := t.TempDir()
+	archiveDir := filepath.Join(root, "archive")
+	require.NoError(t, os.Mkdir(archiveDir, 0755))
+	writeTestFile(t, filepath.Join(root, "file"))
+
+	config := &Config{
+		LogDir:    root,
+		LogStdout: true,
+		ArchiveRoots: []*ArchiveRoot{
+			// 存在しない退避ディレクトリは作成できれば良い
+			{Name: "default", ArchiveDirFullPath: archiveDir, EvacuateDirFullPath: filepath.Join(root, "evacuate", "sora")},
+		},
+	}
+	require.NoError(t, config.validateDirectories())
+
+	config.ArchiveRoots = append(config.ArchiveRoots, &ArchiveRoot{
+		Name:                "missing",
+		ArchiveDirFullPath:  filepath.Join(root, "missing"),
+		EvacuateDirFullPath: filepath.Join(root, "file", "evacuate"),
+	})
+	config.QuarantineDirFullPath = filepath.Join(root, "file")
+	err := config.validateDirectories()
+	require.Error(t, err)
+	messages := configErrorMessages(err)
+	require.Len(t, messages, 3)
+	assert.Contains(t, messages[0], "archive_root.missing: archive_dir_full_path: ")
+	assert.Contains(t, messages[1], "archive_root.missing: evacuate_dir_full_path: ")
+	assert.Contains(t, messages[1], "not a directory")
+	assert.Contains(t, messages[2], "quarantine_dir_full_path: not a directory")
+}
@@ -2,6 +2,7 @@ package archive
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,7 +10,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	base32 "github.com/shogo82148/go-clockwork-base32"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WebhookReportUploaded struct {
@@ -51,6 +61,120 @@ type WebhookArchiveEndUploaded struct {
 	FileURL      string    `json:"file_url"`
 }
 
+type WebhookRecordingIncomplete struct {
+	ID          string                  `json:"id"`
+	Type        string                  `json:"type"`
+	Timestamp   time.Time               `json:"timestamp"`
+	RecordingID string                  `json:"recording_id"`
+	ChannelID   string                  `json:"channel_id,omitempty"`
+	Reasons     []string                `json:"reasons"`
+	Files       []WebhookIncompleteFile `json:"files"`
+}
+
+type WebhookIncompleteFile struct {
+	Filename string `json:"filename"`
+	FileURL  string `json:"file_url"`
+}
+
+type WebhookDiskPressure struct {
+	ID               string    `json:"id"`
+	Type             string    `json:"type"`
+	Timestamp        time.Time `json:"timestamp"`
+	Path             string    `json:"path"`
+	TotalBytes       uint64    `json:"total_bytes"`
+	FreeBytes        uint64    `json:"free_bytes"`
+	UsedPercent      float64   `json:"used_percent"`
+	ThresholdPercent int       `json:"threshold_percent"`
+	MinFreeMB        int64     `json:"min_free_mb"`
+}
+
+type WebhookUploadFailed struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	Timestamp   time.Time `json:"timestamp"`
+	RecordingID string    `json:"recording_id"`
+	// 移動前と移動後の録画ディレクトリのパス
+	RecordingDir  string `json:"recording_dir"`
+	FailedDirPath string `json:"failed_dir_path"`
+	// ファイル名ごとの失敗履歴
+	Files map[string]*FileAttempts `json:"files"`
+}
+
+type WebhookRunSummary struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	*RunSummary
+}
+
+// split-archive ファイルかどうかでアップロードしたウェブフックの種類を返す
+func (c Config) webhookTypeArchiveUploaded(split bool) string {
+	if split {
+		return c.WebhookTypeSplitArchiveUploaded
+	}
+	return c.WebhookTypeArchiveUploaded
+}
+
+// archive ファイルと split-archive ファイルのアップロードのウェブフックを組み立てる
+// ID は呼び出し側で設定する
+func newWebhookArchiveUploaded(webhookType string, am ArchiveMetadata, filename, fileURL, metadataFilename, metadataFileURL string) *WebhookArchiveUploaded {
+	return &WebhookArchiveUploaded{
+		Type:             webhookType,
+		Timestamp:        time.Now().UTC(),
+		SessionID:        am.SessionID,
+		ClientID:         am.ClientID,
+		RecordingID:      am.RecordingID,
+		ChannelID:        am.ChannelID,
+		ConnectionID:     am.ConnectionID,
+		Filename:         filename,
+		FileURL:          fileURL,
+		MetadataFilename: metadataFilename,
+		MetadataFileURL:  metadataFileURL,
+	}
+}
+
+// split-archive-end ファイルのアップロードのウェブフックを組み立てる
+// ID は呼び出し側で設定する
+func newWebhookArchiveEndUploaded(webhookType string, aem ArchiveEndMetadata, filename, fileURL string) *WebhookArchiveEndUploaded {
+	return &WebhookArchiveEndUploaded{
+		Type:         webhookType,
+		Timestamp:    time.Now().UTC(),
+		RecordingID:  aem.RecordingID,
+		SessionID:    aem.SessionID,
+		ClientID:     aem.ClientID,
+		ChannelID:    aem.ChannelID,
+		ConnectionID: aem.ConnectionID,
+		Filename:     filename,
+		FileURL:      fileURL,
+	}
+}
+
+// report ファイルのアップロードのウェブフックを組み立てる
+// ID は呼び出し側で設定する
+func newWebhookReportUploaded(config *Config, rr RecordingReport, filename, fileURL string) *WebhookReportUploaded {
+	w := &WebhookReportUploaded{
+		Type:        config.WebhookTypeReportUploaded,
+		Timestamp:   time.Now().UTC(),
+		RecordingID: rr.RecordingID,
+		ChannelID:   rr.ChannelID,
+		Filename:    filename,
+		FileURL:     fileURL,
+	}
+
+	// recording_metadata の除外設定が *無効* の時は recording_metadata をウェブフックに含める
+	// 関数は !config.ExcludeWebhookRecordingMetadata の値を返しています
+	if config.IncludeWebhookRecordingMetadata() {
+		// セッション録画とレガシー録画では、録画の metadata のキーが異なるための分岐
+		// SessionID が空でなければセッション録画とみなす
+		if rr.SessionID != "" {
+			w.RecordingMetadata = rr.RecordingMetadata
+		} else {
+			w.RecordingMetadata = rr.Metadata
+		}
+	}
+	return w
+}
+
 // mTLS を組み込んだ http.Client を構築する
 func createHTTPClient(config *Config) (*http.Client, error) {
 	e, err := url.Parse(config.WebhookEndpointURL)
@@ -107,41 +231,145 @@ func createHTTPClient(config *Config) (*http.Client, error) {
 	return client, nil
 }
 
-func (u Uploader) httpClientDo(client *http.Client, webhookType string, buf []byte) error {
-	req, err := http.NewRequest("POST", u.config.WebhookEndpointURL, bytes.NewBuffer(buf))
+func httpClientDo(ctx context.Context, config *Config, client *http.Client, webhookType string, buf []byte) error {
+	ctx, span := tracer.Start(ctx, "post-webhook", trace.WithAttributes(
+		attribute.String("webhook.type", webhookType),
+	))
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.WebhookEndpointURL, bytes.NewBuffer(buf))
 	if err != nil {
+		recordSpanError(span, err)
 		return err
 	}
+	// トレースコンテキストを traceparent ヘッダーで伝搬する
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	// 固有ヘッダーを追加する
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Add(u.config.WebhookTypeHeaderName, webhookType)
+	req.Header.Add(config.WebhookTypeHeaderName, webhookType)
 
 	// 設定があれば Basic 認証に対応する
-	if u.config.WebhookBasicAuthUsername != "" && u.config.WebhookBasicAuthPassword != "" {
-		req.SetBasicAuth(u.config.WebhookBasicAuthUsername, u.config.WebhookBasicAuthPassword)
+	if config.WebhookBasicAuthUsername != "" && config.WebhookBasicAuthPassword != "" {
+		req.SetBasicAuth(config.WebhookBasicAuthUsername, config.WebhookBasicAuthPassword)
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		observeWebhook(webhookType, 0, time.Since(start))
+		recordSpanError(span, err)
 		return err
 	}
 	defer resp.Body.Close()
+	observeWebhook(webhookType, resp.StatusCode, time.Since(start))
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("status_code: %d", resp.StatusCode)
+		err := fmt.Errorf("status_code: %d", resp.StatusCode)
+		recordSpanError(span, err)
+		return err
 	}
 
 	return nil
 }
 
-func (u Uploader) postWebhook(webhookType string, buf []byte) error {
-	client, err := createHTTPClient(u.config)
+func postWebhook(ctx context.Context, config *Config, webhookType string, buf []byte) error {
+	client, err := createHTTPClient(config)
 	if err != nil {
 		return err
 	}
-	if err := u.httpClientDo(client, webhookType, buf); err != nil {
+	if err := httpClientDo(ctx, config, client, webhookType, buf); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (u Uploader) postWebhook(ctx context.Context, webhookType string, buf []byte) error {
+	// resend-webhook で再送できるように、送信の成否にかかわらず保存する
+	if u.config.WebhookPayloadStoreDirFullPath != "" {
+		if err := storeWebhookPayload(u.config, webhookType, buf); err != nil {
+			zerolog.Ctx(ctx).Error().
+				Err(err).
+				Str("webhook_type", webhookType).
+				Msg("FAILED-STORE-WEBHOOK-PAYLOAD")
+		}
+	}
+	err := postWebhook(ctx, u.config, webhookType, buf)
+	if err != nil {
+		u.recordFailure("post-webhook:"+webhookType, "", "", err)
+	}
+	return err
+}
+
+func generateWebhookID(encoder *base32.Encoding) (string, error) {
+	id := uuid.New()
+	binaryUUID, err := id.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return encoder.EncodeToString(binaryUUID), nil
+}
+
+// resend-webhook で再送するために保存したウェブフック
+type StoredWebhook struct {
+	Type     string          `json:"type"`
+	StoredAt time.Time       `json:"stored_at"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// 録画 ID ごとのディレクトリにウェブフックのペイロードを保存する
+// 録画 ID を持たないウェブフックは保存しない
+func storeWebhookPayload(config *Config, webhookType string, buf []byte) error {
+	var payload struct {
+		ID          string `json:"id"`
+		RecordingID string `json:"recording_id"`
+	}
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		return err
+	}
+	if payload.RecordingID == "" {
+		return nil
+	}
+	dir := filepath.Join(config.WebhookPayloadStoreDirFullPath, filepath.Base(payload.RecordingID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	raw, err := json.Marshal(StoredWebhook{
+		Type:     webhookType,
+		StoredAt: now,
+		Payload:  buf,
+	})
+	if err != nil {
+		return err
+	}
+	// ファイル名の順に並べると保存した順になる
+	filename := fmt.Sprintf("%d-%s.json", now.UnixNano(), payload.ID)
+	return os.WriteFile(filepath.Join(dir, filename), raw, 0600)
+}
+
+// 録画 ID のウェブフックを保存した順に返す
+func loadStoredWebhooks(config *Config, recordingID string) ([]*StoredWebhook, error) {
+	dir := filepath.Join(config.WebhookPayloadStoreDirFullPath, filepath.Base(recordingID))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []*StoredWebhook
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var w StoredWebhook
+		if err := json.Unmarshal(raw, &w); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		result = append(result, &w)
+	}
+	return result, nil
+}